@@ -0,0 +1,56 @@
+package environment
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/javanhut/isobox/pkg/ipkg"
+)
+
+// qemuNames maps Alpine architectures to the names qemu-user registers
+// with binfmt_misc
+var qemuNames = map[string]string{
+	"x86_64":      "x86_64",
+	"x86":         "i386",
+	"aarch64":     "aarch64",
+	"armv7":       "arm",
+	"armhf":       "arm",
+	"ppc64le":     "ppc64le",
+	"s390x":       "s390x",
+	"riscv64":     "riscv64",
+	"loongarch64": "loongarch64",
+}
+
+// CheckArch returns an error if the host cannot run binaries built for
+// arch: it must be the host architecture, 32-bit x86 on an x86_64 host, or
+// emulated by qemu-user through binfmt_misc. The emulator must be
+// registered with the F flag so it keeps working inside the chroot.
+func CheckArch(arch string) error {
+	host := ipkg.HostArch()
+	if arch == host || (arch == "x86" && host == "x86_64") {
+		return nil
+	}
+
+	name, ok := qemuNames[arch]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %s", arch)
+	}
+
+	data, err := os.ReadFile("/proc/sys/fs/binfmt_misc/qemu-" + name)
+	if err != nil {
+		return fmt.Errorf("this %s host cannot run %s binaries: install qemu-user-static and register it with binfmt_misc", host, arch)
+	}
+
+	status := string(data)
+	if !strings.HasPrefix(status, "enabled") {
+		return fmt.Errorf("the qemu-%s binfmt_misc handler is disabled; enable it to run %s binaries", name, arch)
+	}
+	for _, line := range strings.Split(status, "\n") {
+		if flags, ok := strings.CutPrefix(line, "flags:"); ok && !strings.Contains(flags, "F") {
+			return fmt.Errorf("the qemu-%s binfmt_misc handler lacks the F flag, so it cannot run inside a chroot; register it with the F flag (qemu-user-static packages do)", name)
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package environment
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,30 +9,46 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
+
+	"github.com/javanhut/isobox/pkg/ipkg"
 )
 
 type Environment struct {
-	Root      string    `json:"root"`
-	Created   time.Time `json:"created"`
-	IsoboxDir string    `json:"isobox_dir"`
-	Username  string    `json:"username"`
-	Shell     string    `json:"shell"`
+	Root          string    `json:"root"`
+	Created       time.Time `json:"created"`
+	IsoboxDir     string    `json:"isobox_dir"`
+	Username      string    `json:"username"`
+	Shell         string    `json:"shell"`
+	AlpineVersion string    `json:"alpine_version,omitempty"`
+	Arch          string    `json:"arch,omitempty"`
+
+	pm *ipkg.PackageManager
 }
 
-func getBaseCachePath() string {
+func getBaseCachePath(branch, arch string) string {
+	name := fmt.Sprintf("base-system-%s-%s.tar.gz", branch, arch)
 	home, err := os.UserHomeDir()
 	if err != nil {
-		return "/tmp/isobox-base-system.tar.gz"
+		return "/tmp/isobox-" + name
 	}
 	cacheDir := filepath.Join(home, ".cache", "isobox")
 	os.MkdirAll(cacheDir, 0755)
-	return filepath.Join(cacheDir, "base-system.tar.gz")
+	return filepath.Join(cacheDir, name)
 }
 
-func RebuildCache() error {
-	cachePath := getBaseCachePath()
+// RebuildCache deletes and rebuilds the base system cache of a branch and
+// architecture. Cancelling ctx stops the build and removes its temporary files.
+func RebuildCache(ctx context.Context, alpineVersion, arch string) error {
+	branch := ipkg.NormalizeBranch(alpineVersion)
+	arch, err := ipkg.NormalizeArch(arch)
+	if err != nil {
+		return err
+	}
+	if err := CheckArch(arch); err != nil {
+		return err
+	}
+	cachePath := getBaseCachePath(branch, arch)
 
 	if _, err := os.Stat(cachePath); err == nil {
 		fmt.Printf("Deleting old cache: %s\n", cachePath)
@@ -40,18 +57,15 @@ func RebuildCache() error {
 		}
 	}
 
-	fmt.Println("Rebuilding base system cache...")
-	if err := buildBaseSystem(cachePath); err != nil {
+	fmt.Printf("Rebuilding base system cache (Alpine %s, %s)...\n", branch, arch)
+	if err := buildBaseSystem(ctx, cachePath, branch, arch); err != nil {
 		return fmt.Errorf("rebuild failed: %w", err)
 	}
 
 	return nil
 }
 
-func buildBaseSystem(cachePath string) error {
-	// Install performance optimization tools
-	installOptimizationTools()
-
+func buildBaseSystem(ctx context.Context, cachePath, branch, arch string) error {
 	tmpDir, err := os.MkdirTemp("", "isobox-base-*")
 	if err != nil {
 		return fmt.Errorf("create temp dir: %w", err)
@@ -62,7 +76,9 @@ func buildBaseSystem(cachePath string) error {
 	fmt.Println("This will be cached for faster initialization in the future.")
 
 	tmpEnv := &Environment{
-		IsoboxDir: tmpDir,
+		IsoboxDir:     tmpDir,
+		AlpineVersion: branch,
+		Arch:          arch,
 	}
 
 	dirs := []string{
@@ -83,32 +99,36 @@ func buildBaseSystem(cachePath string) error {
 	}
 
 	fmt.Println("\nSetting up POSIX binaries...")
-	busybox := findBusybox()
-	if busybox == "" {
-		return fmt.Errorf("BusyBox not found")
+
+	// The host's BusyBox only runs in environments of the host architecture
+	var busybox string
+	if arch == ipkg.HostArch() {
+		if busybox = findBusybox(); busybox == "" {
+			return fmt.Errorf("BusyBox not found")
+		}
 	}
-	if err := tmpEnv.setupWithBusybox(busybox); err != nil {
+	if err := tmpEnv.setupWithBusybox(ctx, busybox); err != nil {
 		return err
 	}
 
-	if err := tmpEnv.setupShells(); err != nil {
-		fmt.Printf("  Warning: Shell setup failed: %v\n", err)
+	if err := tmpEnv.setupShells(ctx); err != nil {
+		return err
 	}
 
+	// A cancelled build must not leave an incomplete cache behind
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Environments fetch their own package index; one stored in the cache
+	// would only go stale
+	os.RemoveAll(ipkg.IndexCacheDir(tmpDir))
+
 	fmt.Println("\nCreating base system tarball...")
 	fmt.Print("  Compressing... ")
 
-	// Use pigz for parallel compression if available, otherwise use gzip
-	var cmd *exec.Cmd
-	if _, err := exec.LookPath("pigz"); err == nil {
-		// pigz uses all available CPU cores by default
-		cmd = exec.Command("tar", "--use-compress-program=pigz", "-cf", cachePath, "-C", tmpDir, ".")
-	} else {
-		cmd = exec.Command("tar", "-czf", cachePath, "-C", tmpDir, ".")
-	}
-
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("create tarball: %w (output: %s)", err, string(output))
+	if err := createTarball(cachePath, tmpDir); err != nil {
+		return fmt.Errorf("create tarball: %w", err)
 	}
 
 	fmt.Println("Done!")
@@ -116,95 +136,30 @@ func buildBaseSystem(cachePath string) error {
 	return nil
 }
 
-func installOptimizationTools() {
-	// Check if tools are already installed
-	hasAria2c := false
-	hasPigz := false
-
-	if _, err := exec.LookPath("aria2c"); err == nil {
-		hasAria2c = true
-	}
-	if _, err := exec.LookPath("pigz"); err == nil {
-		hasPigz = true
-	}
-
-	if hasAria2c && hasPigz {
-		return
-	}
-
-	// Detect OS
-	osRelease, err := os.ReadFile("/etc/os-release")
-	if err != nil {
-		return
-	}
-
-	osInfo := string(osRelease)
-	var installCmd []string
-	var packages []string
-
-	if !hasAria2c {
-		packages = append(packages, "aria2")
-	}
-	if !hasPigz {
-		packages = append(packages, "pigz")
-	}
-
-	// Determine package manager based on OS
-	if strings.Contains(osInfo, "ID=arch") || strings.Contains(osInfo, "ID_LIKE=arch") {
-		installCmd = append([]string{"pacman", "-S", "--noconfirm", "--needed"}, packages...)
-	} else if strings.Contains(osInfo, "ID=ubuntu") || strings.Contains(osInfo, "ID=debian") || strings.Contains(osInfo, "ID_LIKE=debian") {
-		installCmd = append([]string{"apt-get", "install", "-y"}, packages...)
-	} else if strings.Contains(osInfo, "ID=fedora") || strings.Contains(osInfo, "ID=rhel") || strings.Contains(osInfo, "ID_LIKE=\"rhel fedora\"") {
-		installCmd = append([]string{"dnf", "install", "-y"}, packages...)
-	} else if strings.Contains(osInfo, "ID=centos") {
-		installCmd = append([]string{"yum", "install", "-y"}, packages...)
-	} else if strings.Contains(osInfo, "ID=opensuse") || strings.Contains(osInfo, "ID_LIKE=\"suse\"") {
-		installCmd = append([]string{"zypper", "install", "-y"}, packages...)
-	} else if strings.Contains(osInfo, "ID=alpine") {
-		installCmd = append([]string{"apk", "add"}, packages...)
-	} else {
-		// Unknown OS, skip installation
-		return
-	}
-
-	fmt.Printf("Installing performance tools (%s)...\n", strings.Join(packages, ", "))
-
-	cmd := exec.Command("sudo", installCmd...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("  Warning: Failed to install optimization tools: %v\n", err)
-		fmt.Printf("  Continuing with standard tools (wget, gzip)\n")
-	} else {
-		fmt.Println("  Performance tools installed successfully!")
-	}
-}
-
 func extractBaseSystem(targetDir, cachePath string) error {
 	fmt.Print("Extracting base system... ")
 
-	// Use pigz for parallel decompression if available
-	var cmd *exec.Cmd
-	if _, err := exec.LookPath("pigz"); err == nil {
-		cmd = exec.Command("tar", "--use-compress-program=pigz", "-xf", cachePath, "-C", targetDir)
-	} else {
-		cmd = exec.Command("tar", "-xzf", cachePath, "-C", targetDir)
-	}
-
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("extract tarball: %w (output: %s)", err, string(output))
+	if err := extractTarball(cachePath, targetDir); err != nil {
+		return fmt.Errorf("extract tarball: %w", err)
 	}
 	fmt.Println("Done!")
 	return nil
 }
 
-func Initialize(path string, shell string) (*Environment, error) {
+func Initialize(ctx context.Context, path string, shell string, alpineVersion string, arch string) (*Environment, error) {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return nil, fmt.Errorf("get absolute path: %w", err)
 	}
 
+	arch, err = ipkg.NormalizeArch(arch)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckArch(arch); err != nil {
+		return nil, err
+	}
+
 	if err := os.MkdirAll(absPath, 0755); err != nil {
 		return nil, fmt.Errorf("create directory: %w", err)
 	}
@@ -217,18 +172,20 @@ func Initialize(path string, shell string) (*Environment, error) {
 	}
 
 	env := &Environment{
-		Root:      absPath,
-		Created:   time.Now(),
-		IsoboxDir: isoboxDir,
-		Username:  username,
-		Shell:     shell,
+		Root:          absPath,
+		Created:       time.Now(),
+		IsoboxDir:     isoboxDir,
+		Username:      username,
+		Shell:         shell,
+		AlpineVersion: ipkg.NormalizeBranch(alpineVersion),
+		Arch:          arch,
 	}
 
-	baseCachePath := getBaseCachePath()
+	baseCachePath := getBaseCachePath(env.AlpineVersion, env.Arch)
 
 	if _, err := os.Stat(baseCachePath); os.IsNotExist(err) {
 		fmt.Println("Building base system (first time only, this will be cached)...")
-		if err := buildBaseSystem(baseCachePath); err != nil {
+		if err := buildBaseSystem(ctx, baseCachePath, env.AlpineVersion, env.Arch); err != nil {
 			return nil, fmt.Errorf("build base system: %w", err)
 		}
 	} else {
@@ -257,10 +214,18 @@ func Initialize(path string, shell string) (*Environment, error) {
 		return nil, err
 	}
 
+	if err := env.setupRepositories(); err != nil {
+		return nil, err
+	}
+
 	if err := env.save(); err != nil {
 		return nil, err
 	}
 
+	if err := env.runDeferredScripts(ctx); err != nil {
+		return nil, err
+	}
+
 	return env, nil
 }
 
@@ -280,6 +245,9 @@ func Load(path string) (*Environment, error) {
 	if err := json.Unmarshal(data, &env); err != nil {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
+	if env.Arch == "" {
+		env.Arch = ipkg.LegacyArch
+	}
 
 	return &env, nil
 }
@@ -362,57 +330,66 @@ func (e *Environment) createDeviceNodes() error {
 	return nil
 }
 
-func (e *Environment) setupBinaries() error {
+func (e *Environment) setupBinaries(ctx context.Context) error {
 	fmt.Println("\nSetting up POSIX binaries...")
 
 	busybox := findBusybox()
 	if busybox != "" {
-		return e.setupWithBusybox(busybox)
+		return e.setupWithBusybox(ctx, busybox)
 	}
 
 	return e.setupWithSystemBinaries()
 }
 
-func (e *Environment) setupWithBusybox(busyboxPath string) error {
-	fmt.Printf("Found BusyBox at: %s\n", busyboxPath)
+// setupWithBusybox copies the host's BusyBox at busyboxPath into the
+// environment, or installs Alpine's if busyboxPath is empty, then adds the
+// base packages
+func (e *Environment) setupWithBusybox(ctx context.Context, busyboxPath string) error {
+	if busyboxPath == "" {
+		if err := e.installBusyboxPackage(ctx); err != nil {
+			return fmt.Errorf("install busybox: %w", err)
+		}
+	} else {
+		fmt.Printf("Found BusyBox at: %s\n", busyboxPath)
 
-	destBusybox := filepath.Join(e.IsoboxDir, "bin/busybox")
-	if err := copyBinary(busyboxPath, destBusybox); err != nil {
-		return fmt.Errorf("copy busybox: %w", err)
-	}
+		destBusybox := filepath.Join(e.IsoboxDir, "bin/busybox")
+		if err := copyBinary(busyboxPath, destBusybox); err != nil {
+			return fmt.Errorf("copy busybox: %w", err)
+		}
 
-	if err := os.Chmod(destBusybox, 0755); err != nil {
-		return err
-	}
+		if err := os.Chmod(destBusybox, 0755); err != nil {
+			return err
+		}
 
-	binDir := filepath.Join(e.IsoboxDir, "bin")
-	cmd := exec.Command("./busybox", "--install", "-s", ".")
-	cmd.Dir = binDir
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("install busybox applets: %w", err)
-	}
+		binDir := filepath.Join(e.IsoboxDir, "bin")
+		cmd := exec.Command("./busybox", "--install", "-s", ".")
+		cmd.Dir = binDir
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("install busybox applets: %w", err)
+		}
 
-	if err := e.fixBusyboxSymlinks(); err != nil {
-		return fmt.Errorf("fix symlinks: %w", err)
+		if err := e.fixBusyboxSymlinks(); err != nil {
+			return fmt.Errorf("fix symlinks: %w", err)
+		}
 	}
 
-	if err := e.addSSLCapableTools(); err != nil {
-		fmt.Printf("  Warning: SSL tools setup failed: %v\n", err)
+	if err := e.addSSLCapableTools(ctx); err != nil {
+		return fmt.Errorf("SSL tools setup failed: %w", err)
 	}
 
-	if err := e.installMuslLibc(); err != nil {
-		fmt.Printf("  Warning: musl libc setup failed: %v\n", err)
+	if err := e.installMuslLibc(ctx); err != nil {
+		return err
 	}
 
-	if err := e.installAlpineBaseDeps(); err != nil {
-		fmt.Printf("  Warning: Alpine base dependencies setup failed: %v\n", err)
+	if err := e.installAlpineBaseDeps(ctx); err != nil {
+		return fmt.Errorf("Alpine base dependencies setup failed: %w", err)
 	}
 
 	fmt.Println("  Installed BusyBox and 150+ Unix utilities")
 	return nil
 }
 
-func (e *Environment) installAlpineBaseDeps() error {
+func (e *Environment) installAlpineBaseDeps(ctx context.Context) error {
 	deps := []string{
 		// Core C/C++ runtime libraries
 		"musl",
@@ -521,314 +498,61 @@ func (e *Environment) installAlpineBaseDeps() error {
 		"libuv",
 	}
 
-	return e.installAlpinePackages(deps)
+	return e.installAlpinePackages(ctx, deps)
 }
 
-func (e *Environment) addSSLCapableTools() error {
+func (e *Environment) addSSLCapableTools(ctx context.Context) error {
+	// ca-certificates brings Alpine's bundle when the host has none to copy
 	if err := e.setupSSLCertificates(); err != nil {
 		fmt.Printf("  Warning: SSL certificates setup failed: %v\n", err)
-		return err
 	}
 
 	packages := []string{"wget", "ca-certificates"}
-	return e.installAlpinePackages(packages)
+	return e.installAlpinePackages(ctx, packages)
 }
 
-// installAlpinePackages installs multiple packages efficiently by caching repo indices
-func (e *Environment) installAlpinePackages(packages []string) error {
-	repos := []string{
-		"https://dl-cdn.alpinelinux.org/alpine/v3.18/main/x86_64/",
-		"https://dl-cdn.alpinelinux.org/alpine/v3.18/community/x86_64/",
-	}
-
-	// Build package URL cache in parallel
-	fmt.Printf("  Building package index...\n")
-	pkgURLs := make(map[string]string)
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-
-	// Download repo indices concurrently
-	for _, baseURL := range repos {
-		wg.Add(1)
-		go func(url string) {
-			defer wg.Done()
-
-			cmd := exec.Command("wget", "-qO-", url)
-			output, err := cmd.Output()
-			if err != nil {
-				return
-			}
-
-			lines := strings.Split(string(output), "\n")
-			for _, line := range lines {
-				for _, pkgName := range packages {
-					if strings.Contains(line, fmt.Sprintf(`href="%s-`, pkgName)) {
-						start := strings.Index(line, `href="`) + 6
-						end := strings.Index(line[start:], `"`)
-						if end > 0 {
-							pkgFile := line[start : start+end]
-							if strings.HasPrefix(pkgFile, pkgName+"-") && strings.HasSuffix(pkgFile, ".apk") {
-								mu.Lock()
-								if _, exists := pkgURLs[pkgName]; !exists {
-									pkgURLs[pkgName] = url + pkgFile
-								}
-								mu.Unlock()
-								break
-							}
-						}
-					}
-				}
-			}
-		}(baseURL)
-	}
-	wg.Wait()
-
-	totalPkgs := len(packages)
-	fmt.Printf("  Installing %d packages...\n", totalPkgs)
-
-	// Phase 1: Download all packages in parallel (16 workers)
-	type downloadJob struct {
-		name string
-		url  string
-	}
-
-	type downloadResult struct {
-		name    string
-		tmpFile string
-		success bool
-	}
-
-	downloadJobs := make(chan downloadJob, totalPkgs)
-	downloadResults := make(chan downloadResult, totalPkgs)
-
-	// Start 16 download workers
-	numDownloadWorkers := 16
-	for w := 0; w < numDownloadWorkers; w++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for job := range downloadJobs {
-				tmpFile, success := downloadPackageFile(job.name, job.url)
-				downloadResults <- downloadResult{
-					name:    job.name,
-					tmpFile: tmpFile,
-					success: success,
-				}
-			}
-		}()
-	}
-
-	// Queue downloads
-	for _, pkgName := range packages {
-		pkgURL, found := pkgURLs[pkgName]
-		if !found {
-			downloadResults <- downloadResult{name: pkgName, success: false}
-			continue
-		}
-		downloadJobs <- downloadJob{name: pkgName, url: pkgURL}
-	}
-	close(downloadJobs)
-
-	// Wait for all downloads to complete
-	go func() {
-		wg.Wait()
-		close(downloadResults)
-	}()
-
-	// Collect downloaded files
-	downloadedFiles := make(map[string]string)
-	downloadedCount := 0
-
-	fmt.Print("  Downloading: [")
-	barWidth := 40
-
-	for result := range downloadResults {
-		if result.success {
-			downloadedFiles[result.name] = result.tmpFile
-			downloadedCount++
-		}
-
-		// Update progress bar
-		progress := float64(len(downloadedFiles)+1) / float64(totalPkgs)
-		filledWidth := int(progress * float64(barWidth))
-
-		fmt.Print("\r  Downloading: [")
-		for i := 0; i < barWidth; i++ {
-			if i < filledWidth {
-				fmt.Print("=")
-			} else if i == filledWidth {
-				fmt.Print(">")
-			} else {
-				fmt.Print(" ")
-			}
-		}
-		fmt.Printf("] %d/%d", len(downloadedFiles), totalPkgs)
-	}
-	fmt.Println()
-
-	// Phase 2: Extract all packages in parallel (16 workers)
-	type extractJob struct {
-		name    string
-		tmpFile string
-	}
-
-	extractJobs := make(chan extractJob, len(downloadedFiles))
-	extractResults := make(chan bool, len(downloadedFiles))
-
-	// Start 16 extraction workers
-	numExtractWorkers := 16
-	for w := 0; w < numExtractWorkers; w++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for job := range extractJobs {
-				success := e.extractPackageFile(job.tmpFile)
-				os.Remove(job.tmpFile)
-				extractResults <- success
-			}
-		}()
-	}
-
-	// Queue extractions
-	for name, tmpFile := range downloadedFiles {
-		extractJobs <- extractJob{name: name, tmpFile: tmpFile}
-	}
-	close(extractJobs)
-
-	// Wait for all extractions to complete
-	go func() {
-		wg.Wait()
-		close(extractResults)
-	}()
-
-	// Display extraction progress
-	installedCount := 0
-	extractedCount := 0
-
-	fmt.Print("  Extracting: [")
-
-	for success := range extractResults {
-		if success {
-			installedCount++
-		}
-		extractedCount++
-
-		// Update progress bar
-		progress := float64(extractedCount) / float64(len(downloadedFiles))
-		filledWidth := int(progress * float64(barWidth))
-
-		fmt.Print("\r  Extracting: [")
-		for i := 0; i < barWidth; i++ {
-			if i < filledWidth {
-				fmt.Print("=")
-			} else if i == filledWidth {
-				fmt.Print(">")
-			} else {
-				fmt.Print(" ")
-			}
-		}
-		fmt.Printf("] %d/%d", extractedCount, len(downloadedFiles))
-	}
-
-	fmt.Printf("\n  Added %d Alpine packages\n", installedCount)
-	return nil
+// installAlpinePackages installs packages and their dependencies into the
+// environment with ipkg, so that they are recorded in its package database
+func (e *Environment) installAlpinePackages(ctx context.Context, packages []string) error {
+	fmt.Printf("  Installing %d packages...\n", len(packages))
+	return e.packageManager().Bootstrap(ctx, packages)
 }
 
-// downloadPackageFile downloads a single package using aria2c or wget
-func downloadPackageFile(pkgName, pkgURL string) (string, bool) {
-	tmpFile := fmt.Sprintf("/tmp/%s-%d.apk", pkgName, time.Now().UnixNano())
-
-	// Try aria2c first (faster with multi-connection support)
-	if _, err := exec.LookPath("aria2c"); err == nil {
-		cmd := exec.Command("aria2c",
-			"-x", "4", // 4 connections per download
-			"-s", "4", // split into 4 segments
-			"-k", "1M", // chunk size
-			"--quiet=true",
-			"--allow-overwrite=true",
-			"-d", "/tmp",
-			"-o", filepath.Base(tmpFile),
-			pkgURL)
-		if err := cmd.Run(); err == nil {
-			return tmpFile, true
-		}
-	}
-
-	// Fallback to wget
-	cmd := exec.Command("wget", "-q", "-O", tmpFile, pkgURL)
-	if err := cmd.Run(); err != nil {
-		return "", false
+// packageManager returns the package manager of the environment's rootfs.
+// It is kept for the whole build so the repository index is fetched once.
+// Install scripts are not run, as the rootfs is not complete yet; each new
+// environment runs the skipped post-install scripts in runDeferredScripts.
+func (e *Environment) packageManager() *ipkg.PackageManager {
+	if e.pm == nil {
+		e.pm = ipkg.NewRootfsPackageManager(e.IsoboxDir, ipkg.NormalizeBranch(e.AlpineVersion), e.Arch)
+		e.pm.NoScripts = true
 	}
-
-	return tmpFile, true
+	return e.pm
 }
 
-// extractPackageFile extracts a single package to the target directory
-func (e *Environment) extractPackageFile(tmpFile string) bool {
-	cmd := exec.Command("tar", "-xzf", tmpFile, "-C", e.IsoboxDir)
-	if err := cmd.Run(); err != nil {
-		return false
-	}
-	return true
+// repositories returns the package repositories for this environment's Alpine branch
+func (e *Environment) repositories() ([]ipkg.Repository, error) {
+	return ipkg.LoadRepositories(e.IsoboxDir, ipkg.NormalizeBranch(e.AlpineVersion))
 }
 
-func (e *Environment) installAlpinePackage(pkgName string) error {
-	// Use Alpine v3.18 which still uses the old APK format (APKv2)
-	// Alpine v3.19+ uses APKv3 which requires apk-tools to extract
-	repos := []string{
-		"https://dl-cdn.alpinelinux.org/alpine/v3.18/main/x86_64/",
-		"https://dl-cdn.alpinelinux.org/alpine/v3.18/community/x86_64/",
-	}
-
-	var pkgURL string
-	var pkgFile string
-
-	for _, baseURL := range repos {
-		cmd := exec.Command("wget", "-qO-", baseURL)
-		output, err := cmd.Output()
-		if err != nil {
-			continue
-		}
-
-		lines := strings.Split(string(output), "\n")
-
-		for _, line := range lines {
-			if strings.Contains(line, fmt.Sprintf(`href="%s-`, pkgName)) {
-				start := strings.Index(line, `href="`) + 6
-				end := strings.Index(line[start:], `"`)
-				if end > 0 {
-					pkgFile = line[start : start+end]
-					if strings.HasPrefix(pkgFile, pkgName+"-") && strings.HasSuffix(pkgFile, ".apk") {
-						pkgURL = baseURL + pkgFile
-						break
-					}
-				}
-			}
-		}
-
-		if pkgURL != "" {
-			break
-		}
+// setupRepositories records the repositories for the selected branch in
+// /etc/isobox/repositories so ipkg keeps using them after init, and in
+// /etc/apk/repositories for apk
+func (e *Environment) setupRepositories() error {
+	repos, err := e.repositories()
+	if err != nil {
+		return fmt.Errorf("load repositories: %w", err)
 	}
 
-	if pkgURL == "" {
-		return fmt.Errorf("package %s not found in repositories", pkgName)
+	path := ipkg.EnvRepositoriesPath(e.IsoboxDir)
+	if err := ipkg.WriteRepositories(path, repos); err != nil {
+		return fmt.Errorf("write repositories: %w", err)
 	}
-
-	tmpFile := fmt.Sprintf("/tmp/%s.apk", pkgName)
-
-	cmd := exec.Command("wget", "-q", "-O", tmpFile, pkgURL)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("download failed: %w", err)
-	}
-	defer os.Remove(tmpFile)
-
-	// Alpine v3.18 uses APKv2 format which is a standard tar.gz
-	cmd = exec.Command("tar", "-xzf", tmpFile, "-C", e.IsoboxDir)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("extract failed: %w (output: %s)", err, string(output))
+	if err := ipkg.WriteApkRepositories(e.IsoboxDir, repos); err != nil {
+		return fmt.Errorf("write apk repositories: %w", err)
 	}
 
+	fmt.Printf("  Configured %d package repositories (Alpine %s)\n", len(repos), e.AlpineVersion)
 	return nil
 }
 
@@ -870,8 +594,41 @@ func (e *Environment) setupSSLCertificates() error {
 	return nil
 }
 
-func (e *Environment) installMuslLibc() error {
-	if err := e.installAlpinePackage("musl"); err != nil {
+// installBusyboxPackage installs Alpine's BusyBox and links its applets.
+// The applets are linked from the list the package ships, as its own
+// --install cannot run on a host of another architecture.
+func (e *Environment) installBusyboxPackage(ctx context.Context) error {
+	fmt.Printf("Installing BusyBox for %s from Alpine...\n", e.Arch)
+	if err := e.installAlpinePackages(ctx, []string{"busybox"}); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(e.IsoboxDir, "etc/busybox-paths.d/busybox"))
+	if err != nil {
+		return fmt.Errorf("read applet list: %w", err)
+	}
+
+	for _, applet := range strings.Fields(string(data)) {
+		if !filepath.IsAbs(applet) {
+			continue
+		}
+		link := filepath.Join(e.IsoboxDir, applet)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink("/bin/busybox", link); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Environment) installMuslLibc(ctx context.Context) error {
+	if err := e.installAlpinePackages(ctx, []string{"musl"}); err != nil {
 		return fmt.Errorf("install musl: %w", err)
 	}
 
@@ -1068,7 +825,7 @@ func (e *Environment) setupLdConfig() error {
 }
 
 
-func (e *Environment) setupShells() error {
+func (e *Environment) setupShells(ctx context.Context) error {
 	fmt.Println("\nSetting up shells (bash, zsh, sh)...")
 
 	// Install shell dependencies and shells together
@@ -1081,7 +838,7 @@ func (e *Environment) setupShells() error {
 		"zsh",
 	}
 
-	if err := e.installAlpinePackages(packages); err != nil {
+	if err := e.installAlpinePackages(ctx, packages); err != nil {
 		return fmt.Errorf("shell installation failed: %w", err)
 	}
 
@@ -1239,6 +996,20 @@ services:   files
 	return nil
 }
 
+// runDeferredScripts runs the post-install scripts of the base packages,
+// which the base build skipped because its rootfs could not run them yet.
+// They can only run on a host of the environment's architecture.
+func (e *Environment) runDeferredScripts(ctx context.Context) error {
+	if e.Arch != ipkg.HostArch() {
+		fmt.Printf("Skipping post-install scripts of the base packages: %s binaries cannot run on this %s host\n", e.Arch, ipkg.HostArch())
+		return nil
+	}
+	if err := ipkg.NewPackageManager(e.Root).RunSkippedScripts(ctx); err != nil {
+		return fmt.Errorf("run post-install scripts: %w", err)
+	}
+	return nil
+}
+
 func (e *Environment) setupInternalPackageManager() error {
 	fmt.Println("\nSetting up internal package manager...")
 
@@ -1280,36 +1051,14 @@ func (e *Environment) copyProjectFiles() error {
 		return fmt.Errorf("create user home: %w", err)
 	}
 
-	tarFile := filepath.Join(e.IsoboxDir, "tmp", "project.tar.gz")
-	if err := os.MkdirAll(filepath.Dir(tarFile), 0755); err != nil {
-		return fmt.Errorf("create tmp dir: %w", err)
-	}
-
-	fmt.Printf("  Creating archive of project files...\n")
+	fmt.Printf("  Copying to /home/%s...\n", e.Username)
 
-	tarCmd := exec.Command("tar",
-		"-czf", tarFile,
-		"--exclude=.isobox",
-		"--exclude=.git",
-		"-C", e.Root,
-		".")
-
-	if output, err := tarCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("tar failed: %w\nOutput: %s", err, string(output))
-	}
-
-	fmt.Printf("  Extracting to /home/%s...\n", e.Username)
-
-	untarCmd := exec.Command("tar",
-		"-xzf", tarFile,
-		"-C", userHome)
-
-	if output, err := untarCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("untar failed: %w\nOutput: %s", err, string(output))
+	// The environment and the repository history stay out of the copy
+	skip := func(name string) bool {
+		return name == ".isobox" || name == ".git"
 	}
-
-	if err := os.Remove(tarFile); err != nil {
-		fmt.Printf("  Warning: failed to remove temp tar file: %v\n", err)
+	if err := copyTree(e.Root, userHome, skip); err != nil {
+		return fmt.Errorf("copy project files: %w", err)
 	}
 
 	chownCmd := exec.Command("sudo", "chown", "-R", "1000:1000", userHome)
@@ -1323,6 +1072,10 @@ func (e *Environment) copyProjectFiles() error {
 }
 
 func (e *Environment) EnterShell() error {
+	if err := CheckArch(e.Arch); err != nil {
+		return err
+	}
+
 	shell := "/bin/" + e.Shell
 	isoboxShell := filepath.Join(e.IsoboxDir, "bin", e.Shell)
 
@@ -1357,6 +1110,10 @@ func (e *Environment) EnterShell() error {
 }
 
 func (e *Environment) Execute(command []string) error {
+	if err := CheckArch(e.Arch); err != nil {
+		return err
+	}
+
 	fmt.Printf("Executing in isolated environment as user '%s': %v\n", e.Username, command)
 
 	homeDir := fmt.Sprintf("/home/%s", e.Username)
@@ -1386,6 +1143,8 @@ func (e *Environment) PrintStatus() {
 	fmt.Printf("Project Root: %s\n", e.Root)
 	fmt.Printf("Isolated Root: %s\n", e.IsoboxDir)
 	fmt.Printf("Created: %s\n", e.Created.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Alpine Branch: %s\n", ipkg.NormalizeBranch(e.AlpineVersion))
+	fmt.Printf("Architecture: %s\n", e.Arch)
 
 	binDir := filepath.Join(e.IsoboxDir, "bin")
 	binCount := 0
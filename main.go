@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/javanhut/isobox/internal/environment"
 	"github.com/javanhut/isobox/pkg/ipkg"
+	"github.com/javanhut/isobox/pkg/toolchain"
 )
 
 func main() {
@@ -41,6 +46,14 @@ func main() {
 		handlePackage()
 	case "status":
 		handleStatus()
+	case "cache":
+		handleCache()
+	case "toolchain":
+		handleToolchain()
+	case "sbom":
+		handleSBOM()
+	case "audit":
+		handleAudit()
 	case "destroy", "delete", "uninstall":
 		handleDestroy()
 	default:
@@ -67,6 +80,8 @@ func isInsideIsoBox() bool {
 
 // handleInternalCommands handles commands when running inside IsoBox environment
 func handleInternalCommands() {
+	ctx := interruptContext()
+
 	if len(os.Args) < 2 {
 		printInternalUsage()
 		os.Exit(1)
@@ -79,29 +94,33 @@ func handleInternalCommands() {
 
 	switch command {
 	case "install":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: isobox install <package>")
-			os.Exit(1)
-		}
-		if err := pm.Install(os.Args[2]); err != nil {
-			log.Fatalf("Failed to install package: %v", err)
-		}
+		handleInstallCommand(ctx, pm, "isobox", os.Args[2:])
 	case "remove":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: isobox remove <package>")
-			os.Exit(1)
-		}
-		if err := pm.Remove(os.Args[2]); err != nil {
-			log.Fatalf("Failed to remove package: %v", err)
-		}
+		handleRemoveCommand(pm, "isobox", os.Args[2:])
 	case "list":
 		if err := pm.List(); err != nil {
 			log.Fatalf("Failed to list packages: %v", err)
 		}
 	case "update":
-		if err := pm.Update(); err != nil {
-			log.Fatalf("Failed to update package index: %v", err)
-		}
+		handleUpdateCommand(ctx, pm, os.Args[2:])
+	case "upgrade":
+		handleUpgradeCommand(ctx, pm, os.Args[2:])
+	case "search", "info", "files", "owns":
+		handleQueryCommand(pm, "isobox", command, os.Args[2:])
+	case "hold", "unhold":
+		handleHoldCommand(pm, "isobox", command, os.Args[2:])
+	case "history", "rollback":
+		handleHistoryCommand(ctx, pm, "isobox", command, os.Args[2:])
+	case "verify":
+		handleVerifyCommand(ctx, pm, os.Args[2:])
+	case "build", "index":
+		handleBuildCommand("isobox", command, os.Args[2:])
+	case "toolchain":
+		handleToolchainCommand(ctx, toolchain.NewManager("/"), os.Args[2:])
+	case "sbom":
+		handleSBOMCommand(pm, "isobox", os.Args[2:])
+	case "audit":
+		handleAuditCommand(ctx, pm, "isobox", os.Args[2:])
 	case "help", "--help", "-h":
 		printInternalUsage()
 	default:
@@ -114,11 +133,44 @@ func handleInternalCommands() {
 func printInternalUsage() {
 	fmt.Println("IsoBox Internal Package Manager")
 	fmt.Println("\nUsage:")
-	fmt.Println("  isobox install <package>    Install a package")
-	fmt.Println("  isobox remove <package>     Remove a package")
+	fmt.Println("  isobox install <package...> Install packages")
+	fmt.Println("    --allow-untrusted         Install even if signature or checksum checks fail")
+	fmt.Println("    --force-overwrite         Replace files owned by other packages")
+	fmt.Println("    --dry-run                 Show what would be installed without changing anything")
+	fmt.Println("  isobox remove <package...>  Remove packages")
+	fmt.Println("    --force                   Remove even if other packages depend on them")
+	fmt.Println("    --dry-run                 Show what would be removed without changing anything")
 	fmt.Println("  isobox list                 List installed packages")
-	fmt.Println("  isobox update               Update package index")
+	fmt.Println("  isobox update               Refresh the cached package index")
+	fmt.Println("  isobox upgrade [package...] Upgrade installed packages to the index's versions")
+	fmt.Println("  isobox search <regex>       Search package names and descriptions")
+	fmt.Println("  isobox info <package>       Show package details")
+	fmt.Println("  isobox files <package>      List files installed by a package")
+	fmt.Println("  isobox owns <path>          Show which package owns a file")
+	fmt.Println("  isobox hold <package>       Keep a package at its installed version")
+	fmt.Println("  isobox unhold <package>     Release a hold")
+	fmt.Println("  isobox history              List package transactions")
+	fmt.Println("  isobox rollback <id>        Restore the packages from before a transaction")
+	fmt.Println("  isobox verify [package...]  Check installed files against their packages")
+	fmt.Println("    --repair                  Restore changed files from the package cache")
+	fmt.Println("  isobox build <dir>          Build an APK from package.toml and files/")
+	fmt.Println("    --output <dir>            Where to write the package (default: current directory)")
+	fmt.Println("    --sign <private key>      Sign the package")
+	fmt.Println("  isobox index <dir>          Write APKINDEX.tar.gz for the packages in a directory")
+	fmt.Println("    --sign <private key>      Sign the index")
+	fmt.Println("  isobox toolchain install <name@version>")
+	fmt.Println("                              Install a Go, Node.js or Python release")
+	fmt.Println("  isobox toolchain use <name@version>")
+	fmt.Println("                              Make an installed release the default")
+	fmt.Println("  isobox toolchain list       List installed toolchains")
+	fmt.Println("  isobox sbom                 Write a software bill of materials of the installed packages")
+	fmt.Println("    --format <format>         spdx-json (default) or cyclonedx-json")
+	fmt.Println("    --output <file>           Write to a file instead of standard output")
+	fmt.Println("  isobox audit --secdb <path> Report vulnerabilities listed in Alpine secdb feeds")
+	fmt.Println("    --severities <file>       JSON map of vulnerability IDs to severities")
+	fmt.Println("    --fail-on <severity>      Fail at low (default), medium, high, critical or none")
 	fmt.Println("  isobox help                 Show this help")
+	fmt.Println("\nsearch, info, files, owns, history, verify, audit and --dry-run plans accept --json for machine-readable output")
 }
 
 func printUsage() {
@@ -128,30 +180,75 @@ func printUsage() {
 	fmt.Println("                                Initialize isolated environment in directory (default: current)")
 	fmt.Println("    --shell <shell>             Set default shell (bash, zsh, or sh)")
 	fmt.Println("    --install-dep <file.toml>   Install packages from dependencies file")
+	fmt.Println("    --locked                    Install exactly the packages in isobox.lock")
+	fmt.Println("    --alpine-version <branch>   Alpine branch to use (default: v3.18)")
+	fmt.Println("    --arch <arch>               Architecture to use (default: the host's, e.g. aarch64)")
 	fmt.Println("  isobox enter                  Enter the isolated environment shell")
 	fmt.Println("  isobox exec <cmd>             Execute command in isolated environment")
 	fmt.Println("  isobox migrate <src> <dest>   Copy directory from host to isobox")
-	fmt.Println("  isobox recache                Delete and rebuild the base system cache")
+	fmt.Println("  isobox recache [--alpine-version <branch>] [--arch <arch>]")
+	fmt.Println("                                Delete and rebuild the base system cache")
 	fmt.Println("  isobox status                 Show environment status")
+	fmt.Println("  isobox cache clean            Remove all packages from the shared download cache")
+	fmt.Println("  isobox toolchain install <name@version>")
+	fmt.Println("                                Install a Go, Node.js or Python release (go@1.22.5)")
+	fmt.Println("  isobox toolchain use <name@version>")
+	fmt.Println("                                Make an installed release the default")
+	fmt.Println("  isobox toolchain list         List installed toolchains")
+	fmt.Println("  isobox sbom                   Write a software bill of materials of the installed packages")
+	fmt.Println("    --format <format>           spdx-json (default) or cyclonedx-json")
+	fmt.Println("    --output <file>             Write to a file instead of standard output")
+	fmt.Println("  isobox audit --secdb <path>   Report vulnerabilities listed in Alpine secdb feeds")
+	fmt.Println("    --severities <file>         JSON map of vulnerability IDs to severities")
+	fmt.Println("    --fail-on <severity>        Fail at low (default), medium, high, critical or none")
 	fmt.Println("  isobox destroy                Remove isolated environment")
 	fmt.Println("\nPackage Management (from host):")
-	fmt.Println("  isobox pkg install <pkg>      Install a package in the environment")
-	fmt.Println("  isobox pkg remove <pkg>       Remove a package from the environment")
+	fmt.Println("  isobox pkg install <pkg...>   Install packages in the environment")
+	fmt.Println("    --allow-untrusted           Install even if signature or checksum checks fail")
+	fmt.Println("    --force-overwrite           Replace files owned by other packages")
+	fmt.Println("    --dry-run                   Show the plan without changing anything")
+	fmt.Println("  isobox pkg remove <pkg...>    Remove packages from the environment")
+	fmt.Println("    --force                     Remove even if other packages depend on them")
+	fmt.Println("    --dry-run                   Show the plan without changing anything")
 	fmt.Println("  isobox pkg list               List installed packages")
-	fmt.Println("  isobox pkg update             Update package index")
+	fmt.Println("  isobox pkg update             Refresh the cached package index")
+	fmt.Println("  isobox pkg upgrade [pkg...]   Upgrade installed packages to the index's versions")
+	fmt.Println("  isobox pkg search <regex>     Search package names and descriptions")
+	fmt.Println("  isobox pkg info <pkg>         Show package details")
+	fmt.Println("  isobox pkg files <pkg>        List files installed by a package")
+	fmt.Println("  isobox pkg owns <path>        Show which package owns a file")
+	fmt.Println("  isobox pkg hold <pkg>         Keep a package at its installed version")
+	fmt.Println("  isobox pkg unhold <pkg>       Release a hold")
+	fmt.Println("  isobox pkg history            List package transactions")
+	fmt.Println("  isobox pkg rollback <id>      Restore the packages from before a transaction")
+	fmt.Println("  isobox pkg verify [pkg...]    Check installed files against their packages")
+	fmt.Println("    --repair                    Restore changed files from the package cache")
+	fmt.Println("                                (search, info, files, owns, history, verify and --dry-run accept --json)")
 	fmt.Println("  isobox pkg install-deps <file.toml>")
-	fmt.Println("                                Install packages from dependencies file")
+	fmt.Println("                                Install packages from dependencies file and write isobox.lock")
+	fmt.Println("    --locked                    Install exactly the packages in isobox.lock")
+	fmt.Println("  isobox pkg build <dir>        Build an APK from package.toml and files/")
+	fmt.Println("    --output <dir>              Where to write the package (default: current directory)")
+	fmt.Println("    --sign <private key>        Sign the package (--key-name sets the public key name)")
+	fmt.Println("  isobox pkg index <dir>        Write APKINDEX.tar.gz for the packages in a directory")
+	fmt.Println("    --sign <private key>        Sign the index")
 	fmt.Println("\nPackage Management (inside environment after 'isobox enter'):")
 	fmt.Println("  isobox install <pkg>          Install a package")
 	fmt.Println("  isobox remove <pkg>           Remove a package")
 	fmt.Println("  isobox list                   List installed packages")
 	fmt.Println("  isobox update                 Update package index")
+	fmt.Println("  isobox upgrade [pkg...]       Upgrade installed packages")
+	fmt.Println("  isobox search <regex>         Search for packages")
 }
 
 func handleInit() {
+	ctx := interruptContext()
 	path := "."
 	shell := "bash"
 	var depsFile string
+	var locked bool
+	var alpineVersion string
+	var arch string
 
 	for i := 2; i < len(os.Args); i++ {
 		arg := os.Args[i]
@@ -173,14 +270,48 @@ func handleInit() {
 			}
 			depsFile = os.Args[i+1]
 			i++
+		} else if arg == "--locked" {
+			locked = true
+		} else if arg == "--alpine-version" {
+			if i+1 >= len(os.Args) {
+				fmt.Println("Error: --alpine-version requires a value (e.g. 3.18, v3.20 or edge)")
+				os.Exit(1)
+			}
+			alpineVersion = os.Args[i+1]
+			i++
+		} else if arg == "--arch" {
+			if i+1 >= len(os.Args) {
+				fmt.Println("Error: --arch requires a value (e.g. x86_64 or aarch64)")
+				os.Exit(1)
+			}
+			arch = os.Args[i+1]
+			i++
 		} else if !strings.HasPrefix(arg, "--") {
 			path = arg
 		}
 	}
 
+	// A locked environment uses the branch and architecture of its lock file
+	if locked {
+		if depsFile == "" {
+			fmt.Println("Error: --locked requires --install-dep")
+			os.Exit(1)
+		}
+		lock, err := ipkg.ReadLock(ipkg.LockPath(depsFile))
+		if err != nil {
+			log.Fatalf("Failed to read lock file: %v", err)
+		}
+		if alpineVersion == "" {
+			alpineVersion = lock.Alpine
+		}
+		if arch == "" {
+			arch = lock.Arch
+		}
+	}
+
 	fmt.Printf("Initializing IsoBox environment in: %s\n", path)
 	fmt.Printf("Default shell: %s\n", shell)
-	env, err := environment.Initialize(path, shell)
+	env, err := environment.Initialize(ctx, path, shell, alpineVersion, arch)
 	if err != nil {
 		log.Fatalf("Failed to initialize: %v", err)
 	}
@@ -188,12 +319,18 @@ func handleInit() {
 	fmt.Printf("\nIsoBox environment created successfully!\n")
 	fmt.Printf("Location: %s\n", env.Root)
 	fmt.Printf("Shell: %s\n", env.Shell)
+	fmt.Printf("Alpine branch: %s\n", env.AlpineVersion)
+	fmt.Printf("Architecture: %s\n", env.Arch)
 
 	// Install dependencies if specified
 	if depsFile != "" {
 		fmt.Printf("\nInstalling dependencies from %s...\n", depsFile)
 		pm := ipkg.NewPackageManager(env.Root)
-		if err := pm.InstallFromConfig(depsFile); err != nil {
+		if locked {
+			if err := pm.InstallLocked(ctx, depsFile); err != nil {
+				log.Fatalf("Failed to install locked dependencies: %v", err)
+			}
+		} else if err := pm.InstallFromConfig(ctx, depsFile); err != nil {
 			fmt.Printf("Warning: Failed to install all dependencies: %v\n", err)
 		}
 	}
@@ -268,13 +405,44 @@ func handleMigrate() {
 }
 
 func handleRecache() {
-	if err := environment.RebuildCache(); err != nil {
+	ctx := interruptContext()
+	var alpineVersion, arch string
+	for i := 2; i < len(os.Args); i++ {
+		if os.Args[i] == "--alpine-version" && i+1 < len(os.Args) {
+			alpineVersion = os.Args[i+1]
+			i++
+		} else if os.Args[i] == "--arch" && i+1 < len(os.Args) {
+			arch = os.Args[i+1]
+			i++
+		}
+	}
+
+	if err := environment.RebuildCache(ctx, alpineVersion, arch); err != nil {
 		log.Fatalf("Failed to rebuild cache: %v", err)
 	}
 	fmt.Println("\nBase system cache rebuilt successfully!")
 	fmt.Println("Next 'isobox init' will use the new cache.")
 }
 
+func handleCache() {
+	if len(os.Args) < 3 || os.Args[2] != "clean" {
+		fmt.Println("Usage: isobox cache clean")
+		os.Exit(1)
+	}
+
+	cache, err := ipkg.OpenPackageCache()
+	if err != nil {
+		log.Fatalf("Failed to open package cache: %v", err)
+	}
+
+	count, freed, err := cache.Clean()
+	if err != nil {
+		log.Fatalf("Failed to clean package cache: %v", err)
+	}
+
+	fmt.Printf("Removed %d cached packages (%.1f MiB) from %s\n", count, float64(freed)/(1<<20), cache.Dir())
+}
+
 func handleDestroy() {
 	env, err := environment.Load(".")
 	if err != nil {
@@ -300,50 +468,60 @@ func handleDestroy() {
 }
 
 func handlePackage() {
+	// Building packages and indexes needs no environment
+	if len(os.Args) >= 3 && (os.Args[2] == "build" || os.Args[2] == "index") {
+		handleBuildCommand("isobox pkg", os.Args[2], os.Args[3:])
+		return
+	}
+
 	env, err := environment.Load(".")
 	if err != nil {
 		log.Fatalf("No IsoBox environment found. Run 'isobox init' first.")
 	}
 
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: isobox pkg [install|remove|list|update|install-deps] [args...]")
+		fmt.Println("Usage: isobox pkg [install|remove|list|update|upgrade|search|info|files|owns|hold|unhold|history|rollback|verify|install-deps|build|index] [args...]")
 		os.Exit(1)
 	}
 
 	subcommand := os.Args[2]
 	pm := ipkg.NewPackageManager(env.Root)
+	ctx := interruptContext()
 
 	switch subcommand {
 	case "install":
-		if len(os.Args) < 4 {
-			fmt.Println("Usage: isobox pkg install <package>")
-			os.Exit(1)
-		}
-		if err := pm.Install(os.Args[3]); err != nil {
-			log.Fatalf("Failed to install package: %v", err)
-		}
+		handleInstallCommand(ctx, pm, "isobox pkg", os.Args[3:])
 	case "remove":
-		if len(os.Args) < 4 {
-			fmt.Println("Usage: isobox pkg remove <package>")
-			os.Exit(1)
-		}
-		if err := pm.Remove(os.Args[3]); err != nil {
-			log.Fatalf("Failed to remove package: %v", err)
-		}
+		handleRemoveCommand(pm, "isobox pkg", os.Args[3:])
 	case "list":
 		if err := pm.List(); err != nil {
 			log.Fatalf("Failed to list packages: %v", err)
 		}
 	case "update":
-		if err := pm.Update(); err != nil {
-			log.Fatalf("Failed to update package index: %v", err)
-		}
+		handleUpdateCommand(ctx, pm, os.Args[3:])
+	case "upgrade":
+		handleUpgradeCommand(ctx, pm, os.Args[3:])
+	case "search", "info", "files", "owns":
+		handleQueryCommand(pm, "isobox pkg", subcommand, os.Args[3:])
+	case "hold", "unhold":
+		handleHoldCommand(pm, "isobox pkg", subcommand, os.Args[3:])
+	case "history", "rollback":
+		handleHistoryCommand(ctx, pm, "isobox pkg", subcommand, os.Args[3:])
+	case "verify":
+		handleVerifyCommand(ctx, pm, os.Args[3:])
 	case "install-deps":
-		if len(os.Args) < 4 {
-			fmt.Println("Usage: isobox pkg install-deps <dependencies.toml>")
+		args, flags := splitFlags(os.Args[3:], "--allow-untrusted", "--force-overwrite", "--locked")
+		if len(args) < 1 {
+			fmt.Println("Usage: isobox pkg install-deps <dependencies.toml> [--locked] [--allow-untrusted] [--force-overwrite]")
 			os.Exit(1)
 		}
-		if err := pm.InstallFromConfig(os.Args[3]); err != nil {
+		pm.AllowUntrusted = flags["--allow-untrusted"]
+		pm.ForceOverwrite = flags["--force-overwrite"]
+		if flags["--locked"] {
+			if err := pm.InstallLocked(ctx, args[0]); err != nil {
+				log.Fatalf("Failed to install locked dependencies: %v", err)
+			}
+		} else if err := pm.InstallFromConfig(ctx, args[0]); err != nil {
 			log.Fatalf("Failed to install dependencies: %v", err)
 		}
 	default:
@@ -351,3 +529,411 @@ func handlePackage() {
 		os.Exit(1)
 	}
 }
+
+// handleInstallCommand installs packages in host or internal mode. prefix
+// is the command prefix shown in usage messages.
+func handleInstallCommand(ctx context.Context, pm *ipkg.PackageManager, prefix string, args []string) {
+	packages, flags := splitFlags(args, "--allow-untrusted", "--force-overwrite", "--dry-run", "--json")
+	if len(packages) < 1 {
+		fmt.Printf("Usage: %s install <package...> [--allow-untrusted] [--force-overwrite] [--dry-run [--json]]\n", prefix)
+		os.Exit(1)
+	}
+
+	if flags["--dry-run"] {
+		plan, err := pm.PlanInstall(packages)
+		if err != nil {
+			log.Fatalf("Failed to plan install: %v", err)
+		}
+		if err := ipkg.PrintPlan(plan, flags["--json"]); err != nil {
+			log.Fatalf("Failed to print plan: %v", err)
+		}
+		return
+	}
+
+	pm.AllowUntrusted = flags["--allow-untrusted"]
+	pm.ForceOverwrite = flags["--force-overwrite"]
+	if err := pm.Install(ctx, packages...); err != nil {
+		log.Fatalf("Failed to install packages: %v", err)
+	}
+}
+
+// handleUpdateCommand refreshes the cached repository indexes
+func handleUpdateCommand(ctx context.Context, pm *ipkg.PackageManager, args []string) {
+	_, flags := splitFlags(args, "--allow-untrusted")
+
+	pm.AllowUntrusted = flags["--allow-untrusted"]
+	if err := pm.Update(ctx); err != nil {
+		log.Fatalf("Failed to update package index: %v", err)
+	}
+}
+
+// handleRemoveCommand removes packages in host or internal mode
+func handleRemoveCommand(pm *ipkg.PackageManager, prefix string, args []string) {
+	packages, flags := splitFlags(args, "--force", "--dry-run", "--json")
+	if len(packages) < 1 {
+		fmt.Printf("Usage: %s remove <package...> [--force] [--dry-run [--json]]\n", prefix)
+		os.Exit(1)
+	}
+
+	if flags["--dry-run"] {
+		plan, err := pm.PlanRemove(packages)
+		if err != nil {
+			log.Fatalf("Failed to plan removal: %v", err)
+		}
+		if err := ipkg.PrintPlan(plan, flags["--json"]); err != nil {
+			log.Fatalf("Failed to print plan: %v", err)
+		}
+		return
+	}
+
+	pm.ForceRemove = flags["--force"]
+	if err := pm.Remove(packages...); err != nil {
+		log.Fatalf("Failed to remove package: %v", err)
+	}
+}
+
+// handleHoldCommand places or releases holds on installed packages
+func handleHoldCommand(pm *ipkg.PackageManager, prefix, command string, args []string) {
+	if len(args) < 1 {
+		fmt.Printf("Usage: %s %s <package...>\n", prefix, command)
+		os.Exit(1)
+	}
+
+	for _, pkg := range args {
+		var err error
+		if command == "hold" {
+			err = pm.Hold(pkg)
+		} else {
+			err = pm.Unhold(pkg)
+		}
+		if err != nil {
+			log.Fatalf("Failed to %s package: %v", command, err)
+		}
+	}
+}
+
+// handleQueryCommand runs the read-only package queries shared by host and
+// internal mode. prefix is the command prefix shown in usage messages.
+func handleQueryCommand(pm *ipkg.PackageManager, prefix, command string, args []string) {
+	positional, flags := splitFlags(args, "--json")
+	asJSON := flags["--json"]
+
+	usage := map[string]string{
+		"search": "<regex>",
+		"info":   "<package>",
+		"files":  "<package>",
+		"owns":   "<path>",
+	}
+	if len(positional) < 1 {
+		fmt.Printf("Usage: %s %s %s [--json]\n", prefix, command, usage[command])
+		os.Exit(1)
+	}
+
+	var err error
+	switch command {
+	case "search":
+		err = pm.Search(positional[0], asJSON)
+	case "info":
+		err = pm.Info(positional[0], asJSON)
+	case "files":
+		err = pm.Files(positional[0], asJSON)
+	case "owns":
+		err = pm.Owns(positional[0], asJSON)
+	}
+
+	if err != nil {
+		log.Fatalf("Failed to %s: %v", command, err)
+	}
+}
+
+// handleHistoryCommand lists the package transaction history or rolls
+// back to the state before one of its transactions
+func handleHistoryCommand(ctx context.Context, pm *ipkg.PackageManager, prefix, command string, args []string) {
+	args, flags := splitFlags(args, "--json", "--allow-untrusted")
+
+	if command == "history" {
+		if err := pm.History(flags["--json"]); err != nil {
+			log.Fatalf("Failed to read history: %v", err)
+		}
+		return
+	}
+
+	if len(args) != 1 {
+		fmt.Printf("Usage: %s rollback <id> [--allow-untrusted]\n", prefix)
+		os.Exit(1)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		log.Fatalf("Invalid transaction id: %s", args[0])
+	}
+
+	pm.AllowUntrusted = flags["--allow-untrusted"]
+	if err := pm.Rollback(ctx, id); err != nil {
+		log.Fatalf("Failed to roll back: %v", err)
+	}
+}
+
+// handleUpgradeCommand upgrades installed packages in host or internal mode
+func handleUpgradeCommand(ctx context.Context, pm *ipkg.PackageManager, args []string) {
+	packages, flags := splitFlags(args, "--allow-untrusted", "--force-overwrite")
+
+	pm.AllowUntrusted = flags["--allow-untrusted"]
+	pm.ForceOverwrite = flags["--force-overwrite"]
+	if err := pm.Upgrade(ctx, packages); err != nil {
+		log.Fatalf("Failed to upgrade packages: %v", err)
+	}
+}
+
+// handleVerifyCommand checks, and with --repair restores, the files of
+// installed packages. It exits non-zero if any file differs.
+func handleVerifyCommand(ctx context.Context, pm *ipkg.PackageManager, args []string) {
+	packages, flags := splitFlags(args, "--repair", "--json", "--allow-untrusted")
+
+	pm.AllowUntrusted = flags["--allow-untrusted"]
+	if err := pm.Verify(ctx, packages, flags["--repair"], flags["--json"]); err != nil {
+		log.Fatalf("Verification failed: %v", err)
+	}
+}
+
+// handleBuildCommand builds a package from a directory, or indexes a
+// directory of packages, in host or internal mode
+func handleBuildCommand(prefix, command string, args []string) {
+	var dir, signKey, keyName string
+	output := "."
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--sign" || arg == "--key-name" || (arg == "--output" && command == "build") {
+			if i+1 >= len(args) {
+				fmt.Printf("Error: %s requires a value\n", arg)
+				os.Exit(1)
+			}
+			switch arg {
+			case "--sign":
+				signKey = args[i+1]
+			case "--key-name":
+				keyName = args[i+1]
+			case "--output":
+				output = args[i+1]
+			}
+			i++
+		} else if !strings.HasPrefix(arg, "--") && dir == "" {
+			dir = arg
+		} else {
+			dir = ""
+			break
+		}
+	}
+
+	if dir == "" {
+		if command == "build" {
+			fmt.Printf("Usage: %s build <dir> [--output <dir>] [--sign <private key>] [--key-name <name.rsa.pub>]\n", prefix)
+		} else {
+			fmt.Printf("Usage: %s index <dir> [--sign <private key>] [--key-name <name.rsa.pub>]\n", prefix)
+		}
+		os.Exit(1)
+	}
+
+	var signer *ipkg.Signer
+	if signKey != "" {
+		var err error
+		if signer, err = ipkg.LoadSigner(signKey, keyName); err != nil {
+			log.Fatalf("Failed to load signing key: %v", err)
+		}
+	}
+
+	if command == "build" {
+		if _, err := ipkg.Build(dir, output, signer); err != nil {
+			log.Fatalf("Failed to build package: %v", err)
+		}
+		return
+	}
+	if err := ipkg.BuildIndex(dir, "", signer); err != nil {
+		log.Fatalf("Failed to index packages: %v", err)
+	}
+}
+
+func handleSBOM() {
+	env, err := environment.Load(".")
+	if err != nil {
+		log.Fatalf("No IsoBox environment found. Run 'isobox init' first.")
+	}
+
+	handleSBOMCommand(ipkg.NewPackageManager(env.Root), "isobox", os.Args[2:])
+}
+
+// handleSBOMCommand writes the software bill of materials of an
+// environment in host or internal mode
+func handleSBOMCommand(pm *ipkg.PackageManager, prefix string, args []string) {
+	positional, values, err := splitValueFlags(args, "--format", "--output")
+	if err != nil || len(positional) > 0 {
+		fmt.Printf("Usage: %s sbom [--format spdx-json|cyclonedx-json] [--output <file>]\n", prefix)
+		os.Exit(1)
+	}
+
+	format := values["--format"]
+	if format == "" {
+		format = ipkg.SBOMFormatSPDX
+	}
+	data, err := pm.SBOM(format)
+	if err != nil {
+		log.Fatalf("Failed to create SBOM: %v", err)
+	}
+
+	if output := values["--output"]; output != "" {
+		if err := os.WriteFile(output, data, 0644); err != nil {
+			log.Fatalf("Failed to write SBOM: %v", err)
+		}
+		fmt.Printf("Wrote %s SBOM to %s\n", format, output)
+		return
+	}
+	os.Stdout.Write(data)
+}
+
+func handleAudit() {
+	env, err := environment.Load(".")
+	if err != nil {
+		log.Fatalf("No IsoBox environment found. Run 'isobox init' first.")
+	}
+
+	handleAuditCommand(interruptContext(), ipkg.NewPackageManager(env.Root), "isobox", os.Args[2:])
+}
+
+// handleAuditCommand checks the installed packages of an environment
+// against secdb feeds in host or internal mode. It exits non-zero when a
+// vulnerability reaches the --fail-on severity.
+func handleAuditCommand(ctx context.Context, pm *ipkg.PackageManager, prefix string, args []string) {
+	args, values, err := splitValueFlags(args, "--secdb", "--severities", "--fail-on")
+	if err != nil {
+		fmt.Printf("Usage: %s audit --secdb <file|dir|url> [--severities <file>] [--fail-on low|medium|high|critical|none] [--json]\n", prefix)
+		os.Exit(1)
+	}
+	positional, flags := splitFlags(args, "--json")
+	if len(positional) > 0 || values["--secdb"] == "" {
+		fmt.Printf("Usage: %s audit --secdb <file|dir|url> [--severities <file>] [--fail-on low|medium|high|critical|none] [--json]\n", prefix)
+		os.Exit(1)
+	}
+
+	failOn := values["--fail-on"]
+	if failOn == "" {
+		failOn = "low"
+	}
+	opts := ipkg.AuditOptions{
+		SecDB:      values["--secdb"],
+		Severities: values["--severities"],
+		FailOn:     failOn,
+		JSON:       flags["--json"],
+	}
+	if err := pm.Audit(ctx, opts); err != nil {
+		log.Fatalf("Audit failed: %v", err)
+	}
+}
+
+func handleToolchain() {
+	env, err := environment.Load(".")
+	if err != nil {
+		log.Fatalf("No IsoBox environment found. Run 'isobox init' first.")
+	}
+
+	handleToolchainCommand(interruptContext(), toolchain.NewManager(env.IsoboxDir), os.Args[2:])
+}
+
+// handleToolchainCommand installs, selects and lists toolchains in host or
+// internal mode
+func handleToolchainCommand(ctx context.Context, m *toolchain.Manager, args []string) {
+	if len(args) < 1 || (args[0] != "list" && len(args) != 2) {
+		fmt.Println("Usage: isobox toolchain [install|use] <name@version>")
+		fmt.Println("       isobox toolchain list")
+		fmt.Printf("Toolchains: %s\n", strings.Join(toolchain.Names(), ", "))
+		os.Exit(1)
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = m.Install(ctx, args[1])
+	case "use":
+		err = m.Use(args[1])
+	case "list":
+		err = m.List()
+	default:
+		fmt.Printf("Unknown toolchain subcommand: %s\n", args[0])
+		os.Exit(1)
+	}
+
+	if err != nil {
+		log.Fatalf("Failed to %s toolchain: %v", args[0], err)
+	}
+}
+
+// interruptContext returns a context that is cancelled by Ctrl-C or
+// SIGTERM, so that downloads and installs stop and clean up after
+// themselves. A second interrupt exits immediately.
+func interruptContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		fmt.Println("\nInterrupted, cleaning up...")
+	}()
+	return ctx
+}
+
+// splitValueFlags separates the named flags that take a value, as in
+// "--format spdx-json", from positional arguments
+func splitValueFlags(args []string, names ...string) ([]string, map[string]string, error) {
+	values := make(map[string]string)
+	var positional []string
+
+	for i := 0; i < len(args); i++ {
+		matched := false
+		for _, name := range names {
+			if args[i] == name {
+				if i+1 >= len(args) {
+					return nil, nil, fmt.Errorf("%s requires a value", name)
+				}
+				values[name] = args[i+1]
+				matched = true
+				i++
+				break
+			}
+		}
+		if !matched {
+			positional = append(positional, args[i])
+		}
+	}
+
+	return positional, values, nil
+}
+
+// splitFlags separates the named boolean flags from positional arguments.
+// Any other argument starting with "-" is an unknown flag and exits, rather
+// than being taken for a package name.
+func splitFlags(args []string, names ...string) ([]string, map[string]bool) {
+	flags := make(map[string]bool)
+	var positional []string
+
+	for _, arg := range args {
+		matched := false
+		for _, name := range names {
+			if arg == name {
+				flags[name] = true
+				matched = true
+				break
+			}
+		}
+		if !matched && strings.HasPrefix(arg, "-") {
+			if len(names) == 0 {
+				fmt.Printf("Unknown flag: %s\n", arg)
+			} else {
+				fmt.Printf("Unknown flag: %s (accepted: %s)\n", arg, strings.Join(names, ", "))
+			}
+			os.Exit(1)
+		}
+		if !matched {
+			positional = append(positional, arg)
+		}
+	}
+
+	return positional, flags
+}
@@ -0,0 +1,572 @@
+package ipkg
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// APKv3 packages use apk-tools' ADB container: an "ADB." magic and a
+// four byte schema id, followed by 8-byte aligned blocks. The ADB block
+// holds a tree of tagged 32-bit values describing the package, SIG blocks
+// sign it, and one DATA block per regular file carries the contents.
+
+const (
+	adbMagic         = "ADB."
+	adbSchemaPackage = "pckg"
+
+	adbBlockADB  = 0
+	adbBlockSig  = 1
+	adbBlockData = 2
+	adbBlockExt  = 3
+
+	adbBlockAlign = 8
+)
+
+// Value types, stored in the top four bits of every adb value
+const (
+	adbTypeMask    = 0xf0000000
+	adbValueMask   = 0x0fffffff
+	adbTypeSpecial = 0x00000000
+	adbTypeInt     = 0x10000000
+	adbTypeInt32   = 0x20000000
+	adbTypeInt64   = 0x30000000
+	adbTypeBlob8   = 0x80000000
+	adbTypeBlob16  = 0x90000000
+	adbTypeBlob32  = 0xa0000000
+	adbTypeArray   = 0xd0000000
+	adbTypeObject  = 0xe0000000
+)
+
+// Field indexes of the package schema
+const (
+	adbPkgInfo     = 0x01
+	adbPkgPaths    = 0x02
+	adbPkgScripts  = 0x03
+	adbPkgTriggers = 0x04
+
+	adbPIName          = 0x01
+	adbPIVersion       = 0x02
+	adbPIDescription   = 0x04
+	adbPIArch          = 0x05
+	adbPILicense       = 0x06
+	adbPIOrigin        = 0x07
+	adbPIURL           = 0x09
+	adbPIInstalledSize = 0x0c
+	adbPIDepends       = 0x0f
+
+	adbDepName    = 0x01
+	adbDepVersion = 0x02
+	adbDepMatch   = 0x03
+
+	adbACLMode = 0x01
+
+	adbFIName   = 0x01
+	adbFIACL    = 0x02
+	adbFIHashes = 0x05
+	adbFITarget = 0x06
+
+	adbDIName  = 0x01
+	adbDIACL   = 0x02
+	adbDIFiles = 0x03
+)
+
+// Script slots of the package schema, in the same order as the APKv2 names
+var adbScriptNames = map[int]string{
+	0x01: scriptTrigger,
+	0x02: scriptPreInstall,
+	0x03: scriptPostInstall,
+	0x04: scriptPreDeinstall,
+	0x05: scriptPostDeinstall,
+	0x06: scriptPreUpgrade,
+	0x07: scriptPostUpgrade,
+}
+
+// Dependency match flags
+const (
+	adbMatchEqual    = 1
+	adbMatchLess     = 2
+	adbMatchGreater  = 4
+	adbMatchFuzzy    = 8
+	adbMatchConflict = 16
+)
+
+// adbFile is a parsed ADB container
+type adbFile struct {
+	header []byte // magic and schema, covered by signatures
+	schema string
+	adb    []byte
+	sigs   [][]byte
+	data   map[[2]uint32][]byte
+}
+
+// isADB reports whether the package at path is in the APKv3 format
+func isADB(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	magic := make([]byte, 3)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return string(magic) == "ADB"
+}
+
+// readPackageADB reads an APKv3 package from disk
+func readPackageADB(path string) (*adbFile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := parseADB(raw)
+	if err != nil {
+		return nil, err
+	}
+	if f.schema != adbSchemaPackage {
+		return nil, fmt.Errorf("unexpected ADB schema %q, want %q", f.schema, adbSchemaPackage)
+	}
+
+	return f, nil
+}
+
+func parseADB(raw []byte) (*adbFile, error) {
+	raw, err := decompressADB(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < 8 || string(raw[:4]) != adbMagic {
+		return nil, fmt.Errorf("not an ADB file")
+	}
+
+	f := &adbFile{
+		header: raw[:8],
+		schema: string(raw[4:8]),
+		data:   make(map[[2]uint32][]byte),
+	}
+
+	pos := uint64(8)
+	for pos+4 <= uint64(len(raw)) {
+		typeSize := binary.LittleEndian.Uint32(raw[pos:])
+		blockType := typeSize >> 30
+		size := uint64(typeSize & 0x3fffffff)
+		hdrSize := uint64(4)
+
+		if blockType == adbBlockExt {
+			if pos+16 > uint64(len(raw)) {
+				return nil, fmt.Errorf("truncated block header")
+			}
+			blockType = typeSize & 0x3fffffff
+			size = binary.LittleEndian.Uint64(raw[pos+8:])
+			hdrSize = 16
+		}
+
+		if size < hdrSize || pos+size > uint64(len(raw)) {
+			return nil, fmt.Errorf("invalid block size at offset %d", pos)
+		}
+		payload := raw[pos+hdrSize : pos+size]
+
+		switch blockType {
+		case adbBlockADB:
+			f.adb = payload
+		case adbBlockSig:
+			f.sigs = append(f.sigs, payload)
+		case adbBlockData:
+			if len(payload) < 8 {
+				return nil, fmt.Errorf("invalid data block")
+			}
+			key := [2]uint32{
+				binary.LittleEndian.Uint32(payload[0:]),
+				binary.LittleEndian.Uint32(payload[4:]),
+			}
+			f.data[key] = payload[8:]
+		}
+
+		pos += (size + adbBlockAlign - 1) &^ (adbBlockAlign - 1)
+	}
+
+	if len(f.adb) < 8 {
+		return nil, fmt.Errorf("missing ADB block")
+	}
+
+	return f, nil
+}
+
+// decompressADB undoes the optional "ADBd" (deflate) or "ADBc" wrapper
+func decompressADB(raw []byte) ([]byte, error) {
+	if len(raw) < 4 {
+		return nil, fmt.Errorf("not an ADB file")
+	}
+
+	var payload []byte
+	switch string(raw[:4]) {
+	case adbMagic:
+		return raw, nil
+	case "ADBd":
+		payload = raw[4:]
+	case "ADBc":
+		if len(raw) < 6 {
+			return nil, fmt.Errorf("truncated compression header")
+		}
+		switch raw[4] {
+		case 0:
+			return raw[6:], nil
+		case 1:
+			payload = raw[6:]
+		default:
+			return nil, fmt.Errorf("unsupported ADB compression %d", raw[4])
+		}
+	default:
+		return nil, fmt.Errorf("not an ADB file")
+	}
+
+	fr := flate.NewReader(bytes.NewReader(payload))
+	defer fr.Close()
+	return io.ReadAll(fr)
+}
+
+// root returns the root object of the ADB block
+func (f *adbFile) root() adbObject {
+	return f.object(binary.LittleEndian.Uint32(f.adb[4:]))
+}
+
+// adbObject is an object or array: slot 0 holds the slot count, fields
+// and elements are numbered from 1
+type adbObject struct {
+	f     *adbFile
+	slots []uint32
+}
+
+func (f *adbFile) u32(off uint32) uint32 {
+	if uint64(off)+4 > uint64(len(f.adb)) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(f.adb[off:])
+}
+
+func (f *adbFile) object(v uint32) adbObject {
+	t := v & adbTypeMask
+	if t != adbTypeObject && t != adbTypeArray {
+		return adbObject{f: f}
+	}
+
+	off := v & adbValueMask
+	n := f.u32(off)
+	if n == 0 || uint64(off)+uint64(n)*4 > uint64(len(f.adb)) {
+		return adbObject{f: f}
+	}
+
+	slots := make([]uint32, n)
+	for i := range slots {
+		slots[i] = f.u32(off + uint32(i)*4)
+	}
+	return adbObject{f: f, slots: slots}
+}
+
+func (f *adbFile) blob(v uint32) []byte {
+	off := uint64(v & adbValueMask)
+	var start, length uint64
+
+	switch v & adbTypeMask {
+	case adbTypeBlob8:
+		if off+1 > uint64(len(f.adb)) {
+			return nil
+		}
+		start, length = off+1, uint64(f.adb[off])
+	case adbTypeBlob16:
+		if off+2 > uint64(len(f.adb)) {
+			return nil
+		}
+		start, length = off+2, uint64(binary.LittleEndian.Uint16(f.adb[off:]))
+	case adbTypeBlob32:
+		if off+4 > uint64(len(f.adb)) {
+			return nil
+		}
+		start, length = off+4, uint64(binary.LittleEndian.Uint32(f.adb[off:]))
+	default:
+		return nil
+	}
+
+	if start+length > uint64(len(f.adb)) {
+		return nil
+	}
+	return f.adb[start : start+length]
+}
+
+func (f *adbFile) integer(v uint32) uint64 {
+	off := v & adbValueMask
+	switch v & adbTypeMask {
+	case adbTypeInt:
+		return uint64(off)
+	case adbTypeInt32:
+		return uint64(f.u32(off))
+	case adbTypeInt64:
+		if uint64(off)+8 > uint64(len(f.adb)) {
+			return 0
+		}
+		return binary.LittleEndian.Uint64(f.adb[off:])
+	}
+	return 0
+}
+
+// count returns the number of fields or elements
+func (o adbObject) count() int {
+	if len(o.slots) == 0 {
+		return 0
+	}
+	return len(o.slots) - 1
+}
+
+func (o adbObject) val(i int) uint32 {
+	if i <= 0 || i >= len(o.slots) {
+		return adbTypeSpecial
+	}
+	return o.slots[i]
+}
+
+func (o adbObject) obj(i int) adbObject { return o.f.object(o.val(i)) }
+func (o adbObject) str(i int) string    { return string(o.f.blob(o.val(i))) }
+func (o adbObject) blob(i int) []byte   { return o.f.blob(o.val(i)) }
+func (o adbObject) int(i int) uint64    { return o.f.integer(o.val(i)) }
+
+// pkgInfo converts the package metadata to the fields ipkg reads from .PKGINFO
+func (f *adbFile) pkgInfo() *pkgInfo {
+	pi := f.root().obj(adbPkgInfo)
+	info := &pkgInfo{
+		Name:        pi.str(adbPIName),
+		Version:     pi.str(adbPIVersion),
+		Description: pi.str(adbPIDescription),
+		Arch:        pi.str(adbPIArch),
+		URL:         pi.str(adbPIURL),
+		License:     pi.str(adbPILicense),
+		Origin:      pi.str(adbPIOrigin),
+		Size:        int64(pi.int(adbPIInstalledSize)),
+	}
+
+	deps := pi.obj(adbPIDepends)
+	for i := 1; i <= deps.count(); i++ {
+		dep := deps.obj(i)
+		info.Depends = append(info.Depends, formatADBDependency(dep.str(adbDepName), dep.str(adbDepVersion), dep.int(adbDepMatch)))
+	}
+
+	triggers := f.root().obj(adbPkgTriggers)
+	for i := 1; i <= triggers.count(); i++ {
+		info.Triggers = append(info.Triggers, triggers.str(i))
+	}
+
+	return info
+}
+
+// scripts returns the package's install scripts keyed by their APKv2 name
+func (f *adbFile) scripts() map[string][]byte {
+	scripts := make(map[string][]byte)
+	obj := f.root().obj(adbPkgScripts)
+	for slot, name := range adbScriptNames {
+		if script := obj.blob(slot); len(script) > 0 {
+			scripts[name] = script
+		}
+	}
+	return scripts
+}
+
+func formatADBDependency(name, version string, match uint64) string {
+	prefix := ""
+	if match&adbMatchConflict != 0 {
+		prefix = "!"
+	}
+	if version == "" {
+		return prefix + name
+	}
+	if match&^adbMatchConflict == 0 {
+		match |= adbMatchEqual
+	}
+
+	op := "="
+	switch {
+	case match&adbMatchFuzzy != 0:
+		op = "~"
+	case match&(adbMatchLess|adbMatchEqual) == adbMatchLess|adbMatchEqual:
+		op = "<="
+	case match&(adbMatchGreater|adbMatchEqual) == adbMatchGreater|adbMatchEqual:
+		op = ">="
+	case match&adbMatchLess != 0:
+		op = "<"
+	case match&adbMatchGreater != 0:
+		op = ">"
+	}
+
+	return prefix + name + op + version
+}
+
+// extract writes the package file tree into rootfs and returns the installed
+// paths relative to rootfs. Regular files are checked against the hash
+// stored in the (signed) metadata.
+func (f *adbFile) extract(rootfs string) ([]string, error) {
+	var files []string
+
+	paths := f.root().obj(adbPkgPaths)
+	for di := 1; di <= paths.count(); di++ {
+		dir := paths.obj(di)
+		dirName := dir.str(adbDIName)
+
+		dirMode := os.FileMode(0755)
+		if mode := dir.obj(adbDIACL).int(adbACLMode); mode != 0 {
+			dirMode = os.FileMode(mode & 07777)
+		}
+		dirPath, err := extractTarget(rootfs, dirName)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dirPath, dirMode); err != nil {
+			return nil, err
+		}
+
+		entries := dir.obj(adbDIFiles)
+		for fi := 1; fi <= entries.count(); fi++ {
+			entry := entries.obj(fi)
+			name := filepath.Join(dirName, entry.str(adbFIName))
+			target, err := extractTarget(rootfs, name)
+			if err != nil {
+				return nil, err
+			}
+
+			if link := entry.blob(adbFITarget); len(link) >= 2 {
+				// Special files store their type in the first two bytes;
+				// only symlinks are created
+				if binary.LittleEndian.Uint16(link)&0170000 != 0120000 {
+					continue
+				}
+				os.Remove(target)
+				if err := os.Symlink(string(link[2:]), target); err != nil {
+					return nil, err
+				}
+				files = append(files, name)
+				continue
+			}
+
+			content := f.data[[2]uint32{uint32(di), uint32(fi)}]
+			if err := checkFileHash(name, content, entry.blob(adbFIHashes)); err != nil {
+				return nil, err
+			}
+
+			mode := os.FileMode(0644)
+			if m := entry.obj(adbFIACL).int(adbACLMode); m != 0 {
+				mode = os.FileMode(m & 07777)
+			}
+
+			os.Remove(target)
+			if err := os.WriteFile(target, content, mode); err != nil {
+				return nil, err
+			}
+			files = append(files, name)
+		}
+	}
+
+	return files, nil
+}
+
+// checksum returns the identity checksum of the package in the same form as
+// the index checksum like: "Q1" and the base64 SHA-1 of the metadata block,
+// or "Q2" and its SHA-256
+func (f *adbFile) checksum(like string) string {
+	if strings.HasPrefix(like, "Q1") {
+		sum := sha1.Sum(f.adb)
+		return "Q1" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	sum := sha256.Sum256(f.adb)
+	return "Q2" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// checkFileHash checks content against the hash stored for it. A missing
+// hash or one of unknown length fails, as the file cannot be verified.
+func checkFileHash(name string, content, want []byte) error {
+	var h hash.Hash
+	switch len(want) {
+	case sha256.Size:
+		h = sha256.New()
+	case sha1.Size:
+		h = sha1.New()
+	case 0:
+		return fmt.Errorf("%w: no content hash for %s", ErrUntrusted, name)
+	default:
+		return fmt.Errorf("%w: content hash of unknown type for %s", ErrUntrusted, name)
+	}
+
+	h.Write(content)
+	if !bytes.Equal(h.Sum(nil), want) {
+		return fmt.Errorf("%w: content hash mismatch for %s", ErrUntrusted, name)
+	}
+	return nil
+}
+
+// verifySignature checks the SIG blocks against the trusted keys. A v0
+// signature holds the hash algorithm of the ADB block digest, the first 16
+// bytes of the SHA-512 of the signing key and an RSA/SHA-512 signature over
+// the file header, those 18 bytes of signature header and the digest, as
+// apk-tools signs them.
+func (f *adbFile) verifySignature(keys map[string]*rsa.PublicKey) error {
+	if len(f.sigs) == 0 {
+		return fmt.Errorf("%w: package is not signed", ErrUntrusted)
+	}
+
+	for _, sig := range f.sigs {
+		if len(sig) < 18 || sig[0] != 0 {
+			continue
+		}
+
+		digest, ok := adbDigest(sig[1], f.adb)
+		if !ok {
+			continue
+		}
+
+		for _, key := range keys {
+			id := sha512.Sum512(x509.MarshalPKCS1PublicKey(key))
+			if !bytes.Equal(id[:16], sig[2:18]) {
+				continue
+			}
+
+			h := sha512.New()
+			h.Write(f.header)
+			h.Write(sig[:18])
+			h.Write(digest)
+			if rsa.VerifyPKCS1v15(key, crypto.SHA512, h.Sum(nil), sig[18:]) == nil {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: no valid signature from a trusted key", ErrUntrusted)
+}
+
+// adbDigest hashes data with one of apk-tools' digest algorithm ids
+func adbDigest(alg byte, data []byte) ([]byte, bool) {
+	switch alg {
+	case 0x02:
+		sum := sha1.Sum(data)
+		return sum[:], true
+	case 0x03:
+		sum := sha256.Sum256(data)
+		return sum[:], true
+	case 0x04:
+		sum := sha512.Sum512(data)
+		return sum[:], true
+	}
+	return nil, false
+}
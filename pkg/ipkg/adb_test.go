@@ -0,0 +1,374 @@
+package ipkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// adbBuilder writes the ADB block of a test package: a four byte header,
+// the root value, then the values it refers to
+type adbBuilder struct {
+	buf []byte
+}
+
+func newADBBuilder() *adbBuilder {
+	return &adbBuilder{buf: make([]byte, 8)}
+}
+
+func (b *adbBuilder) u32(v uint32) {
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, v)
+}
+
+func (b *adbBuilder) align() {
+	for len(b.buf)%4 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *adbBuilder) blob(data []byte) uint32 {
+	b.align()
+	off := uint32(len(b.buf))
+	b.u32(uint32(len(data)))
+	b.buf = append(b.buf, data...)
+	return adbTypeBlob32 | off
+}
+
+func (b *adbBuilder) str(s string) uint32 {
+	if s == "" {
+		return adbTypeSpecial
+	}
+	return b.blob([]byte(s))
+}
+
+func (b *adbBuilder) int(v uint32) uint32 {
+	return adbTypeInt | v
+}
+
+// object writes an object or array whose fields are numbered from 1
+func (b *adbBuilder) object(t uint32, slots ...uint32) uint32 {
+	b.align()
+	off := uint32(len(b.buf))
+	b.u32(uint32(len(slots) + 1))
+	for _, slot := range slots {
+		b.u32(slot)
+	}
+	return t | off
+}
+
+func (b *adbBuilder) finish(root uint32) []byte {
+	binary.LittleEndian.PutUint32(b.buf[4:], root)
+	return b.buf
+}
+
+// adbTestFile is a file of a test package
+type adbTestFile struct {
+	name    string
+	content string
+	link    string
+}
+
+// adbTestPackage builds the ADB block of a package holding files under
+// dir, and the DATA block payloads of its regular files
+func adbTestPackage(dir string, files []adbTestFile) ([]byte, [][]byte) {
+	b := newADBBuilder()
+
+	dep := b.object(adbTypeObject, b.str("musl"), b.str("1.2"), b.int(adbMatchGreater|adbMatchEqual))
+	conflict := b.object(adbTypeObject, b.str("hello-legacy"), 0, b.int(adbMatchConflict))
+	depends := b.object(adbTypeArray, dep, conflict)
+
+	info := make([]uint32, adbPIDepends)
+	info[adbPIName-1] = b.str("hello")
+	info[adbPIVersion-1] = b.str("2.12.1-r0")
+	info[adbPIDescription-1] = b.str("Prints a friendly greeting")
+	info[adbPIArch-1] = b.str("x86_64")
+	info[adbPILicense-1] = b.str("GPL-3.0-or-later")
+	info[adbPIOrigin-1] = b.str("hello")
+	info[adbPIURL-1] = b.str("https://www.gnu.org/software/hello/")
+	info[adbPIInstalledSize-1] = b.int(4096)
+	info[adbPIDepends-1] = depends
+	pkgInfo := b.object(adbTypeObject, info...)
+
+	var entries []uint32
+	var data [][]byte
+	for i, file := range files {
+		slots := make([]uint32, adbFITarget)
+		slots[adbFIName-1] = b.str(file.name)
+		if file.link != "" {
+			target := binary.LittleEndian.AppendUint16(nil, 0120000)
+			slots[adbFITarget-1] = b.blob(append(target, file.link...))
+		} else {
+			sum := sha256.Sum256([]byte(file.content))
+			slots[adbFIACL-1] = b.object(adbTypeObject, b.int(0755))
+			slots[adbFIHashes-1] = b.blob(sum[:])
+
+			payload := binary.LittleEndian.AppendUint32(nil, 1)
+			payload = binary.LittleEndian.AppendUint32(payload, uint32(i+1))
+			data = append(data, append(payload, file.content...))
+		}
+		entries = append(entries, b.object(adbTypeObject, slots...))
+	}
+	dirObj := b.object(adbTypeObject, b.str(dir), b.object(adbTypeObject, b.int(0755)), b.object(adbTypeArray, entries...))
+	paths := b.object(adbTypeArray, dirObj)
+
+	scripts := make([]uint32, 3)
+	scripts[2] = b.blob([]byte("#!/bin/sh\necho installed\n"))
+	scriptsObj := b.object(adbTypeObject, scripts...)
+	triggers := b.object(adbTypeArray, b.str("/usr/share/hello/*"))
+
+	root := b.object(adbTypeObject, pkgInfo, paths, scriptsObj, triggers)
+	return b.finish(root), data
+}
+
+// adbBlock frames a block payload, padded to the block alignment
+func adbBlock(blockType uint32, payload []byte) []byte {
+	block := binary.LittleEndian.AppendUint32(nil, blockType<<30|uint32(4+len(payload)))
+	block = append(block, payload...)
+	for len(block)%adbBlockAlign != 0 {
+		block = append(block, 0)
+	}
+	return block
+}
+
+// signADB returns a v0 SIG block payload for adb the way apk-tools writes
+// it: the 18-byte adb_sign_v0 header (version, hash algorithm, key id)
+// followed by an RSA/SHA-512 signature over the file header, that
+// signature header and the SHA-512 digest of the ADB block
+func signADB(t *testing.T, key *rsa.PrivateKey, header, adb []byte) []byte {
+	t.Helper()
+	id := sha512.Sum512(x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	sig := append([]byte{0, 0x04}, id[:16]...)
+
+	digest := sha512.Sum512(adb)
+	h := sha512.New()
+	h.Write(header)
+	h.Write(sig)
+	h.Write(digest[:])
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA512, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(sig, signature...)
+}
+
+// writeADB writes an APKv3 package of the given blocks and returns its path
+func writeADB(t *testing.T, adb []byte, sigs, data [][]byte) string {
+	t.Helper()
+	raw := []byte(adbMagic + adbSchemaPackage)
+	raw = append(raw, adbBlock(adbBlockADB, adb)...)
+	for _, sig := range sigs {
+		raw = append(raw, adbBlock(adbBlockSig, sig)...)
+	}
+	for _, payload := range data {
+		raw = append(raw, adbBlock(adbBlockData, payload)...)
+	}
+
+	path := filepath.Join(t.TempDir(), "hello-2.12.1-r0.apk")
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+var testADBFiles = []adbTestFile{
+	{name: "hello", content: "#!/bin/sh\necho hello\n"},
+	{name: "hi", link: "hello"},
+}
+
+func TestReadPackageADB(t *testing.T) {
+	adb, data := adbTestPackage("usr/bin", testADBFiles)
+	f, err := readPackageADB(writeADB(t, adb, nil, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &pkgInfo{
+		Name:        "hello",
+		Version:     "2.12.1-r0",
+		Description: "Prints a friendly greeting",
+		Arch:        "x86_64",
+		URL:         "https://www.gnu.org/software/hello/",
+		License:     "GPL-3.0-or-later",
+		Origin:      "hello",
+		Size:        4096,
+		Depends:     []string{"musl>=1.2", "!hello-legacy"},
+		Triggers:    []string{"/usr/share/hello/*"},
+	}
+	if got := f.pkgInfo(); !reflect.DeepEqual(got, want) {
+		t.Errorf("pkgInfo() = %+v, want %+v", got, want)
+	}
+
+	scripts := f.scripts()
+	if len(scripts) != 1 || string(scripts[scriptPostInstall]) != "#!/bin/sh\necho installed\n" {
+		t.Errorf("scripts() = %q, want only %s", scripts, scriptPostInstall)
+	}
+}
+
+func TestParseADBErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"empty", nil},
+		{"APKv2", []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00")},
+		{"no ADB block", []byte(adbMagic + adbSchemaPackage)},
+		{"block past the end", append([]byte(adbMagic+adbSchemaPackage), 0xff, 0, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseADB(tt.raw); err == nil {
+				t.Error("parseADB() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestADBExtract(t *testing.T) {
+	adb, data := adbTestPackage("usr/bin", testADBFiles)
+	f, err := readPackageADB(writeADB(t, adb, nil, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := t.TempDir()
+	files, err := f.extract(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"usr/bin/hello", "usr/bin/hi"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("extract() = %v, want %v", files, want)
+	}
+
+	content, err := os.ReadFile(filepath.Join(rootfs, "usr/bin/hello"))
+	if err != nil || string(content) != testADBFiles[0].content {
+		t.Errorf("usr/bin/hello = %q, %v", content, err)
+	}
+	if info, err := os.Stat(filepath.Join(rootfs, "usr/bin/hello")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("usr/bin/hello mode = %v, %v", info.Mode(), err)
+	}
+	if link, err := os.Readlink(filepath.Join(rootfs, "usr/bin/hi")); err != nil || link != "hello" {
+		t.Errorf("usr/bin/hi -> %q, %v", link, err)
+	}
+}
+
+func TestADBExtractRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		dir    string
+		files  []adbTestFile
+		tamper func(data [][]byte)
+	}{
+		{
+			name:   "changed content",
+			dir:    "usr/bin",
+			files:  testADBFiles[:1],
+			tamper: func(data [][]byte) { data[0][len(data[0])-2] = 'X' },
+		},
+		{
+			name:  "directory outside the root",
+			dir:   "../../etc",
+			files: []adbTestFile{{name: "passwd", content: "root::0:0::/root:/bin/sh\n"}},
+		},
+		{
+			name:  "file outside the root",
+			dir:   "usr/bin",
+			files: []adbTestFile{{name: "../../../etc/passwd", content: "root::0:0::/root:/bin/sh\n"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adb, data := adbTestPackage(tt.dir, tt.files)
+			if tt.tamper != nil {
+				tt.tamper(data)
+			}
+			f, err := readPackageADB(writeADB(t, adb, nil, data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			root := filepath.Join(t.TempDir(), "root")
+			if _, err := f.extract(root); err == nil {
+				t.Error("extract() succeeded, want an error")
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(root), "etc")); err == nil {
+				t.Error("extract() wrote outside the root")
+			}
+		})
+	}
+}
+
+func TestADBVerifySignature(t *testing.T) {
+	key := testKey(t)
+	other := testKey(t)
+	keys := map[string]*rsa.PublicKey{"test.rsa.pub": &key.PublicKey}
+	header := []byte(adbMagic + adbSchemaPackage)
+	adb, data := adbTestPackage("usr/bin", testADBFiles)
+
+	// The signature format before it covered the key id
+	shortHeader := func() []byte {
+		sig := signADB(t, key, header, adb)
+		digest := sha512.Sum512(adb)
+		h := sha512.New()
+		h.Write(header)
+		h.Write(sig[:2])
+		h.Write(digest[:])
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA512, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(sig[:18], signature...)
+	}
+
+	tampered := bytes.Replace(adb, []byte("friendly"), []byte("fiendish"), 1)
+
+	tests := []struct {
+		name string
+		adb  []byte
+		sigs [][]byte
+		ok   bool
+	}{
+		{"signed", adb, [][]byte{signADB(t, key, header, adb)}, true},
+		{"signed by an unknown and a trusted key", adb, [][]byte{signADB(t, other, header, adb), signADB(t, key, header, adb)}, true},
+		{"unsigned", adb, nil, false},
+		{"signed by an unknown key", adb, [][]byte{signADB(t, other, header, adb)}, false},
+		{"tampered metadata", tampered, [][]byte{signADB(t, key, header, adb)}, false},
+		{"signature over the short header", adb, [][]byte{shortHeader()}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := readPackageADB(writeADB(t, tt.adb, tt.sigs, data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.verifySignature(keys)
+			if tt.ok && err != nil {
+				t.Errorf("verifySignature() = %v, want success", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrUntrusted) {
+				t.Errorf("verifySignature() = %v, want ErrUntrusted", err)
+			}
+		})
+	}
+}
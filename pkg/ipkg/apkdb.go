@@ -0,0 +1,341 @@
+package ipkg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The apk-tools database, relative to the rootfs. ipkg keeps it in sync with
+// its own database so that apk can be used inside an environment.
+const (
+	apkInstalledPath    = "lib/apk/db/installed"
+	apkLockPath         = "lib/apk/db/lock"
+	apkWorldPath        = "etc/apk/world"
+	apkRepositoriesPath = "etc/apk/repositories"
+	apkArchPath         = "etc/apk/arch"
+)
+
+// apkStampPath holds the SHA-256 of each apk database file as ipkg last
+// wrote it; a file that no longer matches was changed by apk
+func apkStampPath(rootfs string) string {
+	return filepath.Join(rootfs, "var/lib/ipkg/apk-sync")
+}
+
+func readApkStamps(rootfs string) map[string]string {
+	stamps := make(map[string]string)
+	if data, err := os.ReadFile(apkStampPath(rootfs)); err == nil {
+		json.Unmarshal(data, &stamps)
+	}
+	return stamps
+}
+
+func contentSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// apkModified returns the content of the apk database file rel if it was
+// changed since ipkg wrote it
+func apkModified(rootfs, rel string) ([]byte, bool) {
+	data, err := os.ReadFile(filepath.Join(rootfs, rel))
+	if err != nil {
+		return nil, false
+	}
+	return data, readApkStamps(rootfs)[rel] != contentSHA256(data)
+}
+
+// writeApkFiles replaces apk database files, keyed by path relative to
+// rootfs, and records their checksums
+func writeApkFiles(rootfs string, files map[string][]byte) error {
+	stamps := readApkStamps(rootfs)
+	for rel, data := range files {
+		target := filepath.Join(rootfs, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(target, data, 0644); err != nil {
+			return err
+		}
+		stamps[rel] = contentSHA256(data)
+	}
+
+	data, err := json.MarshalIndent(stamps, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(apkStampPath(rootfs)), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(apkStampPath(rootfs), data, 0644)
+}
+
+// WriteApkRepositories writes /etc/apk/repositories for the environment at
+// rootfs. apk has no priorities or mirrors, so repositories are listed in
+// priority order by their primary URL.
+func WriteApkRepositories(rootfs string, repos []Repository) error {
+	return writeApkFiles(rootfs, map[string][]byte{apkRepositoriesPath: formatApkRepositories(repos)})
+}
+
+func formatApkRepositories(repos []Repository) []byte {
+	var b bytes.Buffer
+	for _, repo := range repos {
+		if repo.Tag != "" {
+			fmt.Fprintf(&b, "@%s ", repo.Tag)
+		}
+		fmt.Fprintln(&b, repo.String())
+	}
+	return b.Bytes()
+}
+
+// syncToApk writes the apk database from the packages committed by ipkg,
+// together with the repositories and architecture. Repositories added with
+// apk since the last sync are taken over into /etc/isobox/repositories.
+func (pm *PackageManager) syncToApk(packages []Package) error {
+	files := map[string][]byte{
+		apkInstalledPath: formatApkInstalled(packages),
+		apkWorldPath:     formatApkWorld(packages),
+	}
+
+	repos, err := pm.repositories()
+	if err != nil {
+		return err
+	}
+	if _, modified := apkModified(pm.rootfs, apkRepositoriesPath); modified {
+		if err := WriteRepositories(EnvRepositoriesPath(pm.rootfs), repos); err != nil {
+			return err
+		}
+	}
+	files[apkRepositoriesPath] = formatApkRepositories(repos)
+
+	if _, err := os.Stat(filepath.Join(pm.rootfs, apkArchPath)); os.IsNotExist(err) {
+		files[apkArchPath] = []byte(pm.architecture() + "\n")
+	}
+
+	return writeApkFiles(pm.rootfs, files)
+}
+
+// formatApkInstalled writes packages in the format of apk's installed
+// database: one "K:value" line per field, files listed per directory
+// ("F:" then "R:" lines), and records separated by blank lines
+func formatApkInstalled(packages []Package) []byte {
+	var b bytes.Buffer
+	for _, pkg := range packages {
+		if pkg.Checksum != "" {
+			fmt.Fprintf(&b, "C:%s\n", pkg.Checksum)
+		}
+		fmt.Fprintf(&b, "P:%s\n", pkg.Name)
+		fmt.Fprintf(&b, "V:%s\n", pkg.Version)
+		if pkg.Arch != "" {
+			fmt.Fprintf(&b, "A:%s\n", pkg.Arch)
+		}
+		fmt.Fprintf(&b, "I:%d\n", pkg.InstalledSize)
+		fmt.Fprintf(&b, "T:%s\n", pkg.Description)
+		if pkg.URL != "" {
+			fmt.Fprintf(&b, "U:%s\n", pkg.URL)
+		}
+		if pkg.License != "" {
+			fmt.Fprintf(&b, "L:%s\n", pkg.License)
+		}
+		if pkg.Origin != "" {
+			fmt.Fprintf(&b, "o:%s\n", pkg.Origin)
+		}
+		if len(pkg.Depends) > 0 {
+			fmt.Fprintf(&b, "D:%s\n", strings.Join(pkg.Depends, " "))
+		}
+		if len(pkg.Provides) > 0 {
+			fmt.Fprintf(&b, "p:%s\n", strings.Join(pkg.Provides, " "))
+		}
+
+		files := append([]string(nil), pkg.Files...)
+		sort.Strings(files)
+		for i, file := range files {
+			if dir := path.Dir(file); i == 0 || dir != path.Dir(files[i-1]) {
+				fmt.Fprintf(&b, "F:%s\n", strings.TrimPrefix(dir, "."))
+			}
+			fmt.Fprintf(&b, "R:%s\n", path.Base(file))
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// formatApkWorld lists the packages asked for by name. Held packages are
+// pinned to their version and tagged packages to their repository, the way
+// apk records "apk add name=version" and "apk add name@tag".
+func formatApkWorld(packages []Package) []byte {
+	var world []string
+	for _, pkg := range packages {
+		switch {
+		case pkg.Held:
+			world = append(world, pkg.Name+"="+pkg.Version)
+		case pkg.Pin != "":
+			world = append(world, pkg.Name+"@"+pkg.Pin)
+		case pkg.Explicit:
+			world = append(world, pkg.Name)
+		}
+	}
+	sort.Strings(world)
+
+	if len(world) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(world, "\n") + "\n")
+}
+
+// parseApkInstalled reads apk's installed database
+func parseApkInstalled(data []byte) []Package {
+	var packages []Package
+	var pkg Package
+	dir := ""
+
+	flush := func() {
+		if pkg.Name != "" {
+			packages = append(packages, pkg)
+		}
+		pkg = Package{}
+		dir = ""
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+
+		value := line[2:]
+		switch line[0] {
+		case 'C':
+			pkg.Checksum = value
+		case 'P':
+			pkg.Name = value
+		case 'V':
+			pkg.Version = value
+		case 'A':
+			pkg.Arch = value
+		case 'T':
+			pkg.Description = value
+		case 'U':
+			pkg.URL = value
+		case 'L':
+			pkg.License = value
+		case 'o':
+			pkg.Origin = value
+		case 'I':
+			pkg.InstalledSize, _ = strconv.ParseInt(value, 10, 64)
+		case 'D':
+			pkg.Depends = strings.Fields(value)
+		case 'p':
+			pkg.Provides = strings.Fields(value)
+		case 'F':
+			dir = value
+		case 'R':
+			pkg.Files = append(pkg.Files, path.Join(dir, value))
+		}
+	}
+	flush()
+
+	return packages
+}
+
+// worldEntry is one line of /etc/apk/world
+type worldEntry struct {
+	held bool
+	pin  string
+}
+
+// parseApkWorld reads /etc/apk/world: dependencies such as "git",
+// "go@edge" or "curl=8.5.0-r0", keyed by package name
+func parseApkWorld(data []byte) map[string]worldEntry {
+	world := make(map[string]worldEntry)
+	for _, dep := range strings.Fields(string(data)) {
+		if strings.HasPrefix(dep, "!") {
+			continue
+		}
+		name := dep
+		var entry worldEntry
+		if i := strings.IndexAny(name, "=<>~"); i >= 0 {
+			entry.held = name[i] == '='
+			name = name[:i]
+		}
+		name, entry.pin = splitPin(name)
+		world[name] = entry
+	}
+	return world
+}
+
+// syncFromApk merges changes made with apk since ipkg last wrote the apk
+// database into packages: packages apk installed or upgraded are taken
+// from its database, packages it removed are dropped, and holds, pins and
+// explicitly installed packages follow /etc/apk/world. Install scripts of
+// packages installed by apk stay with apk.
+func (pm *PackageManager) syncFromApk(packages []Package) []Package {
+	installedData, installedChanged := apkModified(pm.rootfs, apkInstalledPath)
+	worldData, worldChanged := apkModified(pm.rootfs, apkWorldPath)
+	if !installedChanged && !worldChanged {
+		return packages
+	}
+	if installedData == nil {
+		installedData = formatApkInstalled(packages)
+	}
+
+	world := parseApkWorld(worldData)
+	current := make(map[string]Package)
+	for _, pkg := range packages {
+		current[pkg.Name] = pkg
+	}
+
+	apkPackages := make(map[string]Package)
+	var added []string
+	for _, pkg := range parseApkInstalled(installedData) {
+		apkPackages[pkg.Name] = pkg
+		if _, ok := current[pkg.Name]; !ok {
+			added = append(added, pkg.Name)
+		}
+	}
+
+	var merged []Package
+	for _, name := range append(packageNames(packages), added...) {
+		apkPkg, ok := apkPackages[name]
+		if !ok {
+			continue
+		}
+		pkg, ok := current[name]
+		if !ok || pkg.Version != apkPkg.Version {
+			pkg = apkPkg
+			pkg.Installed = time.Now()
+		}
+
+		entry, explicit := world[name]
+		pkg.Explicit = explicit
+		pkg.Held = entry.held
+		pkg.Pin = entry.pin
+		merged = append(merged, pkg)
+	}
+
+	return merged
+}
+
+func packageNames(packages []Package) []string {
+	names := make([]string, 0, len(packages))
+	for _, pkg := range packages {
+		names = append(names, pkg.Name)
+	}
+	return names
+}
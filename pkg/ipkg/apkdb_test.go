@@ -0,0 +1,136 @@
+package ipkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApkInstalledRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		packages []Package
+	}{
+		{
+			name: "full record",
+			packages: []Package{{
+				Checksum:      "Q1abcdefghijklmnopqrstuvwxyz0=",
+				Name:          "curl",
+				Version:       "8.5.0-r0",
+				Arch:          "x86_64",
+				InstalledSize: 294912,
+				Description:   "URL retrieval utility and library",
+				URL:           "https://curl.se/",
+				License:       "curl",
+				Origin:        "curl",
+				Depends:       []string{"ca-certificates", "so:libc.musl-x86_64.so.1", "so:libcurl.so.4"},
+				Provides:      []string{"cmd:curl=8.5.0-r0"},
+				Files:         []string{"usr/bin/curl", "usr/share/man/man1/curl.1.gz"},
+			}},
+		},
+		{
+			name: "minimal records",
+			packages: []Package{
+				{Name: "alpine-baselayout-data", Version: "3.4.3-r2"},
+				{Name: "musl", Version: "1.2.4_git20230717-r4", Files: []string{"lib/ld-musl-x86_64.so.1", "lib/libc.musl-x86_64.so.1"}},
+			},
+		},
+		{
+			name: "files in the root and in several directories",
+			packages: []Package{{
+				Name:    "busybox",
+				Version: "1.36.1-r15",
+				Files:   []string{".post-install", "bin/busybox", "bin/sh", "etc/securetty", "etc/udhcpd.conf"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseApkInstalled(formatApkInstalled(tt.packages))
+			if !reflect.DeepEqual(got, tt.packages) {
+				t.Errorf("round trip changed the packages:\ngot  %+v\nwant %+v", got, tt.packages)
+			}
+		})
+	}
+}
+
+func TestParseApkInstalledIgnoresUnknownFields(t *testing.T) {
+	data := []byte("C:Q1xyz=\nP:zlib\nV:1.3.1-r0\nA:x86_64\nS:53718\nI:102400\nT:A compression library\nm:Natanael Copa <ncopa@alpinelinux.org>\nt:1706000000\nc:abc123\nF:lib\nR:libz.so.1\nZ:Q1zzz=\na:0:0:755\n\n")
+	want := []Package{{
+		Checksum:      "Q1xyz=",
+		Name:          "zlib",
+		Version:       "1.3.1-r0",
+		Arch:          "x86_64",
+		InstalledSize: 102400,
+		Description:   "A compression library",
+		Files:         []string{"lib/libz.so.1"},
+	}}
+
+	if got := parseApkInstalled(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseApkInstalled() = %+v, want %+v", got, want)
+	}
+}
+
+func TestApkWorldRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		packages []Package
+		world    string
+		want     map[string]worldEntry
+	}{
+		{
+			name:     "empty",
+			packages: []Package{{Name: "musl", Version: "1.2.4-r2"}},
+			world:    "",
+			want:     map[string]worldEntry{},
+		},
+		{
+			name: "explicit, held and pinned",
+			packages: []Package{
+				{Name: "git", Version: "2.43.0-r0", Explicit: true},
+				{Name: "curl", Version: "8.5.0-r0", Explicit: true, Held: true},
+				{Name: "go", Version: "1.22.5-r0", Explicit: true, Pin: "edge"},
+				{Name: "zlib", Version: "1.3.1-r0"},
+			},
+			world: "curl=8.5.0-r0\ngit\ngo@edge\n",
+			want: map[string]worldEntry{
+				"curl": {held: true},
+				"git":  {},
+				"go":   {pin: "edge"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			world := formatApkWorld(tt.packages)
+			if string(world) != tt.world {
+				t.Errorf("formatApkWorld() = %q, want %q", world, tt.world)
+			}
+			if got := parseApkWorld(world); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseApkWorld(%q) = %+v, want %+v", world, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseApkWorld(t *testing.T) {
+	tests := []struct {
+		world string
+		want  map[string]worldEntry
+	}{
+		{"git vim\n", map[string]worldEntry{"git": {}, "vim": {}}},
+		{"python3>=3.11\n", map[string]worldEntry{"python3": {}}},
+		{"curl=8.5.0-r0", map[string]worldEntry{"curl": {held: true}}},
+		{"go@edge=1.22.5-r0", map[string]worldEntry{"go": {held: true, pin: "edge"}}},
+		{"!nano busybox", map[string]worldEntry{"busybox": {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.world, func(t *testing.T) {
+			if got := parseApkWorld([]byte(tt.world)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseApkWorld(%q) = %+v, want %+v", tt.world, got, tt.want)
+			}
+		})
+	}
+}
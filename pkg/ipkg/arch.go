@@ -0,0 +1,103 @@
+package ipkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// LegacyArch is the architecture of environments created before the
+// architecture was recorded in their config.json
+const LegacyArch = "x86_64"
+
+// alpineArchs maps Go architecture names to Alpine's
+var alpineArchs = map[string]string{
+	"amd64":   "x86_64",
+	"386":     "x86",
+	"arm64":   "aarch64",
+	"arm":     "armv7",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+	"loong64": "loongarch64",
+}
+
+// HostArch returns the Alpine name of the architecture isobox runs on
+func HostArch() string {
+	if arch, ok := alpineArchs[runtime.GOARCH]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+// NormalizeArch turns an Alpine ("aarch64") or Go ("arm64") architecture
+// name into the Alpine name. An empty name means the host architecture.
+func NormalizeArch(arch string) (string, error) {
+	if arch == "" {
+		return HostArch(), nil
+	}
+	if alpine, ok := alpineArchs[arch]; ok {
+		return alpine, nil
+	}
+	if arch == "armhf" || GoArch(arch) != "" {
+		return arch, nil
+	}
+
+	var known []string
+	for _, alpine := range alpineArchs {
+		known = append(known, alpine)
+	}
+	known = append(known, "armhf")
+	sort.Strings(known)
+	return "", fmt.Errorf("unknown architecture %s (known: %s)", arch, strings.Join(known, ", "))
+}
+
+// GoArch returns the Go name of an Alpine architecture, or "" if Go does
+// not support it
+func GoArch(arch string) string {
+	if arch == "armhf" {
+		return "arm"
+	}
+	for goArch, alpine := range alpineArchs {
+		if alpine == arch {
+			return goArch
+		}
+	}
+	return ""
+}
+
+// EnvironmentArch reads the architecture recorded in the config.json of the
+// environment whose root filesystem is rootfs
+func EnvironmentArch(rootfs string) string {
+	data, err := os.ReadFile(filepath.Join(rootfs, "config.json"))
+	if err != nil {
+		return HostArch()
+	}
+
+	var config struct {
+		Arch string `json:"arch"`
+	}
+	if json.Unmarshal(data, &config) != nil || config.Arch == "" {
+		return LegacyArch
+	}
+
+	return config.Arch
+}
+
+// architecture returns the architecture packages are installed for
+func (pm *PackageManager) architecture() string {
+	if pm.arch == "" {
+		pm.arch = EnvironmentArch(pm.rootfs)
+	}
+	return pm.arch
+}
+
+// archMatches reports whether a package built for arch can be installed in
+// an environment of envArch
+func archMatches(arch, envArch string) bool {
+	return arch == "" || arch == "noarch" || arch == envArch
+}
@@ -0,0 +1,315 @@
+package ipkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Severity levels, lowest first. Findings whose severity is not known
+// count as meeting every threshold.
+var severityLevels = []string{"low", "medium", "high", "critical"}
+
+// severityAliases maps other vendors' names onto severityLevels
+var severityAliases = map[string]string{
+	"negligible": "low",
+	"moderate":   "medium",
+	"important":  "high",
+}
+
+// secDB is an Alpine secdb feed, such as
+// https://secdb.alpinelinux.org/v3.18/main.json. Each package maps the
+// versions that fixed vulnerabilities to their IDs; version "0" lists
+// vulnerabilities that never affected Alpine's package.
+type secDB struct {
+	DistroVersion string `json:"distroversion"`
+	RepoName      string `json:"reponame"`
+	Packages      []struct {
+		Pkg struct {
+			Name     string              `json:"name"`
+			Secfixes map[string][]string `json:"secfixes"`
+		} `json:"pkg"`
+	} `json:"packages"`
+}
+
+// secFix is a version of a source package that fixed a vulnerability
+type secFix struct {
+	id      string
+	fixedIn string
+}
+
+// Vulnerability is a vulnerability affecting an installed package
+type Vulnerability struct {
+	ID       string `json:"id"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Origin   string `json:"origin,omitempty"`
+	FixedIn  string `json:"fixed_in"`
+	Severity string `json:"severity"`
+}
+
+// AuditOptions selects the security data and failure threshold of Audit
+type AuditOptions struct {
+	// SecDB is a secdb JSON file, a directory of them, or a URL
+	SecDB string
+
+	// Severities is an optional JSON file mapping vulnerability IDs to
+	// severities, as secdb has none
+	Severities string
+
+	// FailOn is the lowest severity that fails the audit: low, medium,
+	// high, critical, or none to never fail
+	FailOn string
+
+	JSON bool
+}
+
+// Audit reports the vulnerabilities listed in Alpine's secdb that affect
+// the installed packages: those whose version is older than the version of
+// their source package that fixed them. It returns an error if any
+// vulnerability is at or above opts.FailOn.
+func (pm *PackageManager) Audit(ctx context.Context, opts AuditOptions) error {
+	pm.ctx = ctx
+	threshold, err := severityRank(opts.FailOn)
+	if err != nil {
+		return err
+	}
+
+	fixes, err := pm.loadSecDB(opts.SecDB)
+	if err != nil {
+		return err
+	}
+	severities, err := loadSeverities(opts.Severities)
+	if err != nil {
+		return err
+	}
+
+	if err := pm.ensureDB(); err != nil {
+		return err
+	}
+	packages, err := pm.getInstalled()
+	if err != nil {
+		return err
+	}
+
+	vulns := findVulnerabilities(packages, fixes, severities)
+
+	failing := 0
+	for _, vuln := range vulns {
+		if rank, _ := severityRank(vuln.Severity); threshold >= 0 && (rank < 0 || rank >= threshold) {
+			failing++
+		}
+	}
+
+	if opts.JSON {
+		if err := printJSON(vulns); err != nil {
+			return err
+		}
+	} else {
+		printVulnerabilities(vulns, len(packages))
+	}
+
+	if failing > 0 {
+		return fmt.Errorf("%d vulnerabilities at or above %s severity", failing, opts.FailOn)
+	}
+	return nil
+}
+
+// findVulnerabilities returns the fixes that packages are older than, once
+// per package and ID, sorted by package and ID
+func findVulnerabilities(packages []Package, fixes map[string][]secFix, severities map[string]string) []Vulnerability {
+	vulns := []Vulnerability{}
+	for _, pkg := range packages {
+		origin := pkg.Origin
+		if origin == "" {
+			origin = pkg.Name
+		}
+		// An ID listed under several versions counts once, fixed in the latest
+		seen := make(map[string]int)
+		for _, fix := range fixes[origin] {
+			if compareVersions(pkg.Version, fix.fixedIn) >= 0 {
+				continue
+			}
+			if i, ok := seen[fix.id]; ok {
+				if compareVersions(fix.fixedIn, vulns[i].FixedIn) > 0 {
+					vulns[i].FixedIn = fix.fixedIn
+				}
+				continue
+			}
+			seen[fix.id] = len(vulns)
+			severity := severities[fix.id]
+			if severity == "" {
+				severity = "unknown"
+			}
+			vulns = append(vulns, Vulnerability{
+				ID:       fix.id,
+				Package:  pkg.Name,
+				Version:  pkg.Version,
+				Origin:   pkg.Origin,
+				FixedIn:  fix.fixedIn,
+				Severity: severity,
+			})
+		}
+	}
+	sort.SliceStable(vulns, func(i, j int) bool {
+		if vulns[i].Package != vulns[j].Package {
+			return vulns[i].Package < vulns[j].Package
+		}
+		return vulns[i].ID < vulns[j].ID
+	})
+	return vulns
+}
+
+// printVulnerabilities lists vulns by package, with a summary by severity
+func printVulnerabilities(vulns []Vulnerability, scanned int) {
+	if len(vulns) == 0 {
+		fmt.Printf("No known vulnerabilities in %d packages\n", scanned)
+		return
+	}
+
+	counts := make(map[string]int)
+	affected := 0
+	for i, vuln := range vulns {
+		if i == 0 || vuln.Package != vulns[i-1].Package {
+			affected++
+			if vuln.Origin != "" && vuln.Origin != vuln.Package {
+				fmt.Printf("%s %s (%s):\n", vuln.Package, vuln.Version, vuln.Origin)
+			} else {
+				fmt.Printf("%s %s:\n", vuln.Package, vuln.Version)
+			}
+		}
+		fmt.Printf("  %-18s %-9s fixed in %s\n", vuln.ID, vuln.Severity, vuln.FixedIn)
+		counts[vuln.Severity]++
+	}
+
+	var summary []string
+	for i := len(severityLevels) - 1; i >= 0; i-- {
+		if n := counts[severityLevels[i]]; n > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", n, severityLevels[i]))
+		}
+	}
+	if n := counts["unknown"]; n > 0 {
+		summary = append(summary, fmt.Sprintf("%d unknown", n))
+	}
+	fmt.Printf("%d vulnerabilities in %d of %d packages (%s)\n", len(vulns), affected, scanned, strings.Join(summary, ", "))
+}
+
+// severityRank returns the position of a severity in severityLevels, or
+// -1 for "none" and for severities that are not known
+func severityRank(severity string) (int, error) {
+	severity = normalizeSeverity(severity)
+	if severity == "none" {
+		return -1, nil
+	}
+	for i, level := range severityLevels {
+		if level == severity {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("unknown severity %s (known: %s, none)", severity, strings.Join(severityLevels, ", "))
+}
+
+func normalizeSeverity(severity string) string {
+	severity = strings.ToLower(strings.TrimSpace(severity))
+	if alias, ok := severityAliases[severity]; ok {
+		return alias
+	}
+	return severity
+}
+
+// loadSecDB reads the secdb feeds at source, a file, a directory of .json
+// files or a URL, and returns the fixes of each source package. Feeds for
+// another Alpine branch than the environment's are skipped.
+func (pm *PackageManager) loadSecDB(source string) (map[string][]secFix, error) {
+	if source == "" {
+		return nil, fmt.Errorf("no secdb given")
+	}
+
+	sources := []string{source}
+	if !strings.Contains(source, "://") {
+		abs, err := filepath.Abs(source)
+		if err != nil {
+			return nil, err
+		}
+		sources = []string{abs}
+
+		if info, err := os.Stat(abs); err == nil && info.IsDir() {
+			if sources, err = filepath.Glob(filepath.Join(abs, "*.json")); err != nil {
+				return nil, err
+			}
+			if len(sources) == 0 {
+				return nil, fmt.Errorf("no secdb .json files in %s", source)
+			}
+		}
+	}
+
+	branch := environmentBranch(pm.rootfs)
+	fixes := make(map[string][]secFix)
+	used := 0
+	for _, path := range sources {
+		data, err := FetchURL(pm.context(), path)
+		if err != nil {
+			return nil, fmt.Errorf("read secdb %s: %w", path, err)
+		}
+
+		var db secDB
+		if err := json.Unmarshal(data, &db); err != nil {
+			return nil, fmt.Errorf("parse secdb %s: %w", path, err)
+		}
+		if db.DistroVersion != "" && db.DistroVersion != branch {
+			fmt.Fprintf(os.Stderr, "  Warning: skipping %s, which is for Alpine %s (the environment uses %s)\n", path, db.DistroVersion, branch)
+			continue
+		}
+		used++
+
+		for _, entry := range db.Packages {
+			for version, ids := range entry.Pkg.Secfixes {
+				if version == "0" {
+					continue
+				}
+				for _, field := range ids {
+					// Entries may name several IDs, as in "CVE-2023-1 GHSA-xxxx"
+					for _, id := range strings.Fields(field) {
+						fixes[entry.Pkg.Name] = append(fixes[entry.Pkg.Name], secFix{id: id, fixedIn: version})
+					}
+				}
+			}
+		}
+	}
+
+	if used == 0 {
+		return nil, fmt.Errorf("no secdb feed for Alpine %s in %s", branch, source)
+	}
+	return fixes, nil
+}
+
+// loadSeverities reads a JSON object mapping vulnerability IDs to
+// severities, if path is set
+func loadSeverities(path string) (map[string]string, error) {
+	severities := make(map[string]string)
+	if path == "" {
+		return severities, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read severities: %w", err)
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse severities %s: %w", path, err)
+	}
+
+	for id, severity := range raw {
+		severity = normalizeSeverity(severity)
+		if rank, err := severityRank(severity); err != nil || rank < 0 {
+			return nil, fmt.Errorf("severities %s: %s has unknown severity %q", path, id, raw[id])
+		}
+		severities[id] = severity
+	}
+	return severities, nil
+}
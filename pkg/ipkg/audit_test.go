@@ -0,0 +1,147 @@
+package ipkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindVulnerabilities(t *testing.T) {
+	fixes := map[string][]secFix{
+		"openssl": {
+			{id: "CVE-2023-5678", fixedIn: "3.1.4-r1"},
+			{id: "CVE-2024-0727", fixedIn: "3.1.4-r5"},
+		},
+		"curl": {
+			{id: "CVE-2023-46218", fixedIn: "8.5.0-r0"},
+			{id: "CVE-2023-46218", fixedIn: "8.4.0-r0"},
+		},
+		"zlib": {
+			{id: "CVE-2022-37434", fixedIn: "1.2.12-r2"},
+		},
+	}
+	severities := map[string]string{"CVE-2024-0727": "medium"}
+
+	tests := []struct {
+		name     string
+		packages []Package
+		want     []Vulnerability
+	}{
+		{
+			name:     "older than the fix",
+			packages: []Package{{Name: "curl", Version: "8.4.0-r0"}},
+			want: []Vulnerability{
+				{ID: "CVE-2023-46218", Package: "curl", Version: "8.4.0-r0", FixedIn: "8.5.0-r0", Severity: "unknown"},
+			},
+		},
+		{
+			name:     "at the fixed version",
+			packages: []Package{{Name: "curl", Version: "8.5.0-r0"}},
+			want:     []Vulnerability{},
+		},
+		{
+			name:     "newer than the fix",
+			packages: []Package{{Name: "zlib", Version: "1.3.1-r0"}},
+			want:     []Vulnerability{},
+		},
+		{
+			name:     "not in the feed",
+			packages: []Package{{Name: "busybox", Version: "1.36.1-r15"}},
+			want:     []Vulnerability{},
+		},
+		{
+			name:     "matched by origin",
+			packages: []Package{{Name: "libssl3", Version: "3.1.4-r3", Origin: "openssl"}},
+			want: []Vulnerability{
+				{ID: "CVE-2024-0727", Package: "libssl3", Version: "3.1.4-r3", Origin: "openssl", FixedIn: "3.1.4-r5", Severity: "medium"},
+			},
+		},
+		{
+			name: "several packages",
+			packages: []Package{
+				{Name: "zlib", Version: "1.2.12-r1"},
+				{Name: "libcrypto3", Version: "3.1.4-r0", Origin: "openssl"},
+				{Name: "curl", Version: "8.5.0-r0"},
+			},
+			want: []Vulnerability{
+				{ID: "CVE-2023-5678", Package: "libcrypto3", Version: "3.1.4-r0", Origin: "openssl", FixedIn: "3.1.4-r1", Severity: "unknown"},
+				{ID: "CVE-2024-0727", Package: "libcrypto3", Version: "3.1.4-r0", Origin: "openssl", FixedIn: "3.1.4-r5", Severity: "medium"},
+				{ID: "CVE-2022-37434", Package: "zlib", Version: "1.2.12-r1", FixedIn: "1.2.12-r2", Severity: "unknown"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findVulnerabilities(tt.packages, fixes, severities)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findVulnerabilities() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSecDBDirectory(t *testing.T) {
+	dir := t.TempDir()
+	feeds := map[string]string{
+		"main.json": `{"distroversion": "` + DefaultBranch + `", "reponame": "main", "packages": [
+			{"pkg": {"name": "curl", "secfixes": {
+				"8.5.0-r0": ["CVE-2023-46218 GHSA-xxxx-yyyy"],
+				"0": ["CVE-2021-0000"]
+			}}}
+		]}`,
+		"community.json": `{"distroversion": "` + DefaultBranch + `", "reponame": "community", "packages": [
+			{"pkg": {"name": "go", "secfixes": {"1.21.5-r0": ["CVE-2023-39326"]}}}
+		]}`,
+		"other-branch.json": `{"distroversion": "v2.0", "reponame": "main", "packages": [
+			{"pkg": {"name": "zlib", "secfixes": {"1.2.12-r2": ["CVE-2022-37434"]}}}
+		]}`,
+		"notes.txt": "not a feed",
+	}
+	for name, data := range feeds {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pm := NewRootfsPackageManager(t.TempDir(), DefaultBranch, "x86_64")
+	fixes, err := pm.loadSecDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]secFix{
+		"curl": {{id: "CVE-2023-46218", fixedIn: "8.5.0-r0"}, {id: "GHSA-xxxx-yyyy", fixedIn: "8.5.0-r0"}},
+		"go":   {{id: "CVE-2023-39326", fixedIn: "1.21.5-r0"}},
+	}
+	if !reflect.DeepEqual(fixes, want) {
+		t.Errorf("loadSecDB() = %+v, want %+v", fixes, want)
+	}
+}
+
+func TestLoadSecDBErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		feeds map[string]string
+	}{
+		{"no feeds", map[string]string{}},
+		{"only other branches", map[string]string{"main.json": `{"distroversion": "v2.0", "packages": []}`}},
+		{"invalid JSON", map[string]string{"main.json": `{"packages": [`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.feeds {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pm := NewRootfsPackageManager(t.TempDir(), DefaultBranch, "x86_64")
+			if _, err := pm.loadSecDB(dir); err == nil {
+				t.Error("loadSecDB() succeeded, want an error")
+			}
+		})
+	}
+}
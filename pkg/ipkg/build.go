@@ -0,0 +1,488 @@
+package ipkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// BuildSpecFile is the metadata file of a package directory; the files to
+// package are staged under BuildFilesDir next to it
+const (
+	BuildSpecFile = "package.toml"
+	BuildFilesDir = "files"
+)
+
+// BuildSpec describes a package built with Build
+type BuildSpec struct {
+	Name        string   `toml:"name"`
+	Version     string   `toml:"version"`
+	Description string   `toml:"description"`
+	URL         string   `toml:"url"`
+	License     string   `toml:"license"`
+	Arch        string   `toml:"arch"`
+	Origin      string   `toml:"origin"`
+	Maintainer  string   `toml:"maintainer"`
+	Depends     []string `toml:"depends"`
+	Provides    []string `toml:"provides"`
+	Triggers    []string `toml:"triggers"`
+
+	// Scripts maps install script names (post-install, pre-deinstall, ...)
+	// to files relative to the package directory
+	Scripts map[string]string `toml:"scripts"`
+}
+
+// LoadBuildSpec reads and checks the package.toml of a package directory
+func LoadBuildSpec(dir string) (*BuildSpec, error) {
+	var spec BuildSpec
+	path := filepath.Join(dir, BuildSpecFile)
+	if _, err := toml.DecodeFile(path, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if spec.Name == "" || spec.Version == "" {
+		return nil, fmt.Errorf("%s: name and version are required", path)
+	}
+	for _, field := range []string{spec.Name, spec.Version, spec.Arch, spec.Origin} {
+		if strings.ContainsAny(field, " \t\n/") {
+			return nil, fmt.Errorf("%s: %q may not contain spaces or slashes", path, field)
+		}
+	}
+	for name := range spec.Scripts {
+		if !isScriptName("." + name) {
+			return nil, fmt.Errorf("%s: unknown script %s", path, name)
+		}
+	}
+
+	if spec.Arch == "" {
+		spec.Arch = HostArch()
+	}
+	if spec.Origin == "" {
+		spec.Origin = spec.Name
+	}
+	return &spec, nil
+}
+
+// isScriptName reports whether name is an install script APKs may carry
+func isScriptName(name string) bool {
+	for _, script := range scriptNames {
+		if name == script {
+			return true
+		}
+	}
+	return false
+}
+
+// Signer signs packages and indexes with an RSA private key. The name of
+// the matching public key, as installed in /etc/apk/keys or
+// ~/.config/isobox/keys, is recorded in the signature.
+type Signer struct {
+	key     *rsa.PrivateKey
+	keyName string
+}
+
+// LoadSigner reads a PEM encoded RSA private key. keyName defaults to the
+// abuild convention: the private key file name with ".pub" appended, as in
+// builder.rsa and builder.rsa.pub.
+func LoadSigner(path, keyName string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: not PEM encoded", path)
+	}
+
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = parsed
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an RSA key", path)
+		}
+		key = rsaKey
+	}
+
+	if keyName == "" {
+		keyName = filepath.Base(path)
+		if !strings.HasSuffix(keyName, ".rsa") {
+			keyName = strings.TrimSuffix(keyName, filepath.Ext(keyName)) + ".rsa"
+		}
+		keyName += ".pub"
+	}
+
+	return &Signer{key: key, keyName: keyName}, nil
+}
+
+// KeyName returns the name of the public key verifying the signatures
+func (s *Signer) KeyName() string {
+	return s.keyName
+}
+
+// sign returns the gzipped signature stream over stream
+func (s *Signer) sign(stream []byte) ([]byte, error) {
+	sum := sha256.Sum256(stream)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the control stream, the signature stream has no end-of-archive
+	// marker, so the streams read as a single tar archive
+	return gzipTar(false, func(tw *tar.Writer) error {
+		return writeTarFile(tw, ".SIGN.RSA256."+s.keyName, 0644, sig)
+	})
+}
+
+// Build creates an APK from a package directory: package.toml describes the
+// package and files/ holds the tree to install, laid out as in the root
+// filesystem. The package is written to outDir as <name>-<version>.apk and
+// signed when signer is not nil. It returns the path of the package.
+func Build(dir, outDir string, signer *Signer) (string, error) {
+	spec, err := LoadBuildSpec(dir)
+	if err != nil {
+		return "", err
+	}
+
+	filesDir := filepath.Join(dir, BuildFilesDir)
+	if info, err := os.Stat(filesDir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s: no %s directory with the files to package", dir, BuildFilesDir)
+	}
+
+	fmt.Printf("Building %s %s...\n", spec.Name, spec.Version)
+
+	data, size, err := buildDataStream(filesDir)
+	if err != nil {
+		return "", fmt.Errorf("package files: %w", err)
+	}
+
+	dataHash := sha256.Sum256(data)
+	control, err := buildControlStream(dir, spec, size, hex.EncodeToString(dataHash[:]))
+	if err != nil {
+		return "", err
+	}
+
+	var streams [][]byte
+	if signer != nil {
+		sig, err := signer.sign(control)
+		if err != nil {
+			return "", fmt.Errorf("sign package: %w", err)
+		}
+		streams = append(streams, sig)
+		fmt.Printf("  Signed with %s\n", signer.KeyName())
+	}
+	streams = append(streams, control, data)
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(outDir, fmt.Sprintf("%s-%s.apk", spec.Name, spec.Version))
+	if err := os.WriteFile(path, bytes.Join(streams, nil), 0644); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Built %s\n", path)
+	return path, nil
+}
+
+// buildControlStream writes .PKGINFO and the install scripts
+func buildControlStream(dir string, spec *BuildSpec, size int64, dataHash string) ([]byte, error) {
+	var info strings.Builder
+	fmt.Fprintf(&info, "# Generated by isobox pkg build\n")
+	fmt.Fprintf(&info, "pkgname = %s\n", spec.Name)
+	fmt.Fprintf(&info, "pkgver = %s\n", spec.Version)
+	fmt.Fprintf(&info, "pkgdesc = %s\n", spec.Description)
+	if spec.URL != "" {
+		fmt.Fprintf(&info, "url = %s\n", spec.URL)
+	}
+	fmt.Fprintf(&info, "builddate = %d\n", time.Now().Unix())
+	fmt.Fprintf(&info, "size = %d\n", size)
+	fmt.Fprintf(&info, "arch = %s\n", spec.Arch)
+	fmt.Fprintf(&info, "origin = %s\n", spec.Origin)
+	if spec.Maintainer != "" {
+		fmt.Fprintf(&info, "maintainer = %s\n", spec.Maintainer)
+	}
+	if spec.License != "" {
+		fmt.Fprintf(&info, "license = %s\n", spec.License)
+	}
+	for _, dep := range spec.Depends {
+		fmt.Fprintf(&info, "depend = %s\n", dep)
+	}
+	for _, provide := range spec.Provides {
+		fmt.Fprintf(&info, "provides = %s\n", provide)
+	}
+	if len(spec.Triggers) > 0 {
+		fmt.Fprintf(&info, "triggers = %s\n", strings.Join(spec.Triggers, " "))
+	}
+	fmt.Fprintf(&info, "datahash = %s\n", dataHash)
+
+	var scripts []string
+	for name := range spec.Scripts {
+		scripts = append(scripts, name)
+	}
+	sort.Strings(scripts)
+
+	// The control stream has no end-of-archive marker, so that reading the
+	// package as one tar archive continues into the data stream
+	return gzipTar(false, func(tw *tar.Writer) error {
+		if err := writeTarFile(tw, ".PKGINFO", 0644, []byte(info.String())); err != nil {
+			return err
+		}
+		for _, name := range scripts {
+			content, err := os.ReadFile(filepath.Join(dir, spec.Scripts[name]))
+			if err != nil {
+				return fmt.Errorf("script %s: %w", name, err)
+			}
+			if err := writeTarFile(tw, "."+name, 0755, content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// buildDataStream archives the staged file tree, owned by root, and returns
+// it with the installed size. Regular files carry their SHA-1 in a PAX
+// record like packages built by abuild.
+func buildDataStream(filesDir string) ([]byte, int64, error) {
+	var size int64
+	data, err := gzipTar(true, func(tw *tar.Writer) error {
+		return filepath.Walk(filesDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(filesDir, path)
+			if err != nil || rel == "." {
+				return err
+			}
+
+			var link string
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			} else if !info.Mode().IsRegular() && !info.IsDir() {
+				return fmt.Errorf("%s: unsupported file type", rel)
+			}
+
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(rel)
+			if info.IsDir() {
+				header.Name += "/"
+			}
+			header.Uid, header.Gid = 0, 0
+			header.Uname, header.Gname = "root", "root"
+			header.Format = tar.FormatPAX
+
+			if !info.Mode().IsRegular() {
+				return tw.WriteHeader(header)
+			}
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			sum := sha1.Sum(content)
+			header.PAXRecords = map[string]string{"APK-TOOLS.checksum.SHA1": hex.EncodeToString(sum[:])}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			size += int64(len(content))
+			_, err = tw.Write(content)
+			return err
+		})
+	})
+	return data, size, err
+}
+
+// gzipTar returns a gzip stream of the tar archive written by fill. Without
+// end the archive is left open, for streams that are followed by another.
+func gzipTar(end bool, fill func(*tar.Writer) error) ([]byte, error) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	if err := fill(tw); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if end {
+		err = tw.Close()
+	} else {
+		err = tw.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTarFile adds a regular file owned by root
+func writeTarFile(tw *tar.Writer, name string, mode int64, content []byte) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     mode,
+		Size:     int64(len(content)),
+		Uname:    "root",
+		Gname:    "root",
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// BuildIndex writes APKINDEX.tar.gz for the packages in dir, so the
+// directory can serve as the <arch> directory of a repository. The index is
+// signed when signer is not nil.
+func BuildIndex(dir, description string, signer *Signer) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	var index bytes.Buffer
+	for _, path := range paths {
+		entry, err := indexEntryFromFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		writeIndexEntry(&index, entry)
+	}
+
+	if description == "" {
+		description = filepath.Base(dir)
+	}
+
+	stream, err := gzipTar(true, func(tw *tar.Writer) error {
+		if err := writeTarFile(tw, "DESCRIPTION", 0644, []byte(description)); err != nil {
+			return err
+		}
+		return writeTarFile(tw, "APKINDEX", 0644, index.Bytes())
+	})
+	if err != nil {
+		return err
+	}
+
+	streams := [][]byte{stream}
+	if signer != nil {
+		sig, err := signer.sign(stream)
+		if err != nil {
+			return fmt.Errorf("sign index: %w", err)
+		}
+		streams = [][]byte{sig, stream}
+	}
+
+	path := filepath.Join(dir, "APKINDEX.tar.gz")
+	if err := os.WriteFile(path, bytes.Join(streams, nil), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Indexed %d packages in %s\n", len(paths), path)
+	return nil
+}
+
+// indexEntryFromFile reads the index fields of an APKv2 package
+func indexEntryFromFile(path string) (*IndexEntry, error) {
+	if isADB(path) {
+		return nil, fmt.Errorf("APKv3 packages cannot be indexed")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := splitGzipStreams(data)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt archive: %w", err)
+	}
+
+	control := controlStream(streams)
+	if control == nil {
+		return nil, fmt.Errorf("missing control stream")
+	}
+
+	info := parsePkgInfoStream(control)
+	if info.Name == "" || info.Version == "" {
+		return nil, fmt.Errorf("no .PKGINFO")
+	}
+
+	return &IndexEntry{
+		Name:          info.Name,
+		Version:       info.Version,
+		Arch:          info.Arch,
+		Description:   info.Description,
+		URL:           info.URL,
+		License:       info.License,
+		Origin:        info.Origin,
+		Size:          int64(len(data)),
+		InstalledSize: info.Size,
+		Checksum:      controlChecksum(control),
+		Depends:       info.Depends,
+		Provides:      info.Provides,
+	}, nil
+}
+
+// writeIndexEntry writes one record of the APKINDEX text format
+func writeIndexEntry(w io.Writer, e *IndexEntry) {
+	fmt.Fprintf(w, "C:%s\n", e.Checksum)
+	fmt.Fprintf(w, "P:%s\n", e.Name)
+	fmt.Fprintf(w, "V:%s\n", e.Version)
+	if e.Arch != "" {
+		fmt.Fprintf(w, "A:%s\n", e.Arch)
+	}
+	fmt.Fprintf(w, "S:%d\n", e.Size)
+	fmt.Fprintf(w, "I:%d\n", e.InstalledSize)
+	fmt.Fprintf(w, "T:%s\n", e.Description)
+	if e.URL != "" {
+		fmt.Fprintf(w, "U:%s\n", e.URL)
+	}
+	if e.License != "" {
+		fmt.Fprintf(w, "L:%s\n", e.License)
+	}
+	if e.Origin != "" {
+		fmt.Fprintf(w, "o:%s\n", e.Origin)
+	}
+	if len(e.Depends) > 0 {
+		fmt.Fprintf(w, "D:%s\n", strings.Join(e.Depends, " "))
+	}
+	if len(e.Provides) > 0 {
+		fmt.Fprintf(w, "p:%s\n", strings.Join(e.Provides, " "))
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,328 @@
+package ipkg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCacheMaxSize is the package cache size cap when ISOBOX_CACHE_MAX_SIZE is unset
+const DefaultCacheMaxSize = 2 << 30
+
+// PackageCache is a content-addressed store of downloaded packages shared by
+// every environment of the user. Packages are stored as <checksum>.apk,
+// where checksum is the APKINDEX checksum of the package, and
+// by-name/<arch>/ holds links from repository file names to cached packages. Least
+// recently used packages are evicted once the cache exceeds its size cap.
+type PackageCache struct {
+	dir     string
+	maxSize int64
+}
+
+// OpenPackageCache returns the cache in ~/.cache/isobox/packages
+func OpenPackageCache() (*PackageCache, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(home, ".cache", "isobox", "packages")
+	if err := os.MkdirAll(filepath.Join(dir, "by-name"), 0755); err != nil {
+		return nil, err
+	}
+
+	maxSize := int64(DefaultCacheMaxSize)
+	if value := os.Getenv("ISOBOX_CACHE_MAX_SIZE"); value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ISOBOX_CACHE_MAX_SIZE: %w", err)
+		}
+		maxSize = size
+	}
+
+	return &PackageCache{dir: dir, maxSize: maxSize}, nil
+}
+
+// Dir returns the cache directory
+func (c *PackageCache) Dir() string {
+	return c.dir
+}
+
+func (c *PackageCache) pathFor(checksum string) string {
+	// Checksums are base64, which may contain '/'
+	name := strings.NewReplacer("/", "_", "+", "-").Replace(checksum)
+	return filepath.Join(c.dir, name+".apk")
+}
+
+// Lookup returns the cached package with checksum. The file is checked
+// against its checksum and evicted if it no longer matches.
+func (c *PackageCache) Lookup(checksum string) (string, bool) {
+	if checksum == "" {
+		return "", false
+	}
+
+	path := c.pathFor(checksum)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+
+	if sum, err := packageChecksum(path); err != nil || sum != checksum {
+		fmt.Fprintf(os.Stderr, "  Warning: cached package %s is corrupt, discarding\n", filepath.Base(path))
+		os.Remove(path)
+		return "", false
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return path, true
+}
+
+// LookupName returns the cached package for arch downloaded under a
+// repository file name
+func (c *PackageCache) LookupName(arch, filename string) (string, bool) {
+	target, err := os.Readlink(filepath.Join(c.dir, "by-name", arch, filename))
+	if err != nil {
+		return "", false
+	}
+
+	checksum := strings.TrimSuffix(filepath.Base(target), ".apk")
+	checksum = strings.NewReplacer("_", "/", "-", "+").Replace(checksum)
+	return c.Lookup(checksum)
+}
+
+// Add moves apkFile into the cache under its checksum, links it from
+// filename for arch and returns the cached path. It does not evict; the
+// transaction that fetched the package trims the cache when it ends.
+func (c *PackageCache) Add(apkFile, arch, filename string) (string, error) {
+	checksum, err := packageChecksum(apkFile)
+	if err != nil {
+		return "", err
+	}
+
+	path := c.pathFor(checksum)
+	if err := os.Rename(apkFile, path); err != nil {
+		if err := copyFile(apkFile, path); err != nil {
+			return "", err
+		}
+		os.Remove(apkFile)
+	}
+
+	if filename != "" && arch != "" {
+		link := filepath.Join(c.dir, "by-name", arch, filename)
+		os.MkdirAll(filepath.Dir(link), 0755)
+		os.Remove(link)
+		os.Symlink(filepath.Join("..", "..", filepath.Base(path)), link)
+	}
+
+	return path, nil
+}
+
+// TempFile returns a path in the cache directory for an in-progress
+// download, so that Add can rename it into place
+func (c *PackageCache) TempFile(filename string) string {
+	return filepath.Join(c.dir, fmt.Sprintf(".%s.%d.partial", filename, time.Now().UnixNano()))
+}
+
+// inUseAge is how recently a cached package must have been added or used
+// for eviction to assume another isobox may be about to install it
+const inUseAge = time.Hour
+
+// evict removes the least recently used packages until the cache fits its
+// size cap. The packages in keep and those added or used in the last hour
+// are never evicted, so the cache may stay over its cap for that long.
+func (c *PackageCache) evict(keep []string) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	type cached struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []cached
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".apk") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cached{filepath.Join(c.dir, entry.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	for _, file := range files {
+		if total <= c.maxSize {
+			break
+		}
+		if slices.Contains(keep, file.path) || time.Since(file.modTime) < inUseAge {
+			continue
+		}
+		if os.Remove(file.path) == nil {
+			total -= file.size
+		}
+	}
+
+	c.pruneLinks()
+}
+
+// pruneLinks removes by-name links whose package has been evicted, and
+// links from before they were kept per architecture
+func (c *PackageCache) pruneLinks() {
+	linkDir := filepath.Join(c.dir, "by-name")
+	arches, err := os.ReadDir(linkDir)
+	if err != nil {
+		return
+	}
+
+	for _, arch := range arches {
+		archDir := filepath.Join(linkDir, arch.Name())
+		if !arch.IsDir() {
+			os.Remove(archDir)
+			continue
+		}
+		entries, err := os.ReadDir(archDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			link := filepath.Join(archDir, entry.Name())
+			if _, err := os.Stat(link); os.IsNotExist(err) {
+				os.Remove(link)
+			}
+		}
+	}
+}
+
+// partialAge is how long a download has to sit untouched before Clean
+// takes it for a leftover of an interrupted one
+const partialAge = time.Hour
+
+// Clean removes every cached package and returns how many files and bytes
+// were freed. Downloads written to in the last hour are left alone, since
+// another isobox may still be fetching them.
+func (c *PackageCache) Clean() (int, int64, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count := 0
+	var freed int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), ".partial") && time.Since(info.ModTime()) < partialAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, entry.Name())); err != nil {
+			return count, freed, err
+		}
+		count++
+		freed += info.Size()
+	}
+
+	if err := os.RemoveAll(filepath.Join(c.dir, "by-name")); err != nil {
+		return count, freed, err
+	}
+	return count, freed, os.MkdirAll(filepath.Join(c.dir, "by-name"), 0755)
+}
+
+// packageChecksum computes the identity checksum of a package file: the
+// "Q1" SHA-1 of the control stream used by APKINDEX for APKv2 packages, or
+// a "Q2" SHA-256 of the metadata block for APKv3 packages
+func packageChecksum(apkFile string) (string, error) {
+	if isADB(apkFile) {
+		pkg, err := readPackageADB(apkFile)
+		if err != nil {
+			return "", err
+		}
+		return pkg.checksum("Q2"), nil
+	}
+
+	data, err := os.ReadFile(apkFile)
+	if err != nil {
+		return "", err
+	}
+
+	streams, err := splitGzipStreams(data)
+	if err != nil {
+		return "", err
+	}
+
+	control := controlStream(streams)
+	if control == nil {
+		return "", fmt.Errorf("missing control stream")
+	}
+
+	return controlChecksum(control), nil
+}
+
+// parseSize parses sizes like "500M", "2G" or a plain byte count
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
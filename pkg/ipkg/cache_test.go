@@ -0,0 +1,47 @@
+package ipkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	cache := &PackageCache{dir: dir, maxSize: 250}
+
+	old := time.Now().Add(-2 * inUseAge)
+	files := []struct {
+		name    string
+		modTime time.Time
+		evicted bool
+	}{
+		{"oldest.apk", old.Add(-time.Minute), true},
+		{"kept.apk", old.Add(-2 * time.Minute), false},
+		{"old.apk", old, true},
+		{"recent.apk", time.Now().Add(-time.Minute), false},
+		{"new.apk", time.Now(), false},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, file.modTime, file.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 500 bytes against a cap of 250: the old files go, except kept.apk,
+	// which belongs to the running plan, and the cache stays over its cap
+	// while the recent ones may still be in use
+	cache.evict([]string{filepath.Join(dir, "kept.apk")})
+
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(dir, file.name))
+		if evicted := os.IsNotExist(err); evicted != file.evicted {
+			t.Errorf("%s evicted = %v, want %v", file.name, evicted, file.evicted)
+		}
+	}
+}
@@ -1,68 +1,148 @@
 package ipkg
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"slices"
+	"sort"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
+// DependenciesConfig is a dependencies.toml file: named groups of packages,
+// each installed when enabled
+//
+//	[groups.database]
+//	description = "Database clients"
+//	enabled = true
+//	packages = ["postgresql-client", "redis"]
+//
+// The older format, with the lists under [packages] and install_<name>
+// switches under [options], is still read and turned into groups.
 type DependenciesConfig struct {
-	Packages PackageGroups `toml:"packages"`
-	Options  InstallOptions `toml:"options"`
-}
+	Groups map[string]*PackageGroup `toml:"groups"`
+
+	// Packages and Options hold the older format while loading
+	Packages map[string][]string `toml:"packages,omitempty"`
+	Options  map[string]bool     `toml:"options,omitempty"`
 
-type PackageGroups struct {
-	Dev     []string `toml:"dev"`
-	Shells  []string `toml:"shells"`
-	Network []string `toml:"network"`
-	Utils   []string `toml:"utils"`
-	Custom  []string `toml:"custom"`
+	// order lists the group names as they appear in the file
+	order []string
 }
 
-type InstallOptions struct {
-	InstallDev     bool `toml:"install_dev"`
-	InstallShells  bool `toml:"install_shells"`
-	InstallNetwork bool `toml:"install_network"`
-	InstallUtils   bool `toml:"install_utils"`
-	InstallCustom  bool `toml:"install_custom"`
+// PackageGroup is a named set of packages that is installed together
+type PackageGroup struct {
+	Description string   `toml:"description,omitempty"`
+	Enabled     bool     `toml:"enabled"`
+	Packages    []string `toml:"packages"`
 }
 
+// LoadDependencies reads a dependencies file. Keys it does not know, such
+// as a misspelled group setting or an install_<name> option without a
+// [packages] list, are reported as warnings.
 func LoadDependencies(path string) (*DependenciesConfig, error) {
 	var config DependenciesConfig
 
-	if _, err := toml.DecodeFile(path, &config); err != nil {
+	md, err := toml.DecodeFile(path, &config)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse dependencies file: %w", err)
 	}
 
-	return &config, nil
-}
-
-func (pm *PackageManager) InstallFromConfig(configPath string) error {
-	config, err := LoadDependencies(configPath)
-	if err != nil {
-		return err
+	// Report an unknown table once, not each key in it
+	var unknown []string
+	for _, key := range md.Undecoded() {
+		name := key.String()
+		if len(unknown) > 0 && strings.HasPrefix(name, unknown[len(unknown)-1]+".") {
+			continue
+		}
+		unknown = append(unknown, name)
+		fmt.Fprintf(os.Stderr, "  Warning: %s: unknown key %s\n", path, name)
 	}
 
-	var packagesToInstall []string
+	if config.Groups == nil {
+		config.Groups = make(map[string]*PackageGroup)
+	}
+	for _, key := range md.Keys() {
+		if len(key) != 2 || (key[0] != "groups" && key[0] != "packages") {
+			continue
+		}
+		name := key[1]
+		if key[0] == "packages" {
+			if _, ok := config.Groups[name]; ok {
+				return nil, fmt.Errorf("group %s is defined both under [packages] and as [groups.%s]", name, name)
+			}
+			config.Groups[name] = &PackageGroup{
+				Enabled:  config.Options["install_"+name],
+				Packages: config.Packages[name],
+			}
+		}
+		config.order = append(config.order, name)
+	}
 
-	// Collect packages based on options
-	if config.Options.InstallDev {
-		packagesToInstall = append(packagesToInstall, config.Packages.Dev...)
+	options := make([]string, 0, len(config.Options))
+	for option := range config.Options {
+		options = append(options, option)
 	}
-	if config.Options.InstallShells {
-		packagesToInstall = append(packagesToInstall, config.Packages.Shells...)
+	sort.Strings(options)
+	for _, option := range options {
+		name, ok := strings.CutPrefix(option, "install_")
+		if _, known := config.Packages[name]; !ok || !known {
+			fmt.Fprintf(os.Stderr, "  Warning: %s: unknown key options.%s\n", path, option)
+		}
 	}
-	if config.Options.InstallNetwork {
-		packagesToInstall = append(packagesToInstall, config.Packages.Network...)
+	config.Packages = nil
+	config.Options = nil
+
+	return &config, nil
+}
+
+// EnabledPackages returns the packages of the enabled groups, in the order
+// the groups appear in the file, without duplicates
+func (config *DependenciesConfig) EnabledPackages() []string {
+	var packages []string
+	seen := make(map[string]bool)
+	for _, name := range config.GroupNames() {
+		group := config.Groups[name]
+		if !group.Enabled {
+			continue
+		}
+		for _, pkg := range group.Packages {
+			if pkg != "" && !seen[pkg] {
+				seen[pkg] = true
+				packages = append(packages, pkg)
+			}
+		}
 	}
-	if config.Options.InstallUtils {
-		packagesToInstall = append(packagesToInstall, config.Packages.Utils...)
+	return packages
+}
+
+// GroupNames returns the names of the groups in file order, followed by
+// groups added since the file was loaded, sorted
+func (config *DependenciesConfig) GroupNames() []string {
+	names := append([]string(nil), config.order...)
+	var added []string
+	for name := range config.Groups {
+		if !slices.Contains(names, name) {
+			added = append(added, name)
+		}
 	}
-	if config.Options.InstallCustom {
-		packagesToInstall = append(packagesToInstall, config.Packages.Custom...)
+	sort.Strings(added)
+	return append(names, added...)
+}
+
+// InstallFromConfig installs the packages of the enabled groups of the
+// dependencies file at configPath, then records them and everything they
+// depend on in its lock file for InstallLocked
+func (pm *PackageManager) InstallFromConfig(ctx context.Context, configPath string) error {
+	config, err := LoadDependencies(configPath)
+	if err != nil {
+		return err
 	}
 
+	packagesToInstall := config.EnabledPackages()
+
 	if len(packagesToInstall) == 0 {
 		fmt.Println("No packages selected for installation")
 		return nil
@@ -77,8 +157,12 @@ func (pm *PackageManager) InstallFromConfig(configPath string) error {
 			continue
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		fmt.Printf("\n==> Installing %s\n", pkg)
-		if err := pm.Install(pkg); err != nil {
+		if err := pm.Install(ctx, pkg); err != nil {
 			fmt.Printf("Failed to install %s: %v\n", pkg, err)
 			failed = append(failed, pkg)
 		}
@@ -93,7 +177,7 @@ func (pm *PackageManager) InstallFromConfig(configPath string) error {
 	}
 
 	fmt.Printf("\nSuccessfully installed all %d packages!\n", len(packagesToInstall))
-	return nil
+	return pm.writeLock(configPath, packagesToInstall)
 }
 
 func (config *DependenciesConfig) Save(path string) error {
@@ -0,0 +1,168 @@
+package ipkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestLoadDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		groups  map[string]*PackageGroup
+		order   []string
+		enabled []string
+	}{
+		{
+			name: "groups",
+			file: `
+[groups.core]
+description = "Core tools"
+enabled = true
+packages = ["git", "vim"]
+
+[groups.database]
+enabled = false
+packages = ["postgresql-client"]
+
+[groups.build]
+enabled = true
+packages = ["gcc", "git", "make"]
+`,
+			groups: map[string]*PackageGroup{
+				"core":     {Description: "Core tools", Enabled: true, Packages: []string{"git", "vim"}},
+				"database": {Packages: []string{"postgresql-client"}},
+				"build":    {Enabled: true, Packages: []string{"gcc", "git", "make"}},
+			},
+			order:   []string{"core", "database", "build"},
+			enabled: []string{"git", "vim", "gcc", "make"},
+		},
+		{
+			name: "packages and options",
+			file: `
+[packages]
+core = ["git", "vim"]
+database = ["postgresql-client"]
+python = ["python3", "py3-pip"]
+
+[options]
+install_core = true
+install_python = true
+`,
+			groups: map[string]*PackageGroup{
+				"core":     {Enabled: true, Packages: []string{"git", "vim"}},
+				"database": {Packages: []string{"postgresql-client"}},
+				"python":   {Enabled: true, Packages: []string{"python3", "py3-pip"}},
+			},
+			order:   []string{"core", "database", "python"},
+			enabled: []string{"git", "vim", "python3", "py3-pip"},
+		},
+		{
+			name: "both formats",
+			file: `
+[packages]
+core = ["git"]
+
+[options]
+install_core = true
+
+[groups.extra]
+enabled = true
+packages = ["curl"]
+`,
+			groups: map[string]*PackageGroup{
+				"core":  {Enabled: true, Packages: []string{"git"}},
+				"extra": {Enabled: true, Packages: []string{"curl"}},
+			},
+			order:   []string{"core", "extra"},
+			enabled: []string{"git", "curl"},
+		},
+		{
+			name:    "empty",
+			file:    "",
+			groups:  map[string]*PackageGroup{},
+			enabled: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadDependencies(writeDependencies(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.Groups, tt.groups) {
+				t.Errorf("groups = %+v, want %+v", config.Groups, tt.groups)
+			}
+			if !reflect.DeepEqual(config.order, tt.order) {
+				t.Errorf("order = %v, want %v", config.order, tt.order)
+			}
+			if got := config.EnabledPackages(); !reflect.DeepEqual(got, tt.enabled) {
+				t.Errorf("EnabledPackages() = %v, want %v", got, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestLoadDependenciesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"group in both formats", "[packages]\ncore = [\"git\"]\n\n[groups.core]\nenabled = true\npackages = [\"vim\"]\n"},
+		{"invalid TOML", "[groups.core\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadDependencies(writeDependencies(t, tt.file)); err == nil {
+				t.Error("LoadDependencies() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestDependenciesSaveUsesGroups(t *testing.T) {
+	config, err := LoadDependencies(writeDependencies(t, "[packages]\ncore = [\"git\"]\n\n[options]\ninstall_core = true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "saved.toml")
+	if err := config.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := LoadDependencies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Groups, config.Groups) {
+		t.Errorf("saved groups = %+v, want %+v", saved.Groups, config.Groups)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]any
+	if _, err := toml.Decode(string(data), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw["packages"]; ok {
+		t.Errorf("saved file still has a [packages] table:\n%s", data)
+	}
+}
+
+// writeDependencies writes a dependencies file into a temporary directory
+func writeDependencies(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dependencies.toml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
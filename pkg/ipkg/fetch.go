@@ -0,0 +1,282 @@
+package ipkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Network limits shared by every download
+const (
+	// connectTimeout bounds connecting, the TLS handshake and waiting for
+	// response headers
+	connectTimeout = 15 * time.Second
+
+	// readTimeout aborts a transfer that receives no data for this long
+	readTimeout = 30 * time.Second
+
+	// fetchAttempts is how often a transient failure is tried in total
+	fetchAttempts = 4
+
+	// retryBackoff is the wait before the first retry; it doubles each time
+	retryBackoff = time.Second
+)
+
+// httpClient honours HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: connectTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   maxDownloadWorkers,
+		ForceAttemptHTTP2:     true,
+	},
+}
+
+// statusError is an unsuccessful HTTP response
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("fetch failed: %s", e.status)
+}
+
+// errNotModified is returned by fetchIfChanged when the resource still has
+// the ETag it was given
+var errNotModified = errors.New("not modified")
+
+// retryable reports whether a failed attempt may succeed when repeated.
+// Server errors and network errors are; other HTTP errors such as 404 are not.
+func retryable(err error) bool {
+	if errors.Is(err, errNotModified) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// retry runs attempt until it succeeds, fails permanently, runs out of
+// attempts or ctx is cancelled, backing off between attempts
+func retry(ctx context.Context, url string, attempt func() error) error {
+	backoff := retryBackoff
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if i == fetchAttempts || !retryable(err) {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "  Warning: %s: %v, retrying in %s\n", url, err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// idleReader fails a response body that receives no data for readTimeout
+type idleReader struct {
+	body     io.ReadCloser
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	timedOut atomic.Bool
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if r.timedOut.Load() {
+		return n, fmt.Errorf("no data received for %s", readTimeout)
+	}
+	r.timer.Reset(readTimeout)
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.body.Close()
+}
+
+// get requests url with the extra request headers in header, which may be
+// nil. A 304 response is errNotModified. The response body must be closed.
+func get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		cancel()
+		return nil, errNotModified
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		cancel()
+		return nil, &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	reader := &idleReader{body: resp.Body, cancel: cancel}
+	reader.timer = time.AfterFunc(readTimeout, func() {
+		reader.timedOut.Store(true)
+		cancel()
+	})
+	resp.Body = reader
+	return resp, nil
+}
+
+// FetchURL returns the contents of an http(s) URL, a file:// URL or a
+// plain local path, so repositories can live on a mirror or in a directory
+// on disk. Transient network failures are retried.
+func FetchURL(ctx context.Context, url string) ([]byte, error) {
+	if path, ok := localPath(url); ok {
+		return os.ReadFile(path)
+	}
+
+	var data []byte
+	err := retry(ctx, url, func() error {
+		resp, err := get(ctx, url, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		data, err = io.ReadAll(resp.Body)
+		return err
+	})
+	return data, err
+}
+
+// fetchIfChanged is FetchURL with a conditional request: if etag is set and
+// url still has that ETag, it returns errNotModified instead of the
+// contents. It also returns the current ETag, which for local files is
+// made up from their size and modification time.
+func fetchIfChanged(ctx context.Context, url, etag string) ([]byte, string, error) {
+	if path, ok := localPath(url); ok {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, "", err
+		}
+		current := fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+		if current == etag {
+			return nil, etag, errNotModified
+		}
+		data, err := os.ReadFile(path)
+		return data, current, err
+	}
+
+	var header http.Header
+	if etag != "" {
+		header = http.Header{"If-None-Match": {etag}}
+	}
+
+	var data []byte
+	var current string
+	err := retry(ctx, url, func() error {
+		resp, err := get(ctx, url, header)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		current = resp.Header.Get("ETag")
+		data, err = io.ReadAll(resp.Body)
+		return err
+	})
+	if errors.Is(err, errNotModified) {
+		current = etag
+	}
+	return data, current, err
+}
+
+// DownloadURL saves url to dest. Transient failures are retried, and a
+// retry resumes where the previous attempt stopped when the server supports
+// range requests. dest is left behind on failure for the caller to remove.
+func DownloadURL(ctx context.Context, url, dest string) error {
+	if path, ok := localPath(url); ok {
+		return copyFile(path, dest)
+	}
+
+	os.Remove(dest)
+	return retry(ctx, url, func() error {
+		var header http.Header
+		if info, err := os.Stat(dest); err == nil && info.Size() > 0 {
+			header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", info.Size())}}
+		}
+
+		resp, err := get(ctx, url, header)
+		if err != nil {
+			var se *statusError
+			if errors.As(err, &se) && se.code == http.StatusRequestedRangeNotSatisfiable {
+				// The partial file is unusable; start over on the next attempt
+				os.Remove(dest)
+				return fmt.Errorf("cannot resume download: %v", err)
+			}
+			return err
+		}
+		defer resp.Body.Close()
+
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if resp.StatusCode == http.StatusPartialContent {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		out, err := os.OpenFile(dest, flags, 0644)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(out, resp.Body); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// localPath returns the filesystem path of a file:// URL or absolute path
+func localPath(url string) (string, bool) {
+	if strings.HasPrefix(url, "file://") {
+		return strings.TrimPrefix(url, "file://"), true
+	}
+	if strings.HasPrefix(url, "/") {
+		return url, true
+	}
+	return "", false
+}
@@ -0,0 +1,351 @@
+package ipkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HistoryEntry records one committed transaction that changed the set of
+// installed packages
+type HistoryEntry struct {
+	ID      int             `json:"id"`
+	Time    time.Time       `json:"time"`
+	Command string          `json:"command"`
+	User    string          `json:"user"`
+	Changes []HistoryChange `json:"changes"`
+}
+
+// HistoryChange is the version of one package before and after a
+// transaction. An empty version means the package was not installed.
+type HistoryChange struct {
+	Name   string `json:"name"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+
+	// Checksums of the package files, for finding them in the package
+	// cache on rollback
+	BeforeChecksum string `json:"before_checksum,omitempty"`
+	AfterChecksum  string `json:"after_checksum,omitempty"`
+
+	// Whether the package was asked for by name, for restoring it on
+	// rollback. History written before this was recorded has neither.
+	BeforeExplicit *bool `json:"before_explicit,omitempty"`
+	AfterExplicit  *bool `json:"after_explicit,omitempty"`
+}
+
+func (c HistoryChange) String() string {
+	switch {
+	case c.Before == "":
+		return fmt.Sprintf("+ %s %s", c.Name, c.After)
+	case c.After == "":
+		return fmt.Sprintf("- %s %s", c.Name, c.Before)
+	default:
+		return fmt.Sprintf("~ %s %s -> %s", c.Name, c.Before, c.After)
+	}
+}
+
+// historyPath is the transaction log next to the package database, one
+// JSON entry per line
+func (pm *PackageManager) historyPath() string {
+	return filepath.Join(filepath.Dir(pm.db), "history")
+}
+
+// readHistory returns the recorded transactions, oldest first
+func (pm *PackageManager) readHistory() ([]HistoryEntry, error) {
+	file, err := os.Open(pm.historyPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open history: %w", err)
+	}
+	defer file.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("parse history: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+
+	return entries, nil
+}
+
+// historyChanges compares the package versions before a transaction with
+// the packages it leaves behind
+func historyChanges(before []Package, after []Package) []HistoryChange {
+	versions := make(map[string]string)
+	for _, pkg := range after {
+		versions[pkg.Name] = pkg.Version
+	}
+
+	var changes []HistoryChange
+	previous := make(map[string]Package)
+	for _, pkg := range before {
+		previous[pkg.Name] = pkg
+		if _, ok := versions[pkg.Name]; !ok {
+			changes = append(changes, HistoryChange{Name: pkg.Name, Before: pkg.Version, BeforeChecksum: pkg.Checksum, BeforeExplicit: &pkg.Explicit})
+		}
+	}
+	for _, pkg := range after {
+		if old, ok := previous[pkg.Name]; !ok || old.Version != pkg.Version {
+			change := HistoryChange{
+				Name:           pkg.Name,
+				Before:         old.Version,
+				After:          pkg.Version,
+				BeforeChecksum: old.Checksum,
+				AfterChecksum:  pkg.Checksum,
+				AfterExplicit:  &pkg.Explicit,
+			}
+			if ok {
+				change.BeforeExplicit = &old.Explicit
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// recordHistory appends the changes of a committed transaction to the
+// history. Transactions that changed no package versions are not recorded.
+func (pm *PackageManager) recordHistory(changes []HistoryChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	entries, err := pm.readHistory()
+	if err != nil {
+		return err
+	}
+
+	entry := HistoryEntry{
+		ID:      1,
+		Time:    time.Now(),
+		Command: commandLine(),
+		User:    "host",
+		Changes: changes,
+	}
+	if len(entries) > 0 {
+		entry.ID = entries[len(entries)-1].ID + 1
+	}
+	if pm.rootfs == "/" {
+		entry.User = "internal"
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshal history: %w", err)
+	}
+
+	file, err := os.OpenFile(pm.historyPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open history: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write history: %w", err)
+	}
+	return nil
+}
+
+// commandLine returns the isobox command being run, as typed
+func commandLine() string {
+	if len(os.Args) == 0 {
+		return ""
+	}
+	return strings.Join(append([]string{filepath.Base(os.Args[0])}, os.Args[1:]...), " ")
+}
+
+// History lists the recorded transactions, oldest first
+func (pm *PackageManager) History(asJSON bool) error {
+	entries, err := pm.readHistory()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		if entries == nil {
+			entries = []HistoryEntry{}
+		}
+		return printJSON(entries)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No package transactions recorded")
+		return nil
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%d  %s  %s  %s\n", entry.ID, entry.Time.Format(time.RFC3339), entry.User, entry.Command)
+		for _, change := range entry.Changes {
+			fmt.Printf("    %s\n", change)
+		}
+	}
+	return nil
+}
+
+// Rollback restores the installed packages to the versions they had before
+// transaction id, undoing it and every later transaction as one new
+// transaction. Packages to reinstall are taken from the shared package
+// cache; held packages are never changed.
+func (pm *PackageManager) Rollback(ctx context.Context, id int) error {
+	pm.ctx = ctx
+	entries, err := pm.readHistory()
+	if err != nil {
+		return err
+	}
+
+	start := -1
+	for i, entry := range entries {
+		if entry.ID == id {
+			start = i
+		}
+	}
+	if start < 0 {
+		return fmt.Errorf("no transaction %d in history", id)
+	}
+
+	tx, err := pm.begin()
+	if err != nil {
+		return err
+	}
+
+	// Walk the history back to the state before the transaction
+	target := make(map[string]string)
+	checksums := make(map[string]string)
+	explicit := make(map[string]bool)
+	for _, pkg := range tx.packages {
+		target[pkg.Name] = pkg.Version
+		checksums[pkg.Name] = pkg.Checksum
+		explicit[pkg.Name] = pkg.Explicit
+	}
+	var order []string
+	for i := len(entries) - 1; i >= start; i-- {
+		for _, change := range entries[i].Changes {
+			if change.Before == "" {
+				delete(target, change.Name)
+				delete(checksums, change.Name)
+				delete(explicit, change.Name)
+			} else {
+				target[change.Name] = change.Before
+				checksums[change.Name] = change.BeforeChecksum
+				// Without a recorded flag, keep the package from being
+				// taken for an unneeded dependency
+				explicit[change.Name] = change.BeforeExplicit == nil || *change.BeforeExplicit
+			}
+		}
+	}
+	for i := start; i < len(entries); i++ {
+		for _, change := range entries[i].Changes {
+			order = append(order, change.Name)
+		}
+	}
+
+	fmt.Printf("Rolling back to before transaction %d...\n", id)
+	return tx.finish(pm.restore(target, checksums, explicit, order))
+}
+
+// restore removes and reinstalls packages until the installed versions
+// match target. order lists package names in the order they were changed,
+// so that reinstalled dependencies come before the packages needing them.
+// Packages are found in the cache by their checksum in checksums, or for
+// history written without checksums, by file name and architecture.
+// Reinstalled packages get back the explicit flag they had in explicit.
+func (pm *PackageManager) restore(target, checksums map[string]string, explicit map[string]bool, order []string) error {
+	var remove []Package
+	installed := make(map[string]string)
+	for _, pkg := range pm.tx.packages {
+		installed[pkg.Name] = pkg.Version
+		if version, ok := target[pkg.Name]; ok && version == pkg.Version {
+			continue
+		}
+		if pkg.Held {
+			return errHeld(pkg.Name)
+		}
+		remove = append(remove, pkg)
+	}
+
+	type restoreFile struct {
+		name     string
+		apkFile  string
+		checksum string
+	}
+	var install []restoreFile
+	seen := make(map[string]bool)
+	for _, name := range order {
+		version, ok := target[name]
+		if !ok || seen[name] || installed[name] == version {
+			continue
+		}
+		seen[name] = true
+		install = append(install, restoreFile{name: name, apkFile: fmt.Sprintf("%s-%s.apk", name, version), checksum: checksums[name]})
+	}
+
+	if len(remove) == 0 && len(install) == 0 {
+		fmt.Println("Nothing to roll back")
+		return nil
+	}
+
+	// Find every package before changing anything
+	cache, err := OpenPackageCache()
+	if err != nil && len(install) > 0 {
+		return fmt.Errorf("package cache unavailable: %w", err)
+	}
+	pm.loadKeys()
+	for i := range install {
+		var path string
+		var ok bool
+		if install[i].checksum != "" {
+			path, ok = cache.Lookup(install[i].checksum)
+		} else {
+			path, ok = cache.LookupName(pm.architecture(), install[i].apkFile)
+		}
+		if !ok {
+			return fmt.Errorf("%s is not in the package cache, cannot roll back", install[i].apkFile)
+		}
+		if err := pm.checkTrust(install[i].name, pm.verifyPackage(path, nil)); err != nil {
+			return err
+		}
+		install[i].apkFile = path
+	}
+
+	// Remove dependents before the packages they need
+	for i := len(remove) - 1; i >= 0; i-- {
+		fmt.Printf("  Removing %s %s...\n", remove[i].Name, remove[i].Version)
+		if err := pm.removePackage(&remove[i]); err != nil {
+			return err
+		}
+	}
+
+	for _, pkg := range install {
+		if err := pm.context().Err(); err != nil {
+			return err
+		}
+		if err := pm.installFromFile(pkg.name, pkg.apkFile); err != nil {
+			return err
+		}
+		if explicit[pkg.name] {
+			pm.tx.setExplicit(pkg.name)
+		}
+	}
+
+	return nil
+}
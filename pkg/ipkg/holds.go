@@ -0,0 +1,50 @@
+package ipkg
+
+import "fmt"
+
+// errHeld explains that a change was blocked by a hold on pkgName
+func errHeld(pkgName string) error {
+	return fmt.Errorf("package %s is held; run 'isobox pkg unhold %s' to allow changes", pkgName, pkgName)
+}
+
+// Hold marks an installed package as held, so that it is kept at its
+// current version: it cannot be removed and its files cannot be taken over
+// by other packages until it is unheld
+func (pm *PackageManager) Hold(pkgName string) error {
+	return pm.setHeld(pkgName, true)
+}
+
+// Unhold releases a hold placed with Hold
+func (pm *PackageManager) Unhold(pkgName string) error {
+	return pm.setHeld(pkgName, false)
+}
+
+func (pm *PackageManager) setHeld(pkgName string, held bool) error {
+	tx, err := pm.begin()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range tx.packages {
+		if tx.packages[i].Name != pkgName {
+			continue
+		}
+		found = true
+		tx.packages[i].Held = held
+	}
+	if !found {
+		return tx.finish(fmt.Errorf("package %s is not installed", pkgName))
+	}
+
+	if err := tx.finish(nil); err != nil {
+		return err
+	}
+
+	if held {
+		fmt.Printf("Package %s is now held\n", pkgName)
+	} else {
+		fmt.Printf("Package %s is no longer held\n", pkgName)
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package ipkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IndexEntry is a single package record from a repository APKINDEX
+type IndexEntry struct {
+	Name          string   `json:"name"`
+	Version       string   `json:"version"`
+	Arch          string   `json:"arch,omitempty"`
+	Description   string   `json:"description,omitempty"`
+	URL           string   `json:"url,omitempty"`
+	License       string   `json:"license,omitempty"`
+	Origin        string   `json:"origin,omitempty"`
+	Size          int64    `json:"size"`
+	InstalledSize int64    `json:"installed_size"`
+	Checksum      string   `json:"checksum,omitempty"`
+	Depends       []string `json:"depends,omitempty"`
+	Provides      []string `json:"provides,omitempty"`
+	Repository    string   `json:"repository"`
+	Tag           string   `json:"tag,omitempty"`
+
+	// trusted is set when the index the entry came from had a valid signature
+	trusted bool
+	repo    *Repository
+}
+
+// Filename returns the name of the .apk file in the repository
+func (e *IndexEntry) Filename() string {
+	return fmt.Sprintf("%s-%s.apk", e.Name, e.Version)
+}
+
+// downloadURLs returns the URL of the .apk file in the arch directory of
+// every mirror of its repository, or none for an entry without one
+func (e *IndexEntry) downloadURLs(arch string) []string {
+	if e.repo == nil {
+		return nil
+	}
+	var urls []string
+	for _, base := range e.repo.ArchURLs(arch) {
+		urls = append(urls, base+e.Filename())
+	}
+	return urls
+}
+
+// loadIndex returns the index of every repository from the environment's
+// index cache, fetching the indexes that were never fetched. Indexes older
+// than the TTL are used with a warning; Update refreshes them. While
+// planning, indexes that were never fetched are left out instead. The
+// result is kept for the lifetime of the package manager.
+func (pm *PackageManager) loadIndex() ([]IndexEntry, error) {
+	if pm.index != nil {
+		return pm.index, nil
+	}
+
+	repos, err := pm.repositories()
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := indexTTL()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []IndexEntry
+	var lastErr error
+	var oldest time.Time
+	for i := range repos {
+		cached := pm.readCachedIndex(&repos[i])
+		if cached == nil && pm.readOnly {
+			lastErr = fmt.Errorf("run '%s' first", pm.updateCommand())
+			fmt.Fprintf(os.Stderr, "  Warning: no cached index for %s, leaving it out\n", repos[i].String())
+			continue
+		}
+		if cached == nil {
+			if cached, _, err = pm.refreshIndex(&repos[i], nil); err != nil {
+				lastErr = err
+				fmt.Fprintf(os.Stderr, "  Warning: failed to fetch index for %s: %v\n", repos[i].String(), err)
+				continue
+			}
+		} else if oldest.IsZero() || cached.Fetched.Before(oldest) {
+			oldest = cached.Fetched
+		}
+
+		repoEntries, err := pm.cachedEntries(&repos[i], cached)
+		if err != nil {
+			lastErr = err
+			fmt.Fprintf(os.Stderr, "  Warning: %v\n", err)
+			continue
+		}
+		entries = append(entries, repoEntries...)
+	}
+
+	if len(entries) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("no package index available: %w", lastErr)
+	}
+
+	if age := time.Since(oldest); !oldest.IsZero() && ttl > 0 && age > ttl {
+		fmt.Fprintf(os.Stderr, "  Warning: the package index is %s old, run '%s' to refresh it\n", formatAge(age), pm.updateCommand())
+	}
+
+	if !pm.readOnly {
+		pm.index = entries
+	}
+	return entries, nil
+}
+
+// lookupIndex returns the first index entry named pkgName, in repository order
+func (pm *PackageManager) lookupIndex(pkgName string) (*IndexEntry, error) {
+	entries, err := pm.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		if entries[i].Name == pkgName {
+			return &entries[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("package %s not found in repositories", pkgName)
+}
+
+// repositories returns the configured repositories, highest priority first
+func (pm *PackageManager) repositories() ([]Repository, error) {
+	if pm.repos == nil {
+		branch := pm.branch
+		if branch == "" {
+			branch = environmentBranch(pm.rootfs)
+		}
+		repos, err := LoadRepositories(pm.rootfs, branch)
+		if err != nil {
+			return nil, err
+		}
+		pm.repos = repos
+	}
+	return pm.repos, nil
+}
+
+// refreshIndex downloads the APKINDEX of repo, failing over between its
+// mirrors, and stores it in the index cache. With a cached copy the request
+// is conditional, and an unchanged index is not downloaded again; changed
+// reports whether it was. An index that fails verification is not stored
+// unless untrusted packages are allowed.
+func (pm *PackageManager) refreshIndex(repo *Repository, cached *cachedIndex) (*cachedIndex, bool, error) {
+	etag := ""
+	if cached != nil {
+		etag = cached.ETag
+	}
+
+	var data []byte
+	var err error
+	for _, base := range repo.ArchURLs(pm.architecture()) {
+		data, etag, err = fetchIfChanged(pm.context(), base+"APKINDEX.tar.gz", etag)
+		if err == nil || errors.Is(err, errNotModified) {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "  Warning: mirror %s failed: %v\n", base, err)
+	}
+
+	if errors.Is(err, errNotModified) {
+		cached.Fetched = time.Now()
+		if err := pm.writeCachedIndex(repo, cached); err != nil {
+			fmt.Fprintf(os.Stderr, "  Warning: failed to cache index for %s: %v\n", repo.String(), err)
+		}
+		return cached, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	streams, err := splitGzipStreams(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("corrupt index: %w", err)
+	}
+	verifyErr := pm.verifySignature(streams)
+	if verifyErr != nil && !pm.AllowUntrusted {
+		return nil, false, pm.checkTrust("index "+repo.String(), verifyErr)
+	}
+
+	entries, err := pm.readIndexArchive(data, repo.String())
+	if err != nil {
+		return nil, false, err
+	}
+
+	cached = &cachedIndex{
+		Repository: repo.String(),
+		Arch:       pm.architecture(),
+		Fetched:    time.Now(),
+		ETag:       etag,
+		Entries:    entries,
+	}
+	if verifyErr != nil {
+		cached.Untrusted = strings.TrimPrefix(verifyErr.Error(), ErrUntrusted.Error()+": ")
+	}
+	if err := pm.writeCachedIndex(repo, cached); err != nil {
+		fmt.Fprintf(os.Stderr, "  Warning: failed to cache index for %s: %v\n", repo.String(), err)
+	}
+	return cached, true, nil
+}
+
+// readIndexArchive parses an APKINDEX.tar.gz, keeping the entries for the
+// environment's architecture
+func (pm *PackageManager) readIndexArchive(data []byte, repoURL string) ([]IndexEntry, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Name == "APKINDEX" {
+			parsed, err := parseIndex(tr, repoURL)
+			if err != nil {
+				return nil, err
+			}
+
+			// Repositories built by hand may mix architectures
+			var entries []IndexEntry
+			for _, entry := range parsed {
+				if archMatches(entry.Arch, pm.architecture()) {
+					entries = append(entries, entry)
+				}
+			}
+			return entries, nil
+		}
+	}
+
+	return nil, fmt.Errorf("APKINDEX not found in archive")
+}
+
+// parseIndex reads the APKINDEX text format: one "K:value" line per field,
+// with records separated by blank lines
+func parseIndex(r io.Reader, repoURL string) ([]IndexEntry, error) {
+	var entries []IndexEntry
+	entry := IndexEntry{Repository: repoURL}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if entry.Name != "" {
+				entries = append(entries, entry)
+			}
+			entry = IndexEntry{Repository: repoURL}
+			continue
+		}
+
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+
+		value := line[2:]
+		switch line[0] {
+		case 'C':
+			entry.Checksum = value
+		case 'P':
+			entry.Name = value
+		case 'V':
+			entry.Version = value
+		case 'A':
+			entry.Arch = value
+		case 'T':
+			entry.Description = value
+		case 'U':
+			entry.URL = value
+		case 'L':
+			entry.License = value
+		case 'o':
+			entry.Origin = value
+		case 'S':
+			entry.Size, _ = strconv.ParseInt(value, 10, 64)
+		case 'I':
+			entry.InstalledSize, _ = strconv.ParseInt(value, 10, 64)
+		case 'D':
+			entry.Depends = strings.Fields(value)
+		case 'p':
+			entry.Provides = strings.Fields(value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if entry.Name != "" {
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
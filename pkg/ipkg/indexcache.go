@@ -0,0 +1,178 @@
+package ipkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultIndexTTL is how old a cached repository index gets before installs
+// and searches warn that it is stale, when ISOBOX_INDEX_TTL is unset
+const DefaultIndexTTL = 24 * time.Hour
+
+// cachedIndex is the parsed index of one repository for one architecture,
+// as stored in the environment
+type cachedIndex struct {
+	Repository string    `json:"repository"`
+	Arch       string    `json:"arch"`
+	Fetched    time.Time `json:"fetched"`
+	ETag       string    `json:"etag,omitempty"`
+
+	// Untrusted is why the index failed signature verification, for an
+	// index fetched with --allow-untrusted
+	Untrusted string `json:"untrusted,omitempty"`
+
+	Entries []IndexEntry `json:"entries"`
+}
+
+// IndexCacheDir returns the directory of cached repository indexes of the
+// environment at rootfs
+func IndexCacheDir(rootfs string) string {
+	return filepath.Join(rootfs, "var/lib/ipkg/indexes")
+}
+
+// indexTTL returns the staleness threshold from ISOBOX_INDEX_TTL, such as
+// "12h"; 0 turns the warning off
+func indexTTL() (time.Duration, error) {
+	value := os.Getenv("ISOBOX_INDEX_TTL")
+	if value == "" {
+		return DefaultIndexTTL, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ISOBOX_INDEX_TTL: %w", err)
+	}
+	return ttl, nil
+}
+
+// indexCachePath returns the cache file of repo for the environment's
+// architecture, named after its primary URL
+func (pm *PackageManager) indexCachePath(repo *Repository) string {
+	sum := sha256.Sum256([]byte(repo.String() + "\n" + pm.architecture()))
+	return filepath.Join(IndexCacheDir(pm.rootfs), hex.EncodeToString(sum[:8])+".json")
+}
+
+// readCachedIndex returns the cached index of repo, or nil if there is none
+// or it cannot be read
+func (pm *PackageManager) readCachedIndex(repo *Repository) *cachedIndex {
+	data, err := os.ReadFile(pm.indexCachePath(repo))
+	if err != nil {
+		return nil
+	}
+
+	var cached cachedIndex
+	if err := json.Unmarshal(data, &cached); err != nil {
+		fmt.Fprintf(os.Stderr, "  Warning: cached index for %s is corrupt, fetching it again\n", repo.String())
+		return nil
+	}
+	if cached.Repository != repo.String() || cached.Arch != pm.architecture() {
+		return nil
+	}
+	return &cached
+}
+
+func (pm *PackageManager) writeCachedIndex(repo *Repository, cached *cachedIndex) error {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	path := pm.indexCachePath(repo)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// cachedEntries returns the entries of a cached index of repo, checking
+// again that an index stored despite failing verification is allowed
+func (pm *PackageManager) cachedEntries(repo *Repository, cached *cachedIndex) ([]IndexEntry, error) {
+	var verifyErr error
+	if cached.Untrusted != "" {
+		verifyErr = fmt.Errorf("%w: %s", ErrUntrusted, cached.Untrusted)
+	}
+	if err := pm.checkTrust("index "+repo.String(), verifyErr); err != nil {
+		return nil, err
+	}
+
+	entries := make([]IndexEntry, len(cached.Entries))
+	for i, entry := range cached.Entries {
+		entry.trusted = verifyErr == nil
+		entry.repo = repo
+		entry.Tag = repo.Tag
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+// updateCommand returns the command that refreshes the package index
+func (pm *PackageManager) updateCommand() string {
+	if pm.rootfs == "/" {
+		return "isobox update"
+	}
+	return "isobox pkg update"
+}
+
+// formatAge formats the age of an index in days, hours or minutes
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d days", int(d/(24*time.Hour)))
+	case d >= 2*time.Hour:
+		return fmt.Sprintf("%d hours", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%d minutes", int(d/time.Minute))
+	}
+}
+
+// Update refreshes the cached index of every repository. Requests are
+// conditional on the ETag of the cached copy, so unchanged indexes are not
+// downloaded again.
+func (pm *PackageManager) Update(ctx context.Context) error {
+	pm.ctx = ctx
+	fmt.Println("Updating package index...")
+	repos, err := pm.repositories()
+	if err != nil {
+		return err
+	}
+
+	updated := 0
+	var lastErr error
+	for i := range repos {
+		repo := &repos[i]
+		fmt.Printf("Repository (priority %d): %s\n", repo.Priority, strings.Join(repo.URLs, ", "))
+
+		cached, changed, err := pm.refreshIndex(repo, pm.readCachedIndex(repo))
+		if err != nil {
+			if ctxErr := pm.context().Err(); ctxErr != nil {
+				return ctxErr
+			}
+			lastErr = err
+			fmt.Fprintf(os.Stderr, "  Warning: failed to fetch index: %v\n", err)
+			continue
+		}
+		updated++
+
+		if changed {
+			fmt.Printf("  %d packages\n", len(cached.Entries))
+		} else {
+			fmt.Printf("  Up to date, %d packages\n", len(cached.Entries))
+		}
+		if cached.Untrusted != "" {
+			fmt.Fprintf(os.Stderr, "  WARNING: index failed verification (%s)\n", cached.Untrusted)
+		}
+	}
+
+	if updated == 0 && lastErr != nil {
+		return fmt.Errorf("no package index available: %w", lastErr)
+	}
+
+	pm.index = nil
+	fmt.Println("Package index updated")
+	return nil
+}
@@ -0,0 +1,346 @@
+package ipkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileRecord describes an installed file as it was extracted from its package
+type FileRecord struct {
+	SHA256 string      `json:"sha256,omitempty"`
+	Link   string      `json:"link,omitempty"`
+	Mode   os.FileMode `json:"mode"`
+}
+
+// Kinds of FileProblem
+const (
+	problemModified    = "modified"
+	problemMissing     = "missing"
+	problemPermissions = "permissions"
+)
+
+// FileProblem is an installed file that no longer matches its package
+type FileProblem struct {
+	Path     string `json:"path"`
+	Problem  string `json:"problem"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+
+	// Config files under /etc are expected to be edited and are left
+	// alone by repair when their content changed
+	Config bool `json:"config,omitempty"`
+}
+
+// VerifyResult lists the problems found in the files of one package
+type VerifyResult struct {
+	Package  string        `json:"package"`
+	Version  string        `json:"version"`
+	Problems []FileProblem `json:"problems,omitempty"`
+	Repaired []string      `json:"repaired,omitempty"`
+
+	// Unverified packages were installed before file checksums were
+	// recorded, or with apk
+	Unverified bool `json:"unverified,omitempty"`
+}
+
+// modeBits are the parts of a file mode that verify compares
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// readFileRecord describes the file at path: the checksum of a regular
+// file or the target of a symlink, and its permissions
+func readFileRecord(path string) (FileRecord, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return FileRecord{}, err
+	}
+
+	record := FileRecord{Mode: info.Mode() & modeBits}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		record.Mode = 0
+		record.Link, err = os.Readlink(path)
+	case info.Mode().IsRegular():
+		record.SHA256, err = fileChecksum(path)
+	}
+	return record, err
+}
+
+// configChecksums returns the checksums of the config files in manifest
+func configChecksums(manifest map[string]FileRecord) map[string]string {
+	checksums := make(map[string]string)
+	for name, record := range manifest {
+		if strings.HasPrefix(name, "etc/") && record.SHA256 != "" {
+			checksums[name] = record.SHA256
+		}
+	}
+	return checksums
+}
+
+// checkFile compares the file name in the rootfs with its record
+func (pm *PackageManager) checkFile(name string, record FileRecord) *FileProblem {
+	problem := &FileProblem{
+		Path:   "/" + name,
+		Config: strings.HasPrefix(name, "etc/") && record.SHA256 != "",
+	}
+
+	current, err := readFileRecord(filepath.Join(pm.rootfs, name))
+	switch {
+	case os.IsNotExist(err):
+		problem.Problem = problemMissing
+	case err != nil:
+		problem.Problem = problemModified
+		problem.Actual = err.Error()
+	case current.Link != record.Link:
+		problem.Problem = problemModified
+		problem.Expected = record.Link
+		problem.Actual = current.Link
+	case current.SHA256 != record.SHA256:
+		problem.Problem = problemModified
+	case current.Mode != record.Mode:
+		problem.Problem = problemPermissions
+		problem.Expected = fmt.Sprintf("%04o", uint32(record.Mode.Perm()))
+		problem.Actual = fmt.Sprintf("%04o", uint32(current.Mode.Perm()))
+		if record.Mode&^os.ModePerm != current.Mode&^os.ModePerm {
+			problem.Expected = record.Mode.String()
+			problem.Actual = current.Mode.String()
+		}
+	default:
+		return nil
+	}
+	return problem
+}
+
+// verifyFiles checks the installed files of pkg against its manifest
+func (pm *PackageManager) verifyFiles(pkg *Package) VerifyResult {
+	result := VerifyResult{Package: pkg.Name, Version: pkg.Version}
+	if pkg.Manifest == nil {
+		result.Unverified = len(pkg.Files) > 0
+		return result
+	}
+
+	for _, name := range pkg.Files {
+		record, ok := pkg.Manifest[name]
+		if !ok {
+			continue
+		}
+		if problem := pm.checkFile(name, record); problem != nil {
+			result.Problems = append(result.Problems, *problem)
+		}
+	}
+	return result
+}
+
+// Verify checks the files of the named installed packages, or of every
+// installed package, against the checksums and permissions recorded when
+// they were installed. With repair, changed and missing files are extracted
+// again from the cached package, in one transaction; modified config files
+// are kept. It returns an error if any file still differs, or if a package
+// named in pkgNames has no recorded checksums to verify against.
+func (pm *PackageManager) Verify(ctx context.Context, pkgNames []string, repair, asJSON bool) error {
+	pm.ctx = ctx
+	if repair {
+		tx, err := pm.begin()
+		if err != nil {
+			return err
+		}
+		results, err := pm.repairPackages(pkgNames, asJSON)
+		if err := tx.finish(err); err != nil {
+			return err
+		}
+		return reportVerify(results, asJSON, len(pkgNames) > 0)
+	}
+
+	if err := pm.ensureDB(); err != nil {
+		return err
+	}
+	packages, err := pm.getInstalled()
+	if err != nil {
+		return err
+	}
+	selected, err := selectPackages(packages, pkgNames, pm.resolvePackageName)
+	if err != nil {
+		return err
+	}
+
+	var results []VerifyResult
+	for _, pkg := range selected {
+		results = append(results, pm.verifyFiles(pkg))
+	}
+	return reportVerify(results, asJSON, len(pkgNames) > 0)
+}
+
+// repairPackages checks the selected packages of the running transaction
+// and restores their changed files
+func (pm *PackageManager) repairPackages(pkgNames []string, asJSON bool) ([]VerifyResult, error) {
+	selected, err := selectPackages(pm.tx.packages, pkgNames, pm.resolvePackageName)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []VerifyResult
+	for _, pkg := range selected {
+		if err := pm.context().Err(); err != nil {
+			return nil, err
+		}
+		result := pm.verifyFiles(pkg)
+		if len(result.Problems) > 0 {
+			if err := pm.repair(pkg, &result, asJSON); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// selectPackages returns the packages named by names, or all of them if
+// names is empty
+func selectPackages(packages []Package, names []string, resolve func(string) string) ([]*Package, error) {
+	var selected []*Package
+	if len(names) == 0 {
+		for i := range packages {
+			selected = append(selected, &packages[i])
+		}
+		return selected, nil
+	}
+
+	for _, name := range names {
+		name = resolve(name)
+		found := false
+		for i := range packages {
+			if packages[i].Name == name {
+				selected = append(selected, &packages[i])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("package %s is not installed", name)
+		}
+	}
+	return selected, nil
+}
+
+// cachedPackage returns the shared package cache's copy of pkg
+func (pm *PackageManager) cachedPackage(pkg *Package) (string, error) {
+	cache, err := OpenPackageCache()
+	if err != nil {
+		return "", fmt.Errorf("package cache unavailable: %w", err)
+	}
+	if path, ok := cache.Lookup(pkg.Checksum); ok {
+		return path, nil
+	}
+	arch := pkg.Arch
+	if arch == "" {
+		arch = pm.architecture()
+	}
+	if path, ok := cache.LookupName(arch, fmt.Sprintf("%s-%s.apk", pkg.Name, pkg.Version)); ok {
+		return path, nil
+	}
+	return "", fmt.Errorf("%s-%s is not in the package cache, reinstall it to repair", pkg.Name, pkg.Version)
+}
+
+// repair extracts the files of result that differ from pkg's manifest
+// again from the cached package. Problems that are fixed move from
+// result.Problems to result.Repaired.
+func (pm *PackageManager) repair(pkg *Package, result *VerifyResult, asJSON bool) error {
+	apkFile, err := pm.cachedPackage(pkg)
+	if err != nil {
+		return err
+	}
+	if err := pm.checkTrust(pkg.Name, pm.verifyPackage(apkFile, nil)); err != nil {
+		return err
+	}
+
+	stagingDir := filepath.Join(pm.tx.workDir, "repair-"+pkg.Name)
+	defer os.RemoveAll(stagingDir)
+	if _, err := ExtractPackage(apkFile, stagingDir); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", pkg.Name, err)
+	}
+
+	var remaining []FileProblem
+	for _, problem := range result.Problems {
+		name := strings.TrimPrefix(problem.Path, "/")
+		if problem.Config && problem.Problem == problemModified {
+			if !asJSON {
+				fmt.Printf("  Keeping modified %s\n", problem.Path)
+			}
+			remaining = append(remaining, problem)
+			continue
+		}
+
+		staged, err := readFileRecord(filepath.Join(stagingDir, name))
+		if err != nil || staged != pkg.Manifest[name] {
+			return fmt.Errorf("cached package of %s does not contain %s as installed", pkg.Name, problem.Path)
+		}
+		if err := pm.tx.place(stagingDir, name, name); err != nil {
+			return fmt.Errorf("failed to repair %s: %w", problem.Path, err)
+		}
+		result.Repaired = append(result.Repaired, problem.Path)
+	}
+	result.Problems = remaining
+	return nil
+}
+
+// reportVerify prints the results of Verify and returns an error if any
+// file still differs from its package. When the packages were named rather
+// than all checked, one that could not be verified is an error too.
+func reportVerify(results []VerifyResult, asJSON, named bool) error {
+	var changed []VerifyResult
+	var unverifiedNames []string
+	problems, unverified := 0, 0
+	for _, result := range results {
+		problems += len(result.Problems)
+		if result.Unverified {
+			unverified++
+			unverifiedNames = append(unverifiedNames, result.Package)
+		}
+		if len(result.Problems) > 0 || len(result.Repaired) > 0 || result.Unverified {
+			changed = append(changed, result)
+		}
+	}
+
+	if asJSON {
+		if changed == nil {
+			changed = []VerifyResult{}
+		}
+		if err := printJSON(changed); err != nil {
+			return err
+		}
+	} else {
+		for _, result := range changed {
+			if len(result.Problems) == 0 && len(result.Repaired) == 0 {
+				continue
+			}
+			fmt.Printf("%s %s:\n", result.Package, result.Version)
+			for _, problem := range result.Problems {
+				line := fmt.Sprintf("  %-12s %s", problem.Problem, problem.Path)
+				if problem.Expected != "" || problem.Actual != "" {
+					line += fmt.Sprintf(" (%s, expected %s)", problem.Actual, problem.Expected)
+				}
+				fmt.Println(line)
+			}
+			for _, path := range result.Repaired {
+				fmt.Printf("  %-12s %s\n", "repaired", path)
+			}
+		}
+
+		if unverified > 0 {
+			fmt.Printf("%d packages have no recorded checksums (installed with apk or an older isobox); reinstall them to verify\n", unverified)
+		}
+		if problems == 0 {
+			fmt.Printf("Verified %d packages\n", len(results)-unverified)
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d files differ from their packages", problems)
+	}
+	if named && unverified > 0 {
+		return fmt.Errorf("%s could not be verified: no recorded checksums", strings.Join(unverifiedNames, ", "))
+	}
+	return nil
+}
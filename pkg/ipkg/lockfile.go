@@ -0,0 +1,495 @@
+package ipkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// LockFileName is the name of the lock file written next to a
+// dependencies file
+const LockFileName = "isobox.lock"
+
+// Lockfile is an isobox.lock file: the exact packages that were installed
+// from a dependencies file, dependencies first
+type Lockfile struct {
+	Alpine string `toml:"alpine"`
+	Arch   string `toml:"arch"`
+
+	// Requested are the packages the dependencies file asked for
+	Requested []string        `toml:"requested"`
+	Packages  []LockedPackage `toml:"package"`
+}
+
+// LockedPackage is one package of a Lockfile
+type LockedPackage struct {
+	Name       string `toml:"name"`
+	Version    string `toml:"version"`
+	Repository string `toml:"repository"`
+	Checksum   string `toml:"checksum"`
+	Tag        string `toml:"tag,omitempty"`
+}
+
+func (p LockedPackage) String() string {
+	return fmt.Sprintf("%s-%s", p.Name, p.Version)
+}
+
+// LockPath returns the path of the lock file of the dependencies file at
+// configPath
+func LockPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), LockFileName)
+}
+
+// ReadLock reads the lock file at path
+func ReadLock(path string) (*Lockfile, error) {
+	var lock Lockfile
+	if _, err := toml.DecodeFile(path, &lock); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no lock file at %s; install the dependencies without --locked to create it", path)
+		}
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &lock, nil
+}
+
+// writeLock records the installed packages that satisfy requested, and
+// everything they depend on, in the lock file of the dependencies file at
+// configPath
+func (pm *PackageManager) writeLock(configPath string, requested []string) error {
+	packages, err := pm.getInstalled()
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]*Package)
+	for i := range packages {
+		for _, provide := range packages[i].Provides {
+			name := dependencyName(provide)
+			if _, ok := byName[name]; !ok {
+				byName[name] = &packages[i]
+			}
+		}
+	}
+	for i := range packages {
+		byName[packages[i].Name] = &packages[i]
+	}
+	find := func(name string) *Package {
+		if pkg, ok := byName[name]; ok {
+			return pkg
+		}
+		return byName[soLibraryMap[name]]
+	}
+
+	// Walk the dependencies so that each package follows what it needs
+	var locked []*Package
+	visited := make(map[string]bool)
+	var visit func(pkg *Package)
+	visit = func(pkg *Package) {
+		if visited[pkg.Name] {
+			return
+		}
+		visited[pkg.Name] = true
+		for _, dep := range pkg.Depends {
+			if strings.HasPrefix(dep, "!") || strings.HasPrefix(dep, "/") {
+				continue
+			}
+			if target := find(dependencyName(dep)); target != nil {
+				visit(target)
+			}
+		}
+		locked = append(locked, pkg)
+	}
+	requested, err = pm.lockNames(requested)
+	if err != nil {
+		return err
+	}
+	for _, name := range requested {
+		name, _ = splitPin(name)
+		pkg := find(name)
+		if pkg == nil {
+			return fmt.Errorf("package %s is not installed", name)
+		}
+		visit(pkg)
+	}
+
+	// The database does not record repositories; take them from the index
+	// entries the packages were installed from
+	entries, err := pm.loadIndex()
+	if err != nil {
+		return err
+	}
+	repositories := make(map[string]string)
+	for _, entry := range entries {
+		key := entry.Name + "\n" + entry.Checksum
+		if _, ok := repositories[key]; !ok {
+			repositories[key] = entry.Repository
+		}
+	}
+
+	lock := Lockfile{
+		Alpine:    environmentBranch(pm.rootfs),
+		Arch:      pm.architecture(),
+		Requested: requested,
+	}
+	for _, pkg := range locked {
+		if pkg.Checksum == "" {
+			return fmt.Errorf("package %s has no recorded checksum; reinstall it to lock it", pkg.Name)
+		}
+		repository, ok := repositories[pkg.Name+"\n"+pkg.Checksum]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "  Warning: %s-%s is not in any repository index, locking it without a repository\n", pkg.Name, pkg.Version)
+		}
+		lock.Packages = append(lock.Packages, LockedPackage{
+			Name:       pkg.Name,
+			Version:    pkg.Version,
+			Repository: repository,
+			Checksum:   pkg.Checksum,
+			Tag:        pkg.Pin,
+		})
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by isobox from %s. Do not edit by hand; install the\n", filepath.Base(configPath))
+	fmt.Fprintf(&buf, "# dependencies with --locked to get exactly these packages.\n\n")
+	encoder := toml.NewEncoder(&buf)
+	encoder.Indent = ""
+	if err := encoder.Encode(lock); err != nil {
+		return err
+	}
+
+	path := LockPath(configPath)
+	if err := writeFileAtomic(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	fmt.Printf("Locked %d packages in %s\n", len(lock.Packages), path)
+	return nil
+}
+
+// InstallLocked installs exactly the packages in the lock file of the
+// dependencies file at configPath, as one transaction. Locked packages are
+// taken from the repositories or the shared package cache by version and
+// checksum; installed packages at another version are replaced. It fails
+// without changing anything if a locked package cannot be found, or if the
+// lock file is out of date with the dependencies file.
+func (pm *PackageManager) InstallLocked(ctx context.Context, configPath string) error {
+	pm.ctx = ctx
+	config, err := LoadDependencies(configPath)
+	if err != nil {
+		return err
+	}
+	lockPath := LockPath(configPath)
+	lock, err := ReadLock(lockPath)
+	if err != nil {
+		return err
+	}
+
+	if branch, arch := environmentBranch(pm.rootfs), pm.architecture(); NormalizeBranch(lock.Alpine) != branch || lock.Arch != arch {
+		return fmt.Errorf("%s is for Alpine %s on %s, the environment uses %s on %s", lockPath, lock.Alpine, lock.Arch, branch, arch)
+	}
+
+	// Both sides are compared as written by writeLock, so that aliases,
+	// pins and local files match however the lock file was written
+	requested, err := pm.lockNames(config.EnabledPackages())
+	if err != nil {
+		return err
+	}
+	lockRequested, err := pm.lockNames(lock.Requested)
+	if err != nil {
+		return err
+	}
+	for _, name := range requested {
+		if !slices.Contains(lockRequested, name) {
+			return fmt.Errorf("%s is out of date: %s is not locked; install the dependencies without --locked to update it", lockPath, name)
+		}
+	}
+	for _, name := range lockRequested {
+		if !slices.Contains(requested, name) {
+			return fmt.Errorf("%s is out of date: %s is no longer in %s; install the dependencies without --locked to update it", lockPath, name, filepath.Base(configPath))
+		}
+	}
+
+	fmt.Printf("Installing %d locked packages from %s...\n", len(lock.Packages), lockPath)
+	tx, err := pm.begin()
+	if err != nil {
+		return err
+	}
+	return tx.finish(pm.installLocked(lock))
+}
+
+// lockNames returns the requested packages names as they are recorded in a
+// lock file: the package name after aliases, with the repository tag it is
+// pinned to, and for local .apk files the name of their package
+func (pm *PackageManager) lockNames(names []string) ([]string, error) {
+	var result []string
+	for _, name := range names {
+		switch {
+		case name == "":
+			continue
+		case isLocalPackage(name):
+			info, err := pm.readPkgInfo(name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			name = info.Name
+		default:
+			base, tag := splitPin(name)
+			name = pm.resolvePackageName(base)
+			if tag != "" {
+				name += "@" + tag
+			}
+		}
+		if !slices.Contains(result, name) {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+// installLocked installs the packages of lock that are not installed at
+// their locked version and checksum. The plan is resolved with every
+// package pinned to its locked version, and all packages are fetched
+// before anything is changed; installed packages at another version are
+// then replaced in place, like an upgrade.
+func (pm *PackageManager) installLocked(lock *Lockfile) error {
+	installed := make(map[string]Package)
+	for _, pkg := range pm.tx.packages {
+		installed[pkg.Name] = pkg
+	}
+
+	var current []Package
+	var pending []LockedPackage
+	replacing := make(map[string]Package)
+	for _, locked := range lock.Packages {
+		pkg, ok := installed[locked.Name]
+		if ok && pkg.Version == locked.Version && pkg.Checksum == locked.Checksum {
+			current = append(current, pkg)
+			continue
+		}
+		if ok {
+			if pkg.Held {
+				return errHeld(pkg.Name)
+			}
+			replacing[pkg.Name] = pkg
+		}
+		pending = append(pending, locked)
+	}
+
+	if len(pending) == 0 {
+		fmt.Println("All locked packages are installed")
+		pm.markLocked(lock)
+		return nil
+	}
+
+	// Find every package before changing anything
+	entries, unavailable, err := pm.findLocked(pending)
+	if err != nil {
+		return err
+	}
+	if len(unavailable) > 0 {
+		for _, locked := range unavailable {
+			fmt.Printf("  %s (%s) is in no repository and not in the package cache\n", locked, locked.Checksum)
+		}
+		return fmt.Errorf("%d locked packages cannot be satisfied, nothing was installed", len(unavailable))
+	}
+
+	r, err := pm.newResolver()
+	if err != nil {
+		return err
+	}
+
+	// Dependencies resolve to the locked packages only: the installed ones
+	// that match the lock, and the entries found for the rest. Packages to
+	// replace are planned again as if they were not installed.
+	r.tagged = make(map[string]map[string]*IndexEntry)
+	locked := make(map[string]bool)
+	pin := func(entry *IndexEntry) {
+		locked[entry.Name] = true
+		r.byName[entry.Name] = entry
+		for _, provide := range entry.Provides {
+			r.providers[dependencyName(provide)] = entry
+		}
+	}
+	for _, pkg := range current {
+		pin(&IndexEntry{Name: pkg.Name, Version: pkg.Version, Provides: pkg.Provides})
+	}
+	for _, entry := range entries {
+		pin(entry)
+		if _, ok := replacing[entry.Name]; ok {
+			r.installed[entry.Name] = false
+			r.versions[entry.Name] = entry.Version
+		}
+	}
+	for _, entry := range entries {
+		r.visit(entry)
+	}
+
+	// Installed packages outside the lock must still accept the versions
+	// that replace their dependencies
+	for _, pkg := range pm.tx.packages {
+		if locked[pkg.Name] {
+			continue
+		}
+		for _, dep := range pkg.Depends {
+			name, op, want := splitConstraint(dep)
+			if _, ok := replacing[name]; ok && op != "" && !satisfiesVersion(r.versions[name], op, want) {
+				r.blocked = append(r.blocked, PlanConflict{
+					Package: name,
+					With:    pkg.Name,
+					Reason:  fmt.Sprintf("is locked at %s, but %s is needed by", r.versions[name], dep),
+				})
+			}
+		}
+	}
+
+	for _, entry := range r.plan {
+		if !locked[entry.Name] {
+			return fmt.Errorf("%s is needed by the locked packages but is not locked; install the dependencies without --locked to update the lock file", entry.Name)
+		}
+	}
+	if err := r.check(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Locked packages to install (%d):\n", len(r.plan))
+	for _, entry := range r.plan {
+		if old, ok := replacing[entry.Name]; ok {
+			fmt.Printf("  %s %s -> %s\n", entry.Name, old.Version, entry.Version)
+		} else {
+			fmt.Printf("  %s %s\n", entry.Name, entry.Version)
+		}
+	}
+
+	apkFiles, cleanup, err := pm.fetchPlan(r.plan)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	for i, entry := range r.plan {
+		if err := pm.context().Err(); err != nil {
+			return err
+		}
+		if old, ok := replacing[entry.Name]; ok {
+			err = pm.upgradeFromFile(old, apkFiles[i])
+		} else {
+			err = pm.installFromFile(entry.Name, apkFiles[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	pm.markLocked(lock)
+	return nil
+}
+
+// findLocked returns the index entries of the locked packages, matched by
+// name, version and checksum and preferring the locked repository. Packages
+// no longer served by a repository are taken from the shared package cache
+// when it has them, described by their own metadata; the rest are returned
+// as unavailable.
+func (pm *PackageManager) findLocked(pending []LockedPackage) ([]*IndexEntry, []LockedPackage, error) {
+	entries, err := pm.loadIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	cache, err := OpenPackageCache()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "  Warning: package cache unavailable: %v\n", err)
+	}
+
+	var plan []*IndexEntry
+	var unavailable []LockedPackage
+	for _, locked := range pending {
+		var match *IndexEntry
+		for i := range entries {
+			entry := &entries[i]
+			if entry.Name != locked.Name || entry.Version != locked.Version || entry.Checksum != locked.Checksum {
+				continue
+			}
+			if match == nil || entry.Repository == locked.Repository && match.Repository != locked.Repository {
+				match = entry
+			}
+		}
+
+		if match == nil && cache != nil {
+			if path, ok := cache.Lookup(locked.Checksum); ok {
+				if match, err = pm.cachedEntry(path, locked); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+
+		if match == nil {
+			unavailable = append(unavailable, locked)
+			continue
+		}
+		plan = append(plan, match)
+	}
+	return plan, unavailable, nil
+}
+
+// cachedEntry describes the cached package at path as an index entry of
+// the repository it was locked from, so that it can still be downloaded
+// from there if it leaves the cache before it is installed
+func (pm *PackageManager) cachedEntry(path string, locked LockedPackage) (*IndexEntry, error) {
+	info, err := pm.readPkgInfo(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached %s: %w", locked, err)
+	}
+	if info.Name != locked.Name || info.Version != locked.Version {
+		return nil, fmt.Errorf("cached package %s is %s-%s", locked, info.Name, info.Version)
+	}
+	var size int64
+	if stat, err := os.Stat(path); err == nil {
+		size = stat.Size()
+	}
+
+	repos, err := pm.repositories()
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repository{URLs: []string{locked.Repository}, Tag: locked.Tag}
+	for i := range repos {
+		if repos[i].String() == locked.Repository {
+			repo = &repos[i]
+			break
+		}
+	}
+
+	return &IndexEntry{
+		Name:          info.Name,
+		Version:       info.Version,
+		Arch:          info.Arch,
+		Description:   info.Description,
+		URL:           info.URL,
+		License:       info.License,
+		Origin:        info.Origin,
+		Size:          size,
+		InstalledSize: info.Size,
+		Checksum:      locked.Checksum,
+		Depends:       info.Depends,
+		Provides:      info.Provides,
+		Repository:    locked.Repository,
+		Tag:           locked.Tag,
+		repo:          repo,
+	}, nil
+}
+
+// markLocked records the repository tags of the locked packages and marks
+// the requested ones as explicit
+func (pm *PackageManager) markLocked(lock *Lockfile) {
+	for _, locked := range lock.Packages {
+		pm.tx.setPin(locked.Name, locked.Tag)
+	}
+	requested, _ := pm.lockNames(lock.Requested)
+	for _, name := range requested {
+		name, _ = splitPin(name)
+		pm.tx.setExplicit(name)
+	}
+}
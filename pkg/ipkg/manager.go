@@ -5,22 +5,18 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
-const (
-	AlpineMainRepo      = "https://dl-cdn.alpinelinux.org/alpine/v3.18/main/x86_64/"
-	AlpineCommunityRepo = "https://dl-cdn.alpinelinux.org/alpine/v3.18/community/x86_64/"
-)
-
 var packageAliases = map[string]string{
 	"nvim":   "neovim",
 	"vim":    "vim",
@@ -60,21 +56,105 @@ type Package struct {
 	Version     string    `json:"version"`
 	Description string    `json:"description,omitempty"`
 	Installed   time.Time `json:"installed"`
+	Files       []string  `json:"files,omitempty"`
+
+	// InstalledSize is the size of the package contents in bytes
+	InstalledSize int64 `json:"installed_size,omitempty"`
+
+	// Held packages are never removed, replaced or overwritten until unheld
+	Held bool `json:"held,omitempty"`
+
+	// Pin is the repository tag the package was installed from, as in "go@edge"
+	Pin string `json:"pin,omitempty"`
+
+	// Checksums holds the SHA-256 of each config file under /etc as
+	// installed, to tell local modifications apart on reinstall
+	Checksums map[string]string `json:"checksums,omitempty"`
+
+	// Triggers are the directory globs whose changes run the package's
+	// .trigger script
+	Triggers []string `json:"triggers,omitempty"`
+
+	// Manifest records every installed file as it was extracted, for
+	// checking it with pkg verify
+	Manifest map[string]FileRecord `json:"manifest,omitempty"`
+
+	// Explicit packages were asked for by name rather than pulled in as
+	// dependencies; they make up /etc/apk/world
+	Explicit bool `json:"explicit,omitempty"`
+
+	// ScriptPending is set when the post-install script was skipped
+	// because NoScripts was set; RunSkippedScripts runs it
+	ScriptPending bool `json:"script_pending,omitempty"`
+
+	// Metadata kept for apk's installed database
+	Arch     string   `json:"arch,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	License  string   `json:"license,omitempty"`
+	Origin   string   `json:"origin,omitempty"`
+	Checksum string   `json:"checksum,omitempty"`
+	Depends  []string `json:"depends,omitempty"`
+	Provides []string `json:"provides,omitempty"`
+}
+
+// pkgInfo holds the fields read from a package's .PKGINFO
+type pkgInfo struct {
+	Name        string
+	Version     string
+	Description string
+	URL         string
+	License     string
+	Origin      string
+	Arch        string
+	Size        int64
+	DataHash    string
+	Depends     []string
+	Provides    []string
+	Triggers    []string
 }
 
 type PackageManager struct {
-	rootfs     string
-	db         string
-	installing map[string]bool
+	rootfs  string
+	db      string
+	branch  string
+	arch    string
+	repos   []Repository
+	index   []IndexEntry
+	keys    map[string]*rsa.PublicKey
+	keysErr error
+	tx      *transaction
+	ctx     context.Context
+
+	// AllowUntrusted installs packages that fail signature or checksum
+	// verification instead of refusing them
+	AllowUntrusted bool
+
+	// ForceOverwrite lets a package replace files owned by another package
+	// instead of aborting the install
+	ForceOverwrite bool
+
+	// NoScripts skips install scripts and triggers, for a rootfs that
+	// cannot run them yet. Skipped post-install scripts are run later by
+	// RunSkippedScripts.
+	NoScripts bool
+
+	// ForceRemove removes packages that installed packages still depend on
+	ForceRemove bool
+
+	// warnedUser is set once scripts were reported to run without root
+	warnedUser bool
+
+	// readOnly is set while planning: indexes are only read from the cache
+	// and a missing database counts as empty
+	readOnly bool
 }
 
 func NewPackageManager(envRoot string) *PackageManager {
 	isoboxRoot := filepath.Join(envRoot, ".isobox")
 	db := filepath.Join(isoboxRoot, "var/lib/ipkg/installed.json")
 	return &PackageManager{
-		rootfs:     isoboxRoot,
-		db:         db,
-		installing: make(map[string]bool),
+		rootfs: isoboxRoot,
+		db:     db,
 	}
 }
 
@@ -83,9 +163,20 @@ func NewPackageManager(envRoot string) *PackageManager {
 func NewInternalPackageManager() *PackageManager {
 	db := "/var/lib/ipkg/installed.json"
 	return &PackageManager{
-		rootfs:     "/",
-		db:         db,
-		installing: make(map[string]bool),
+		rootfs: "/",
+		db:     db,
+	}
+}
+
+// NewRootfsPackageManager creates a package manager for a bare root
+// filesystem that is not an environment yet, such as the base system while
+// it is being built. Packages for arch come from the repositories of branch.
+func NewRootfsPackageManager(rootfs, branch, arch string) *PackageManager {
+	return &PackageManager{
+		rootfs: rootfs,
+		db:     filepath.Join(rootfs, "var/lib/ipkg/installed.json"),
+		branch: branch,
+		arch:   arch,
 	}
 }
 
@@ -96,112 +187,313 @@ func (pm *PackageManager) resolvePackageName(pkgName string) string {
 	return pkgName
 }
 
-func (pm *PackageManager) Install(pkgName string) error {
-	if err := pm.ensureDB(); err != nil {
+// context returns the context of the running operation
+func (pm *PackageManager) context() context.Context {
+	if pm.ctx == nil {
+		return context.Background()
+	}
+	return pm.ctx
+}
+
+// Install installs packages and their dependencies as one transaction:
+// if anything fails or ctx is cancelled, every file extracted so far is
+// rolled back and the database is left unchanged
+func (pm *PackageManager) Install(ctx context.Context, pkgNames ...string) error {
+	pm.ctx = ctx
+	tx, err := pm.begin()
+	if err != nil {
 		return err
 	}
 
-	originalName := pkgName
-	pkgName = pm.resolvePackageName(pkgName)
+	var names []string
+	for _, pkgName := range pkgNames {
+		if isLocalPackage(pkgName) {
+			if err := pm.installLocal(pkgName); err != nil {
+				return tx.finish(err)
+			}
+			continue
+		}
 
-	if originalName != pkgName {
-		fmt.Printf("Installing %s (mapped to: %s)...\n", originalName, pkgName)
-	} else {
-		fmt.Printf("Installing %s...\n", pkgName)
+		resolved := pm.resolvePackageName(pkgName)
+		if resolved != pkgName {
+			fmt.Printf("Installing %s (mapped to: %s)...\n", pkgName, resolved)
+		} else {
+			fmt.Printf("Installing %s...\n", resolved)
+		}
+		names = append(names, resolved)
+	}
+	if len(names) == 0 {
+		return tx.finish(nil)
 	}
 
 	fmt.Println("Resolving dependencies...")
-	return pm.installWithDeps(pkgName)
+	return tx.finish(pm.installWithDeps(names))
 }
 
-func (pm *PackageManager) installWithDeps(pkgName string) error {
-	// Prevent circular dependencies
-	if pm.installing[pkgName] {
+// installWithDeps resolves pkgNames and their missing dependencies from the
+// index, then downloads and installs them
+func (pm *PackageManager) installWithDeps(pkgNames []string) error {
+	var missing []string
+	for _, pkgName := range pkgNames {
+		name, _ := splitPin(pkgName)
+		installed, err := pm.isInstalled(name)
+		if err != nil {
+			return err
+		}
+		if installed {
+			fmt.Printf("Package %s is already installed\n", name)
+			pm.tx.setExplicit(name)
+			continue
+		}
+		missing = append(missing, pkgName)
+	}
+	if len(missing) == 0 {
 		return nil
 	}
 
-	// Check if already installed
-	installed, err := pm.isInstalled(pkgName)
+	r, err := pm.planInstall(missing)
+	if err != nil {
+		return err
+	}
+	if err := r.check(); err != nil {
+		return err
+	}
+
+	if err := pm.executePlan(r.plan); err != nil {
+		return err
+	}
+
+	// Remember the repository tag of packages installed from tagged repositories
+	for _, entry := range r.plan {
+		if entry.Tag != "" {
+			pm.tx.setPin(entry.Name, entry.Tag)
+		}
+	}
+	for _, pkgName := range missing {
+		name, _ := splitPin(pkgName)
+		pm.tx.setExplicit(name)
+	}
+	return nil
+}
+
+// Bootstrap installs names and their dependencies as one transaction, for
+// populating a new root filesystem. Unlike Install, installed names are left
+// alone. It fails without installing anything if a name is missing from
+// the repositories.
+func (pm *PackageManager) Bootstrap(ctx context.Context, names []string) error {
+	pm.ctx = ctx
+	tx, err := pm.begin()
+	if err != nil {
+		return err
+	}
+
+	r, err := pm.newResolver()
+	if err != nil {
+		return tx.finish(err)
+	}
+	var missing []string
+	for _, name := range names {
+		if err := r.require(name, ""); err != nil {
+			fmt.Printf("  %v\n", err)
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return tx.finish(fmt.Errorf("cannot resolve base packages: %s", strings.Join(missing, " ")))
+	}
+	if err := r.check(); err != nil {
+		return tx.finish(err)
+	}
+
+	if err := pm.executePlan(r.plan); err != nil {
+		return tx.finish(err)
+	}
+	for _, name := range names {
+		tx.setExplicit(name)
+	}
+	return tx.finish(nil)
+}
+
+// isLocalPackage reports whether name refers to an .apk file on disk rather
+// than a repository package
+func isLocalPackage(name string) bool {
+	if !strings.HasSuffix(name, ".apk") {
+		return false
+	}
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
+}
+
+// installLocal installs an .apk file from disk, resolving its dependencies
+// from the configured repositories
+func (pm *PackageManager) installLocal(apkFile string) error {
+	fmt.Printf("Installing local package %s...\n", apkFile)
+
+	if err := pm.checkTrust(filepath.Base(apkFile), pm.verifyPackage(apkFile, nil)); err != nil {
+		return err
+	}
+
+	info, err := pm.readPkgInfo(apkFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", apkFile, err)
+	}
+	if info.Name == "" {
+		return fmt.Errorf("%s has no package name in its metadata", apkFile)
+	}
+	if !archMatches(info.Arch, pm.architecture()) {
+		return fmt.Errorf("%s is built for %s, the environment is %s", apkFile, info.Arch, pm.architecture())
+	}
+
+	installed, err := pm.isInstalled(info.Name)
 	if err != nil {
 		return err
 	}
 	if installed {
+		fmt.Printf("Package %s is already installed\n", info.Name)
+		pm.tx.setExplicit(info.Name)
 		return nil
 	}
 
-	pm.installing[pkgName] = true
-	defer func() { delete(pm.installing, pkgName) }()
-
-	// Find and download package
-	apkURL, err := pm.findPackage(pkgName)
+	fmt.Println("Resolving dependencies...")
+	r, err := pm.newResolver()
 	if err != nil {
-		return fmt.Errorf("package %s not found in Alpine repositories", pkgName)
+		return err
+	}
+	r.visited[info.Name] = true
+	for _, dep := range info.Depends {
+		r.require(dep, info.Name)
+	}
+	if err := r.check(); err != nil {
+		return err
 	}
 
-	cacheDir := filepath.Join(pm.rootfs, "var/cache/isobox")
-	os.MkdirAll(cacheDir, 0755)
-	apkFile := filepath.Join(cacheDir, pkgName+".apk")
+	if err := pm.executePlan(r.plan); err != nil {
+		return err
+	}
+
+	if err := pm.installFromFile(info.Name, apkFile); err != nil {
+		return err
+	}
+	pm.tx.setExplicit(info.Name)
+	return nil
+}
+
+// installFromFile extracts a downloaded or local APK, runs its install
+// scripts and records it in the database. Its dependencies must already be
+// installed.
+func (pm *PackageManager) installFromFile(pkgName, apkFile string) error {
+	return pm.unpack(pkgName, apkFile, nil)
+}
+
+// upgradeFromFile replaces the installed package old with another version
+// from apkFile. Files of old that the new version no longer has are
+// removed; the package keeps its pin and explicit mark.
+func (pm *PackageManager) upgradeFromFile(old Package, apkFile string) error {
+	return pm.unpack(old.Name, apkFile, &old)
+}
 
-	fmt.Printf("  Downloading %s...\n", pkgName)
-	if err := pm.downloadFile(apkURL, apkFile); err != nil {
-		return fmt.Errorf("failed to download %s: %w", pkgName, err)
+// unpack installs apkFile as pkgName, replacing old if it is set
+func (pm *PackageManager) unpack(pkgName, apkFile string, old *Package) error {
+	info, err := pm.readPkgInfo(apkFile)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata of %s: %w", pkgName, err)
+	}
+	if !archMatches(info.Arch, pm.architecture()) {
+		return fmt.Errorf("%s is built for %s, the environment is %s", pkgName, info.Arch, pm.architecture())
 	}
-	defer os.Remove(apkFile)
 
-	// Parse dependencies
-	deps, err := pm.parseDependencies(apkFile)
+	scripts, err := readScripts(apkFile)
 	if err != nil {
-		return fmt.Errorf("failed to parse dependencies for %s: %w", pkgName, err)
+		return fmt.Errorf("failed to read scripts of %s: %w", pkgName, err)
 	}
 
-	// Install dependencies first
-	for _, dep := range deps {
-		if dep == "" {
-			continue
+	// Extract the package between its pre- and post-install scripts, or
+	// its pre- and post-upgrade scripts when it replaces an older version
+	if old != nil {
+		verb := "Upgrading"
+		if compareVersions(info.Version, old.Version) < 0 {
+			verb = "Downgrading"
 		}
-
-		// Skip invalid dependency types
-		if strings.HasPrefix(dep, "cmd:") || strings.HasPrefix(dep, "pc:") || strings.HasPrefix(dep, "/") {
-			continue
+		fmt.Printf("  %s %s (%s -> %s)...\n", verb, pkgName, old.Version, info.Version)
+		if err := pm.runScript(pkgName, scriptPreUpgrade, scripts[scriptPreUpgrade], info.Version, old.Version); err != nil {
+			return err
 		}
-
-		// Map so: dependencies
-		if strings.HasPrefix(dep, "so:") {
-			if mappedPkg, ok := soLibraryMap[dep]; ok {
-				dep = mappedPkg
-			} else {
-				continue // Skip unknown so: dependencies
-			}
+	} else {
+		fmt.Printf("  Installing %s...\n", pkgName)
+		if err := pm.runScript(pkgName, scriptPreInstall, scripts[scriptPreInstall], info.Version); err != nil {
+			return err
 		}
+	}
 
-		// Remove version constraints
-		dep = strings.Split(dep, "=")[0]
-		dep = strings.Split(dep, "<")[0]
-		dep = strings.Split(dep, ">")[0]
-		dep = strings.TrimSpace(dep)
+	files, manifest, err := pm.extractAPK(pkgName, apkFile)
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", pkgName, err)
+	}
 
-		if dep == "" {
-			continue
+	if old != nil {
+		if err := pm.removeStale(old, files); err != nil {
+			return err
 		}
+	}
 
-		if err := pm.installWithDeps(dep); err != nil {
-			fmt.Printf("  Warning: Failed to install dependency %s: %v\n", dep, err)
+	// Keep the scripts for removal and triggers
+	for _, name := range scriptNames {
+		path := pm.scriptPath(pkgName, name)
+		if script, ok := scripts[name]; ok {
+			if err := pm.tx.writeFile(path, script, 0755); err != nil {
+				return fmt.Errorf("failed to save scripts of %s: %w", pkgName, err)
+			}
+		} else if old != nil {
+			if err := pm.tx.removeFile(path); err != nil {
+				return err
+			}
 		}
 	}
 
-	// Extract the package
-	fmt.Printf("  Installing %s...\n", pkgName)
-	if err := pm.extractAPK(apkFile); err != nil {
-		return fmt.Errorf("failed to extract %s: %w", pkgName, err)
+	if old != nil {
+		if err := pm.runScript(pkgName, scriptPostUpgrade, scripts[scriptPostUpgrade], info.Version, old.Version); err != nil {
+			fmt.Fprintf(os.Stderr, "  Warning: %v\n", err)
+		}
+	} else if err := pm.runScript(pkgName, scriptPostInstall, scripts[scriptPostInstall], info.Version); err != nil {
+		fmt.Fprintf(os.Stderr, "  Warning: %v\n", err)
 	}
 
 	// Add to database
+	checksum, err := packageChecksum(apkFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", pkgName, err)
+	}
+	version := info.Version
+	if version == "" {
+		version = "latest"
+	}
 	pkg := Package{
-		Name:      pkgName,
-		Version:   "latest",
-		Installed: time.Now(),
+		Name:          pkgName,
+		Version:       version,
+		Description:   info.Description,
+		Installed:     time.Now(),
+		Files:         files,
+		InstalledSize: info.Size,
+		Checksums:     configChecksums(manifest),
+		Manifest:      manifest,
+		Triggers:      info.Triggers,
+		Arch:          info.Arch,
+		URL:           info.URL,
+		License:       info.License,
+		Origin:        info.Origin,
+		Checksum:      checksum,
+		Depends:       info.Depends,
+		Provides:      info.Provides,
+		ScriptPending: old == nil && pm.NoScripts && len(scripts[scriptPostInstall]) > 0,
+	}
+
+	if old != nil {
+		pkg.Pin = old.Pin
+		pkg.Explicit = old.Explicit
+		if err := pm.removeFromDatabase(pkgName); err != nil {
+			return err
+		}
 	}
-
 	if err := pm.addToDatabase(pkg); err != nil {
 		return err
 	}
@@ -209,23 +501,121 @@ func (pm *PackageManager) installWithDeps(pkgName string) error {
 	return nil
 }
 
-func (pm *PackageManager) Remove(pkgName string) error {
-	fmt.Printf("Removing package: %s\n", pkgName)
+// removeStale deletes the files of old that its replacement, which
+// installed files, no longer has. Config files changed since install are kept.
+func (pm *PackageManager) removeStale(old *Package, files []string) error {
+	kept := make(map[string]bool, len(files))
+	for _, name := range files {
+		kept[name] = true
+	}
 
-	installed, err := pm.isInstalled(pkgName)
+	for _, name := range old.Files {
+		if kept[name] || pm.tx.owners[name] != old.Name {
+			continue
+		}
+		target := filepath.Join(pm.rootfs, name)
+		if recorded, ok := old.Checksums[name]; ok {
+			if current, err := fileChecksum(target); err == nil && current != recorded {
+				fmt.Printf("  Keeping modified /%s\n", name)
+				continue
+			}
+		}
+		if err := pm.tx.removeFile(target); err != nil {
+			return fmt.Errorf("failed to remove /%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Remove removes the named packages as one transaction. It refuses to
+// remove a package that another installed package depends on, unless
+// ForceRemove is set.
+func (pm *PackageManager) Remove(pkgNames ...string) error {
+	tx, err := pm.begin()
 	if err != nil {
 		return err
 	}
-	if !installed {
-		fmt.Printf("Package %s is not installed\n", pkgName)
-		return nil
+	return tx.finish(pm.remove(pkgNames))
+}
+
+func (pm *PackageManager) remove(pkgNames []string) error {
+	var selected []*Package
+	removing := make(map[string]bool)
+	for _, pkgName := range pkgNames {
+		pkg, err := pm.findInstalled(pkgName)
+		if err != nil {
+			return err
+		}
+		if pkg == nil {
+			fmt.Printf("Package %s is not installed\n", pkgName)
+			continue
+		}
+		if pkg.Held {
+			return errHeld(pkgName)
+		}
+		selected = append(selected, pkg)
+		removing[pkg.Name] = true
+	}
+
+	if conflicts := dependents(pm.tx.packages, removing); len(conflicts) > 0 {
+		for _, conflict := range conflicts {
+			fmt.Printf("  %s\n", conflict)
+		}
+		if !pm.ForceRemove {
+			return fmt.Errorf("%d installed package(s) depend on what would be removed (use --force to remove anyway), nothing was removed", len(conflicts))
+		}
+		fmt.Fprintln(os.Stderr, "  Warning: removing packages other packages depend on")
 	}
 
-	if err := pm.removeFromDatabase(pkgName); err != nil {
+	for _, pkg := range selected {
+		fmt.Printf("Removing package: %s\n", pkg.Name)
+		if err := pm.removePackage(pkg); err != nil {
+			return err
+		}
+		fmt.Printf("Successfully removed %s\n", pkg.Name)
+	}
+	return nil
+}
+
+// removePackage runs the deinstall scripts of pkg around deleting its files
+// and dropping it from the database
+func (pm *PackageManager) removePackage(pkg *Package) error {
+	preDeinstall := pm.savedScript(pkg.Name, scriptPreDeinstall)
+	postDeinstall := pm.savedScript(pkg.Name, scriptPostDeinstall)
+	version := pkg.Version
+
+	if err := pm.runScript(pkg.Name, scriptPreDeinstall, preDeinstall, version); err != nil {
+		return err
+	}
+
+	if err := pm.removeFromDatabase(pkg.Name); err != nil {
 		return err
 	}
 
-	fmt.Printf("Successfully removed %s\n", pkgName)
+	// Delete the package's files, keeping config files changed since install
+	for _, name := range pkg.Files {
+		target := filepath.Join(pm.rootfs, name)
+		if recorded, ok := pkg.Checksums[name]; ok {
+			if current, err := fileChecksum(target); err == nil && current != recorded {
+				fmt.Printf("  Keeping modified /%s\n", name)
+				continue
+			}
+		}
+		if err := pm.tx.removeFile(target); err != nil {
+			return fmt.Errorf("failed to remove /%s: %w", name, err)
+		}
+	}
+
+	for _, name := range scriptNames {
+		if err := pm.tx.removeFile(pm.scriptPath(pkg.Name, name)); err != nil {
+			return err
+		}
+	}
+
+	if err := pm.runScript(pkg.Name, scriptPostDeinstall, postDeinstall, version); err != nil {
+		fmt.Fprintf(os.Stderr, "  Warning: %v\n", err)
+	}
+
 	return nil
 }
 
@@ -242,32 +632,41 @@ func (pm *PackageManager) List() error {
 
 	fmt.Println("Installed packages:")
 	for _, pkg := range packages {
-		fmt.Printf("  %s (%s) - %s\n", pkg.Name, pkg.Version, pkg.Description)
+		name := pkg.Name
+		if pkg.Pin != "" {
+			name += "@" + pkg.Pin
+		}
+		if pkg.Held {
+			name += " [held]"
+		}
+		fmt.Printf("  %s (%s) - %s\n", name, pkg.Version, pkg.Description)
 	}
 
 	return nil
 }
 
-func (pm *PackageManager) Update() error {
-	fmt.Println("Updating package index...")
-	fmt.Printf("Main repository: %s\n", AlpineMainRepo)
-	fmt.Printf("Community repository: %s\n", AlpineCommunityRepo)
-	fmt.Println("Package index updated")
-	return nil
-}
-
 func (pm *PackageManager) ensureDB() error {
 	dbDir := filepath.Dir(pm.db)
 	if err := os.MkdirAll(dbDir, 0755); err != nil {
 		return fmt.Errorf("create db dir: %w", err)
 	}
 
-	if _, err := os.Stat(pm.db); os.IsNotExist(err) {
-		emptyDB := []Package{}
-		data, _ := json.MarshalIndent(emptyDB, "", "  ")
-		if err := os.WriteFile(pm.db, data, 0644); err != nil {
-			return fmt.Errorf("create db: %w", err)
-		}
+	if _, err := os.Stat(pm.db); !os.IsNotExist(err) {
+		return nil
+	}
+
+	// Link a complete empty database into place, which fails harmlessly
+	// if a concurrent run created it first
+	emptyDB := []Package{}
+	data, _ := json.MarshalIndent(emptyDB, "", "  ")
+	tmp := fmt.Sprintf("%s.%d.new", pm.db, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("create db: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Link(tmp, pm.db); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("create db: %w", err)
 	}
 
 	return nil
@@ -288,8 +687,22 @@ func (pm *PackageManager) isInstalled(pkgName string) (bool, error) {
 	return false, nil
 }
 
+// getInstalled returns the installed packages, as modified so far by the
+// running transaction if there is one
 func (pm *PackageManager) getInstalled() ([]Package, error) {
+	if pm.tx != nil {
+		return pm.tx.packages, nil
+	}
+	return pm.readDatabase()
+}
+
+// readDatabase returns the installed packages, including changes made with
+// apk since ipkg last wrote the apk database
+func (pm *PackageManager) readDatabase() ([]Package, error) {
 	data, err := os.ReadFile(pm.db)
+	if os.IsNotExist(err) && pm.readOnly {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("read db: %w", err)
 	}
@@ -299,120 +712,88 @@ func (pm *PackageManager) getInstalled() ([]Package, error) {
 		return nil, fmt.Errorf("parse db: %w", err)
 	}
 
-	return packages, nil
+	return pm.syncFromApk(packages), nil
 }
 
+// addToDatabase records pkg in the running transaction; it is written
+// out when the transaction commits
 func (pm *PackageManager) addToDatabase(pkg Package) error {
-	packages, err := pm.getInstalled()
-	if err != nil {
-		return err
-	}
-
-	packages = append(packages, pkg)
-
-	data, err := json.MarshalIndent(packages, "", "  ")
-	if err != nil {
-		return fmt.Errorf("marshal db: %w", err)
-	}
-
-	if err := os.WriteFile(pm.db, data, 0644); err != nil {
-		return fmt.Errorf("write db: %w", err)
+	if pm.tx == nil {
+		return fmt.Errorf("database update outside of a transaction")
 	}
-
+	pm.tx.addPackage(pkg)
 	return nil
 }
 
 func (pm *PackageManager) removeFromDatabase(pkgName string) error {
-	packages, err := pm.getInstalled()
-	if err != nil {
-		return err
+	if pm.tx == nil {
+		return fmt.Errorf("database update outside of a transaction")
 	}
-
-	filtered := []Package{}
-	for _, pkg := range packages {
-		if pkg.Name != pkgName {
-			filtered = append(filtered, pkg)
-		}
-	}
-
-	data, err := json.MarshalIndent(filtered, "", "  ")
-	if err != nil {
-		return fmt.Errorf("marshal db: %w", err)
-	}
-
-	if err := os.WriteFile(pm.db, data, 0644); err != nil {
-		return fmt.Errorf("write db: %w", err)
-	}
-
+	pm.tx.removePackage(pkgName)
 	return nil
 }
 
-func (pm *PackageManager) downloadFile(url, dest string) error {
-	resp, err := http.Get(url)
+// fetchPackage returns a local copy of entry, from the shared package cache
+// when possible. cleanup removes the file if it could not be cached.
+func (pm *PackageManager) fetchPackage(entry *IndexEntry) (string, func(), error) {
+	cache, err := OpenPackageCache()
 	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed: %s", resp.Status)
+		fmt.Fprintf(os.Stderr, "  Warning: package cache unavailable: %v\n", err)
+	} else if path, ok := cache.Lookup(entry.Checksum); ok {
+		fmt.Printf("  Using cached %s\n", entry.Filename())
+		return path, func() {}, nil
 	}
 
-	out, err := os.Create(dest)
-	if err != nil {
-		return err
+	var tmpFile string
+	if cache != nil {
+		tmpFile = cache.TempFile(entry.Filename())
+	} else {
+		cacheDir := filepath.Join(pm.rootfs, "var/cache/isobox")
+		os.MkdirAll(cacheDir, 0755)
+		tmpFile = filepath.Join(cacheDir, entry.Filename())
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return err
-}
 
-func (pm *PackageManager) findPackage(pkgName string) (string, error) {
-	// Try main repository first
-	url, err := pm.searchRepo(AlpineMainRepo, pkgName)
-	if err == nil {
-		return url, nil
+	fmt.Printf("  Downloading %s...\n", entry.Name)
+	if err := pm.downloadPackage(entry, tmpFile); err != nil {
+		os.Remove(tmpFile)
+		return "", nil, err
 	}
 
-	// Try community repository
-	url, err = pm.searchRepo(AlpineCommunityRepo, pkgName)
-	if err == nil {
-		return url, nil
+	if cache != nil {
+		if path, err := cache.Add(tmpFile, pm.architecture(), entry.Filename()); err == nil {
+			return path, func() {}, nil
+		}
 	}
 
-	return "", fmt.Errorf("package not found")
+	return tmpFile, func() { os.Remove(tmpFile) }, nil
 }
 
-func (pm *PackageManager) searchRepo(repoURL, pkgName string) (string, error) {
-	resp, err := http.Get(repoURL)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to fetch repo index")
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+// downloadPackage downloads entry into dest, trying each mirror of its repository
+func (pm *PackageManager) downloadPackage(entry *IndexEntry, dest string) error {
+	err := fmt.Errorf("no repository to download %s from", entry.Filename())
+	for _, url := range entry.downloadURLs(pm.architecture()) {
+		if err = DownloadURL(pm.context(), url, dest); err == nil {
+			return nil
+		}
+		if pm.context().Err() != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "  Warning: download from %s failed: %v\n", url, err)
 	}
+	return err
+}
 
-	// Search for package in HTML index
-	pattern := fmt.Sprintf(`href="(%s-[^"]*\.apk)"`, regexp.QuoteMeta(pkgName))
-	re := regexp.MustCompile(pattern)
-	matches := re.FindStringSubmatch(string(body))
-
-	if len(matches) < 2 {
-		return "", fmt.Errorf("package not found in repo")
+// readPkgInfo reads the package metadata of an APK file: .PKGINFO for
+// APKv2 packages, the package info object for APKv3
+func (pm *PackageManager) readPkgInfo(apkFile string) (*pkgInfo, error) {
+	if isADB(apkFile) {
+		pkg, err := readPackageADB(apkFile)
+		if err != nil {
+			return nil, err
+		}
+		return pkg.pkgInfo(), nil
 	}
 
-	return repoURL + matches[1], nil
-}
-
-func (pm *PackageManager) parseDependencies(apkFile string) ([]string, error) {
 	file, err := os.Open(apkFile)
 	if err != nil {
 		return nil, err
@@ -444,46 +825,132 @@ func (pm *PackageManager) parseDependencies(apkFile string) ([]string, error) {
 				return nil, err
 			}
 
-			// Parse dependencies
-			var deps []string
-			scanner := bufio.NewScanner(buf)
-			for scanner.Scan() {
-				line := scanner.Text()
-				if strings.HasPrefix(line, "depend = ") {
-					dep := strings.TrimPrefix(line, "depend = ")
-					deps = append(deps, dep)
-				}
-			}
+			return parsePkgInfo(buf), nil
+		}
+	}
 
-			return deps, nil
+	return &pkgInfo{}, nil
+}
+
+func parsePkgInfo(r io.Reader) *pkgInfo {
+	info := &pkgInfo{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " = ")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "pkgname":
+			info.Name = value
+		case "pkgver":
+			info.Version = value
+		case "pkgdesc":
+			info.Description = value
+		case "url":
+			info.URL = value
+		case "license":
+			info.License = value
+		case "origin":
+			info.Origin = value
+		case "arch":
+			info.Arch = value
+		case "size":
+			info.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "datahash":
+			info.DataHash = value
+		case "depend":
+			info.Depends = append(info.Depends, value)
+		case "provides":
+			info.Provides = append(info.Provides, value)
+		case "triggers":
+			info.Triggers = append(info.Triggers, strings.Fields(value)...)
 		}
 	}
 
-	return []string{}, nil
+	return info
+}
+
+// extractAPK stages the package contents into the rootfs as part of the
+// running transaction and returns the paths of the installed files,
+// relative to the rootfs, and their manifest
+func (pm *PackageManager) extractAPK(pkgName, apkFile string) ([]string, map[string]FileRecord, error) {
+	return pm.tx.stage(pkgName, apkFile)
 }
 
-func (pm *PackageManager) extractAPK(apkFile string) error {
+// extractTarget returns the path of the archive entry name under root. It
+// fails if the entry escapes root, either with ".." or through a symlink
+// extracted earlier that leads outside root.
+func extractTarget(root, name string) (string, error) {
+	root = filepath.Clean(root)
+	target := filepath.Join(root, name)
+	if target == root {
+		return target, nil
+	}
+	if !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("%s escapes the package root", name)
+	}
+
+	// Resolve the deepest existing parent; anything below it is created
+	// as plain directories
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		return target, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Dir(target)
+	for parent != root {
+		if _, err := os.Lstat(parent); err == nil {
+			break
+		}
+		parent = filepath.Dir(parent)
+	}
+	realParent, err := filepath.EvalSymlinks(parent)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	if realParent != realRoot && !strings.HasPrefix(realParent, realRoot+string(os.PathSeparator)) {
+		return "", fmt.Errorf("%s escapes the package root through a symlink", name)
+	}
+	return target, nil
+}
+
+// ExtractPackage extracts an APKv2 or APKv3 package into rootfs and returns
+// the paths of the installed files, relative to rootfs
+func ExtractPackage(apkFile, rootfs string) ([]string, error) {
+	if isADB(apkFile) {
+		pkg, err := readPackageADB(apkFile)
+		if err != nil {
+			return nil, err
+		}
+		return pkg.extract(rootfs)
+	}
+
 	file, err := os.Open(apkFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
 	gzr, err := gzip.NewReader(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer gzr.Close()
 
 	tr := tar.NewReader(gzr)
 
+	var files []string
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Skip metadata files
@@ -491,36 +958,45 @@ func (pm *PackageManager) extractAPK(apkFile string) error {
 			continue
 		}
 
-		target := filepath.Join(pm.rootfs, header.Name)
+		target, err := extractTarget(rootfs, header.Name)
+		if err != nil {
+			return nil, err
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-				return err
+				return nil, err
 			}
 
 		case tar.TypeReg:
 			// Ensure parent directory exists
 			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
+				return nil, err
+			}
+
+			// Replace rather than write through a symlink of the same name
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				os.Remove(target)
 			}
 
 			// Create file
 			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			if _, err := io.Copy(outFile, tr); err != nil {
 				outFile.Close()
-				return err
+				return nil, err
 			}
 			outFile.Close()
+			files = append(files, header.Name)
 
 		case tar.TypeSymlink:
 			// Ensure parent directory exists
 			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
+				return nil, err
 			}
 
 			// Remove existing file/symlink
@@ -528,10 +1004,11 @@ func (pm *PackageManager) extractAPK(apkFile string) error {
 
 			// Create symlink
 			if err := os.Symlink(header.Linkname, target); err != nil {
-				return err
+				return nil, err
 			}
+			files = append(files, header.Name)
 		}
 	}
 
-	return nil
+	return files, nil
 }
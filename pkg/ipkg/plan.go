@@ -0,0 +1,366 @@
+package ipkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Plan describes what a transaction would change, without changing anything
+type Plan struct {
+	Install            []PlanPackage  `json:"install"`
+	Upgrade            []PlanUpgrade  `json:"upgrade"`
+	Remove             []PlanPackage  `json:"remove"`
+	DownloadSize       int64          `json:"download_size"`
+	InstalledSizeDelta int64          `json:"installed_size_delta"`
+	Conflicts          []PlanConflict `json:"conflicts"`
+	Warnings           []string       `json:"warnings,omitempty"`
+}
+
+// PlanPackage is one package added or removed by a plan
+type PlanPackage struct {
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	Repository    string `json:"repository,omitempty"`
+	Size          int64  `json:"size"`
+	InstalledSize int64  `json:"installed_size"`
+	Cached        bool   `json:"cached,omitempty"`
+}
+
+// PlanUpgrade is an installed package a plan replaces with a newer version
+type PlanUpgrade struct {
+	Name          string `json:"name"`
+	OldVersion    string `json:"old_version"`
+	Version       string `json:"version"`
+	Repository    string `json:"repository,omitempty"`
+	Size          int64  `json:"size"`
+	InstalledSize int64  `json:"installed_size"`
+	Cached        bool   `json:"cached,omitempty"`
+}
+
+// PlanConflict is a problem that would stop or break the transaction
+type PlanConflict struct {
+	Package string `json:"package"`
+	With    string `json:"with"`
+	Reason  string `json:"reason"`
+}
+
+func (c PlanConflict) String() string {
+	return fmt.Sprintf("%s %s %s", c.Package, c.Reason, c.With)
+}
+
+// PlanInstall resolves what installing names would do. Names may be
+// repository packages or local .apk files. Installed packages too old for
+// a new dependency are planned as upgrades. Nothing is written: indexes
+// that were never fetched are left out with a warning.
+func (pm *PackageManager) PlanInstall(names []string) (*Plan, error) {
+	pm.readOnly = true
+	defer func() { pm.readOnly = false }()
+
+	r, err := pm.newResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Install: []PlanPackage{}, Upgrade: []PlanUpgrade{}, Remove: []PlanPackage{}, Conflicts: []PlanConflict{}}
+	local := make(map[string]string)
+
+	for _, name := range names {
+		if !isLocalPackage(name) {
+			name = pm.resolvePackageName(name)
+			if base, _ := splitPin(name); r.installed[base] {
+				plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s is already installed", base))
+				continue
+			}
+			if err := r.require(name, ""); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Local packages are planned like index entries, after their dependencies
+		info, err := pm.readPkgInfo(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if r.installed[info.Name] {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s is already installed", info.Name))
+			continue
+		}
+		local[info.Name] = name
+		r.visit(&IndexEntry{
+			Name:          info.Name,
+			Version:       info.Version,
+			InstalledSize: info.Size,
+			Depends:       info.Depends,
+			Repository:    name,
+		})
+	}
+
+	cache, _ := OpenPackageCache()
+	apkFiles := make(map[string]string)
+	for _, entry := range r.plan {
+		pkg := PlanPackage{
+			Name:          entry.Name,
+			Version:       entry.Version,
+			Repository:    entry.Repository,
+			Size:          entry.Size,
+			InstalledSize: entry.InstalledSize,
+		}
+		if path, ok := local[entry.Name]; ok {
+			apkFiles[entry.Name] = path
+		}
+		if entry.repo != nil && cache != nil {
+			var path string
+			if path, pkg.Cached = cache.Lookup(entry.Checksum); pkg.Cached {
+				apkFiles[entry.Name] = path
+			}
+		}
+		if entry.repo != nil && !pkg.Cached {
+			plan.DownloadSize += entry.Size
+		}
+		plan.InstalledSizeDelta += entry.InstalledSize
+
+		if oldVersion, ok := r.upgrading[entry.Name]; ok {
+			old, err := pm.findInstalled(entry.Name)
+			if err != nil {
+				return nil, err
+			}
+			if old != nil {
+				plan.InstalledSizeDelta -= old.InstalledSize
+			}
+			plan.Upgrade = append(plan.Upgrade, PlanUpgrade{
+				Name:          pkg.Name,
+				OldVersion:    oldVersion,
+				Version:       pkg.Version,
+				Repository:    pkg.Repository,
+				Size:          pkg.Size,
+				InstalledSize: pkg.InstalledSize,
+				Cached:        pkg.Cached,
+			})
+			continue
+		}
+		plan.Install = append(plan.Install, pkg)
+	}
+
+	plan.Conflicts = append(plan.Conflicts, r.conflicts()...)
+	plan.Warnings = append(plan.Warnings, r.missing...)
+
+	fileConflicts, unchecked, err := pm.fileConflicts(r.plan, apkFiles)
+	if err != nil {
+		return nil, err
+	}
+	plan.Conflicts = append(plan.Conflicts, fileConflicts...)
+	if len(unchecked) > 0 {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("file conflicts not checked for packages that are not downloaded yet: %s", strings.Join(unchecked, " ")))
+	}
+	return plan, nil
+}
+
+// fileConflicts returns the files the packages of plan would take from
+// installed packages or from each other. Only packages with a file in
+// apkFiles, local or in the package cache, can be checked; the names of
+// the others are returned.
+func (pm *PackageManager) fileConflicts(plan []*IndexEntry, apkFiles map[string]string) ([]PlanConflict, []string, error) {
+	packages, err := pm.getInstalled()
+	if err != nil {
+		return nil, nil, err
+	}
+	owners := make(map[string]Package)
+	for _, pkg := range packages {
+		for _, name := range pkg.Files {
+			owners[name] = pkg
+		}
+	}
+
+	var conflicts []PlanConflict
+	var unchecked []string
+	for _, entry := range plan {
+		apkFile, ok := apkFiles[entry.Name]
+		if !ok {
+			unchecked = append(unchecked, entry.Name)
+			continue
+		}
+		files, err := packageFiles(apkFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", apkFile, err)
+		}
+		for _, name := range files {
+			owner, ok := owners[name]
+			if ok && owner.Name != entry.Name {
+				reason := fmt.Sprintf("would overwrite /%s, owned by", name)
+				if owner.Held {
+					reason = fmt.Sprintf("would overwrite /%s, owned by held package", name)
+				}
+				conflicts = append(conflicts, PlanConflict{Package: entry.Name, With: owner.Name, Reason: reason})
+				continue
+			}
+			owners[name] = Package{Name: entry.Name}
+		}
+	}
+	return conflicts, unchecked, nil
+}
+
+// packageFiles lists the files apkFile would install, by extracting it
+// into a scratch directory outside the environment
+func packageFiles(apkFile string) ([]string, error) {
+	dir, err := os.MkdirTemp("", "isobox-plan-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	return ExtractPackage(apkFile, dir)
+}
+
+// PlanRemove describes what removing names would do. Installed packages
+// that depend on a removed package are reported as conflicts.
+func (pm *PackageManager) PlanRemove(names []string) (*Plan, error) {
+	pm.readOnly = true
+	defer func() { pm.readOnly = false }()
+
+	plan := &Plan{Install: []PlanPackage{}, Upgrade: []PlanUpgrade{}, Remove: []PlanPackage{}, Conflicts: []PlanConflict{}}
+
+	removing := make(map[string]bool)
+	for _, name := range names {
+		pkg, err := pm.findInstalled(name)
+		if err != nil {
+			return nil, err
+		}
+		if pkg == nil {
+			return nil, fmt.Errorf("package %s is not installed", name)
+		}
+
+		size := pkg.InstalledSize
+		if size == 0 {
+			size = pm.diskUsage(pkg)
+		}
+
+		if pkg.Held {
+			plan.Conflicts = append(plan.Conflicts, PlanConflict{Package: pkg.Name, With: "a hold", Reason: "is protected by"})
+		}
+
+		removing[pkg.Name] = true
+		plan.Remove = append(plan.Remove, PlanPackage{Name: pkg.Name, Version: pkg.Version, InstalledSize: size})
+		plan.InstalledSizeDelta -= size
+	}
+
+	packages, err := pm.getInstalled()
+	if err != nil {
+		return nil, err
+	}
+	plan.Conflicts = append(plan.Conflicts, dependents(packages, removing)...)
+
+	return plan, nil
+}
+
+// dependents returns a conflict for each installed package outside
+// removing that depends on a package in removing
+func dependents(packages []Package, removing map[string]bool) []PlanConflict {
+	providers := make(map[string]string)
+	for _, pkg := range packages {
+		for _, provide := range pkg.Provides {
+			if _, ok := providers[dependencyName(provide)]; !ok {
+				providers[dependencyName(provide)] = pkg.Name
+			}
+		}
+	}
+	for _, pkg := range packages {
+		providers[pkg.Name] = pkg.Name
+	}
+
+	var conflicts []PlanConflict
+	for _, pkg := range packages {
+		if removing[pkg.Name] {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, dep := range pkg.Depends {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			name := dependencyName(dep)
+			target, ok := providers[name]
+			if !ok {
+				target = providers[soLibraryMap[name]]
+			}
+			if removing[target] && !seen[target] {
+				seen[target] = true
+				conflicts = append(conflicts, PlanConflict{Package: target, With: pkg.Name, Reason: "is required by"})
+			}
+		}
+	}
+	return conflicts
+}
+
+// diskUsage sums the sizes of the files of pkg that are still on disk
+func (pm *PackageManager) diskUsage(pkg *Package) int64 {
+	var total int64
+	for _, name := range pkg.Files {
+		if info, err := os.Lstat(filepath.Join(pm.rootfs, name)); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// PrintPlan shows a plan as text or JSON
+func PrintPlan(plan *Plan, asJSON bool) error {
+	if asJSON {
+		return printJSON(plan)
+	}
+
+	if len(plan.Install) > 0 {
+		fmt.Printf("Packages to install (%d):\n", len(plan.Install))
+		for _, pkg := range plan.Install {
+			note := ""
+			if pkg.Cached {
+				note = ", cached"
+			}
+			fmt.Printf("  %s %s (%s%s)\n", pkg.Name, pkg.Version, formatSize(pkg.InstalledSize), note)
+		}
+	}
+
+	if len(plan.Upgrade) > 0 {
+		fmt.Printf("Packages to upgrade (%d):\n", len(plan.Upgrade))
+		for _, pkg := range plan.Upgrade {
+			note := ""
+			if pkg.Cached {
+				note = ", cached"
+			}
+			fmt.Printf("  %s %s -> %s (%s%s)\n", pkg.Name, pkg.OldVersion, pkg.Version, formatSize(pkg.InstalledSize), note)
+		}
+	}
+
+	if len(plan.Remove) > 0 {
+		fmt.Printf("Packages to remove (%d):\n", len(plan.Remove))
+		for _, pkg := range plan.Remove {
+			fmt.Printf("  %s %s (%s)\n", pkg.Name, pkg.Version, formatSize(pkg.InstalledSize))
+		}
+	}
+
+	if len(plan.Install) == 0 && len(plan.Upgrade) == 0 && len(plan.Remove) == 0 {
+		fmt.Println("Nothing to do")
+	}
+
+	if len(plan.Conflicts) > 0 {
+		fmt.Println("Conflicts:")
+		for _, conflict := range plan.Conflicts {
+			fmt.Printf("  %s\n", conflict)
+		}
+	}
+
+	for _, warning := range plan.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+
+	sign := "+"
+	delta := plan.InstalledSizeDelta
+	if delta < 0 {
+		sign, delta = "-", -delta
+	}
+	fmt.Printf("Download size: %s\n", formatSize(plan.DownloadSize))
+	fmt.Printf("Installed size change: %s%s\n", sign, formatSize(delta))
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package ipkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// PackageInfo describes a package as seen in the repositories and the local database
+type PackageInfo struct {
+	IndexEntry
+	Installed        bool   `json:"installed"`
+	InstalledVersion string `json:"installed_version,omitempty"`
+	InstalledFiles   int    `json:"installed_files,omitempty"`
+	Held             bool   `json:"held,omitempty"`
+	Pin              string `json:"pin,omitempty"`
+}
+
+// FileOwner records which installed package provides a path
+type FileOwner struct {
+	Path    string `json:"path"`
+	Package string `json:"package"`
+	Version string `json:"version"`
+}
+
+// Search lists repository packages whose name or description matches pattern
+func (pm *PackageManager) Search(pattern string, asJSON bool) error {
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return fmt.Errorf("invalid search pattern: %w", err)
+	}
+
+	entries, err := pm.loadIndex()
+	if err != nil {
+		return err
+	}
+
+	matches := []IndexEntry{}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if seen[entry.Name] {
+			continue
+		}
+		if re.MatchString(entry.Name) || re.MatchString(entry.Description) {
+			matches = append(matches, entry)
+			seen[entry.Name] = true
+		}
+	}
+
+	if asJSON {
+		return printJSON(matches)
+	}
+
+	if len(matches) == 0 {
+		fmt.Printf("No packages matching '%s'\n", pattern)
+		return nil
+	}
+
+	for _, entry := range matches {
+		fmt.Printf("%s-%s - %s\n", entry.Name, entry.Version, entry.Description)
+	}
+
+	return nil
+}
+
+// Info shows repository metadata and install state for a package
+func (pm *PackageManager) Info(pkgName string, asJSON bool) error {
+	pkgName = pm.resolvePackageName(pkgName)
+
+	installed, err := pm.findInstalled(pkgName)
+	if err != nil {
+		return err
+	}
+
+	info := PackageInfo{}
+	entry, indexErr := pm.lookupIndex(pkgName)
+	if entry != nil {
+		info.IndexEntry = *entry
+	} else if installed != nil {
+		info.Name = installed.Name
+		info.Version = installed.Version
+		info.Description = installed.Description
+	} else {
+		return indexErr
+	}
+
+	if installed != nil {
+		info.Installed = true
+		info.InstalledVersion = installed.Version
+		info.InstalledFiles = len(installed.Files)
+		info.Held = installed.Held
+		info.Pin = installed.Pin
+	}
+
+	if asJSON {
+		return printJSON(info)
+	}
+
+	fmt.Printf("Name:           %s\n", info.Name)
+	fmt.Printf("Version:        %s\n", info.Version)
+	fmt.Printf("Description:    %s\n", info.Description)
+	if info.URL != "" {
+		fmt.Printf("URL:            %s\n", info.URL)
+	}
+	if info.License != "" {
+		fmt.Printf("License:        %s\n", info.License)
+	}
+	if info.Repository != "" {
+		fmt.Printf("Repository:     %s\n", info.Repository)
+		fmt.Printf("Download size:  %s\n", formatSize(info.Size))
+		fmt.Printf("Installed size: %s\n", formatSize(info.InstalledSize))
+	}
+	if len(info.Depends) > 0 {
+		fmt.Printf("Depends:        %s\n", strings.Join(info.Depends, " "))
+	}
+	if info.Installed {
+		fmt.Printf("Installed:      yes (%s, %d files)\n", info.InstalledVersion, info.InstalledFiles)
+		if info.Pin != "" {
+			fmt.Printf("Pinned to:      @%s\n", info.Pin)
+		}
+		if info.Held {
+			fmt.Printf("Held:           yes\n")
+		}
+	} else {
+		fmt.Printf("Installed:      no\n")
+	}
+
+	return nil
+}
+
+// Files lists the files installed by a package
+func (pm *PackageManager) Files(pkgName string, asJSON bool) error {
+	pkgName = pm.resolvePackageName(pkgName)
+
+	pkg, err := pm.findInstalled(pkgName)
+	if err != nil {
+		return err
+	}
+	if pkg == nil {
+		return fmt.Errorf("package %s is not installed", pkgName)
+	}
+
+	files := make([]string, 0, len(pkg.Files))
+	for _, file := range pkg.Files {
+		files = append(files, "/"+file)
+	}
+
+	if asJSON {
+		return printJSON(files)
+	}
+
+	if len(files) == 0 {
+		fmt.Printf("No file list recorded for %s\n", pkgName)
+		return nil
+	}
+
+	for _, file := range files {
+		fmt.Println(file)
+	}
+
+	return nil
+}
+
+// Owns reports which installed package provides path. The path is
+// interpreted relative to the environment root.
+func (pm *PackageManager) Owns(path string, asJSON bool) error {
+	target := strings.TrimPrefix(filepath.Clean("/"+path), "/")
+
+	if err := pm.ensureDB(); err != nil {
+		return err
+	}
+
+	packages, err := pm.getInstalled()
+	if err != nil {
+		return err
+	}
+
+	for _, pkg := range packages {
+		for _, file := range pkg.Files {
+			if filepath.Clean(file) != target {
+				continue
+			}
+
+			owner := FileOwner{Path: "/" + target, Package: pkg.Name, Version: pkg.Version}
+			if asJSON {
+				return printJSON(owner)
+			}
+			fmt.Printf("%s is owned by %s-%s\n", owner.Path, owner.Package, owner.Version)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no installed package owns /%s", target)
+}
+
+// findInstalled returns the database record for pkgName, or nil if it is not installed
+func (pm *PackageManager) findInstalled(pkgName string) (*Package, error) {
+	if err := pm.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	packages, err := pm.getInstalled()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range packages {
+		if packages[i].Name == pkgName {
+			return &packages[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,212 @@
+package ipkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultMirror = "https://dl-cdn.alpinelinux.org/alpine"
+	DefaultBranch = "v3.18"
+)
+
+// Repository is a package repository reachable through one or more mirrors.
+// URLs point at the repository directory (e.g. .../alpine/v3.18/main) and
+// are tried in order until one responds. Packages from a tagged repository
+// are only installed when pinned to its tag, as in "go@edge".
+type Repository struct {
+	URLs     []string `json:"urls"`
+	Priority int      `json:"priority"`
+	Tag      string   `json:"tag,omitempty"`
+}
+
+// ArchURLs returns the directory of arch on every mirror, with a trailing slash
+func (r *Repository) ArchURLs(arch string) []string {
+	urls := make([]string, 0, len(r.URLs))
+	for _, url := range r.URLs {
+		urls = append(urls, strings.TrimSuffix(url, "/")+"/"+arch+"/")
+	}
+	return urls
+}
+
+// String returns the primary URL of the repository
+func (r *Repository) String() string {
+	if len(r.URLs) == 0 {
+		return ""
+	}
+	return r.URLs[0]
+}
+
+// NormalizeBranch turns user input like "3.20" into a branch name like "v3.20"
+func NormalizeBranch(version string) string {
+	if version == "" {
+		return DefaultBranch
+	}
+	if version[0] >= '0' && version[0] <= '9' {
+		return "v" + version
+	}
+	return version
+}
+
+// DefaultRepositories returns the main and community repositories of branch
+func DefaultRepositories(branch string) []Repository {
+	return []Repository{
+		{URLs: []string{fmt.Sprintf("%s/%s/main", DefaultMirror, branch)}},
+		{URLs: []string{fmt.Sprintf("%s/%s/community", DefaultMirror, branch)}},
+	}
+}
+
+// GlobalRepositoriesPath returns the host-wide repositories file
+func GlobalRepositoriesPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "isobox", "repositories")
+}
+
+// EnvRepositoriesPath returns the repositories file of the environment at rootfs
+func EnvRepositoriesPath(rootfs string) string {
+	return filepath.Join(rootfs, "etc/isobox/repositories")
+}
+
+// LoadRepositories returns the repositories for the environment at rootfs.
+// /etc/apk/repositories wins when it was edited for apk since ipkg wrote it;
+// otherwise the environment's /etc/isobox/repositories wins over the global
+// ~/.config/isobox/repositories, which wins over the built-in defaults.
+// {branch} in URLs is replaced with branch.
+func LoadRepositories(rootfs, branch string) ([]Repository, error) {
+	if data, modified := apkModified(rootfs, apkRepositoriesPath); modified {
+		repos, err := ParseRepositories(bytes.NewReader(data), branch)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", filepath.Join(rootfs, apkRepositoriesPath), err)
+		}
+		if len(repos) > 0 {
+			return repos, nil
+		}
+	}
+
+	for _, path := range []string{EnvRepositoriesPath(rootfs), GlobalRepositoriesPath()} {
+		if path == "" {
+			continue
+		}
+
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		repos, err := ParseRepositories(file, branch)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if len(repos) > 0 {
+			return repos, nil
+		}
+	}
+
+	return DefaultRepositories(branch), nil
+}
+
+// ParseRepositories reads a repositories file. Each line holds an optional
+// integer priority and an optional @tag, followed by one or more mirror
+// URLs of the same repository:
+//
+//	# priority  [@tag] url [mirror...]
+//	100 https://mirror.internal/alpine/{branch}/main https://dl-cdn.alpinelinux.org/alpine/{branch}/main
+//	https://dl-cdn.alpinelinux.org/alpine/{branch}/community
+//	-10 @edge https://dl-cdn.alpinelinux.org/alpine/edge/community
+//
+// Repositories are returned highest priority first, keeping file order for ties.
+func ParseRepositories(r io.Reader, branch string) ([]Repository, error) {
+	var repos []Repository
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		repo := Repository{}
+		if priority, err := strconv.Atoi(fields[0]); err == nil {
+			repo.Priority = priority
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+			repo.Tag = strings.TrimPrefix(fields[0], "@")
+			fields = fields[1:]
+		}
+
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: missing repository URL", lineNo)
+		}
+
+		for _, url := range fields {
+			repo.URLs = append(repo.URLs, strings.ReplaceAll(url, "{branch}", branch))
+		}
+		repos = append(repos, repo)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(repos, func(i, j int) bool {
+		return repos[i].Priority > repos[j].Priority
+	})
+
+	return repos, nil
+}
+
+// WriteRepositories saves repos to path in the format read by ParseRepositories
+func WriteRepositories(path string, repos []Repository) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString("# IsoBox package repositories\n")
+	b.WriteString("# priority  [@tag] url [mirror...]\n")
+	for _, repo := range repos {
+		if repo.Tag != "" {
+			fmt.Fprintf(&b, "%d @%s %s\n", repo.Priority, repo.Tag, strings.Join(repo.URLs, " "))
+			continue
+		}
+		fmt.Fprintf(&b, "%d %s\n", repo.Priority, strings.Join(repo.URLs, " "))
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// environmentBranch reads the Alpine branch recorded in the environment's config.json
+func environmentBranch(rootfs string) string {
+	data, err := os.ReadFile(filepath.Join(rootfs, "config.json"))
+	if err != nil {
+		return DefaultBranch
+	}
+
+	var config struct {
+		AlpineVersion string `json:"alpine_version"`
+	}
+	if json.Unmarshal(data, &config) != nil {
+		return DefaultBranch
+	}
+
+	return NormalizeBranch(config.AlpineVersion)
+}
@@ -0,0 +1,502 @@
+package ipkg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats accepted by SBOM
+const (
+	SBOMFormatSPDX      = "spdx-json"
+	SBOMFormatCycloneDX = "cyclonedx-json"
+)
+
+// sbomPackage is an installed package with the installed packages it
+// depends on
+type sbomPackage struct {
+	Package
+	purl      string
+	sha256    string
+	dependsOn []string
+}
+
+// SBOM describes the installed packages of the environment as a software
+// bill of materials in format: every package with its version, license,
+// origin and checksums, and which packages depend on which. Dependencies
+// are resolved against the installed packages, by name and by what they
+// provide.
+func (pm *PackageManager) SBOM(format string) ([]byte, error) {
+	if format != SBOMFormatSPDX && format != SBOMFormatCycloneDX {
+		return nil, fmt.Errorf("unknown SBOM format %s (known: %s, %s)", format, SBOMFormatSPDX, SBOMFormatCycloneDX)
+	}
+
+	if err := pm.ensureDB(); err != nil {
+		return nil, err
+	}
+	installed, err := pm.getInstalled()
+	if err != nil {
+		return nil, err
+	}
+
+	packages := pm.sbomPackages(installed)
+	name := environmentName(pm.rootfs)
+
+	var doc any
+	if format == SBOMFormatSPDX {
+		doc = spdxDocument(name, packages)
+	} else {
+		doc = cyclonedxDocument(name, packages)
+	}
+
+	// Package URLs hold '&', which would otherwise be escaped
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// sbomPackages sorts the installed packages by name and resolves their
+// dependencies to installed package names
+func (pm *PackageManager) sbomPackages(installed []Package) []sbomPackage {
+	providers := make(map[string]string)
+	for _, pkg := range installed {
+		for _, provide := range pkg.Provides {
+			name := dependencyName(provide)
+			if _, ok := providers[name]; !ok {
+				providers[name] = pkg.Name
+			}
+		}
+	}
+	for _, pkg := range installed {
+		providers[pkg.Name] = pkg.Name
+	}
+
+	branch := pm.branch
+	if branch == "" {
+		branch = environmentBranch(pm.rootfs)
+	}
+	distro := "alpine-" + strings.TrimPrefix(branch, "v")
+
+	cache, err := OpenPackageCache()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "  Warning: package cache unavailable, packages are listed without file checksums: %v\n", err)
+	}
+
+	var packages []sbomPackage
+	for _, pkg := range installed {
+		sp := sbomPackage{Package: pkg}
+
+		arch := pkg.Arch
+		if arch == "" {
+			arch = pm.architecture()
+		}
+		sp.purl = fmt.Sprintf("pkg:apk/alpine/%s@%s?arch=%s&distro=%s",
+			url.PathEscape(pkg.Name), url.PathEscape(pkg.Version), arch, distro)
+
+		// The apk checksum identifies the package but hashes only part of
+		// it, so the package file is hashed when the cache still has it
+		if cache != nil {
+			if path, ok := cache.Lookup(pkg.Checksum); ok {
+				if sum, err := fileChecksum(path); err == nil {
+					sp.sha256 = sum
+				}
+			}
+		}
+
+		seen := make(map[string]bool)
+		for _, dep := range pkg.Depends {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			name := dependencyName(dep)
+			target, ok := providers[name]
+			if !ok {
+				target, ok = soLibraryMap[name]
+			}
+			if ok && target != pkg.Name && !seen[target] {
+				seen[target] = true
+				sp.dependsOn = append(sp.dependsOn, target)
+			}
+		}
+		sort.Strings(sp.dependsOn)
+
+		packages = append(packages, sp)
+	}
+
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Name < packages[j].Name })
+	return packages
+}
+
+// environmentName returns the name of the environment at rootfs: the base
+// name of the directory it was created in
+func environmentName(rootfs string) string {
+	data, err := os.ReadFile(filepath.Join(rootfs, "config.json"))
+	if err != nil {
+		return "isobox"
+	}
+
+	var config struct {
+		Root string `json:"root"`
+	}
+	if json.Unmarshal(data, &config) != nil || config.Root == "" {
+		return "isobox"
+	}
+	return filepath.Base(config.Root)
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// SPDX 2.3
+
+type spdxDoc struct {
+	SPDXVersion       string                 `json:"spdxVersion"`
+	DataLicense       string                 `json:"dataLicense"`
+	SPDXID            string                 `json:"SPDXID"`
+	Name              string                 `json:"name"`
+	DocumentNamespace string                 `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo       `json:"creationInfo"`
+	Packages          []spdxPackage          `json:"packages"`
+	Relationships     []spdxRelationship     `json:"relationships"`
+	ExtractedLicenses []spdxExtractedLicense `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo"`
+	Supplier         string            `json:"supplier"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Homepage         string            `json:"homepage,omitempty"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	Summary          string            `json:"summary,omitempty"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxExtractedLicense struct {
+	LicenseID     string `json:"licenseId"`
+	Name          string `json:"name"`
+	ExtractedText string `json:"extractedText"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxLicense turns an Alpine license field into an SPDX license
+// expression. Identifiers Alpine uses that SPDX does not know, such as
+// "custom" or "custom:multiple", become LicenseRef- identifiers, which are
+// returned with the text they stand for. A field that is not an expression
+// at all becomes NOASSERTION.
+func spdxLicense(license string) (string, map[string]string) {
+	if license == "" {
+		return "NOASSERTION", nil
+	}
+
+	refs := make(map[string]string)
+	var tokens []string
+	depth := 0
+	expectID := true
+	fields := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(license))
+	for _, token := range fields {
+		switch upper := strings.ToUpper(token); {
+		case token == "(":
+			if !expectID {
+				return "NOASSERTION", nil
+			}
+			depth++
+		case token == ")":
+			if expectID || depth == 0 {
+				return "NOASSERTION", nil
+			}
+			depth--
+		case upper == "AND" || upper == "OR" || upper == "WITH":
+			if expectID {
+				return "NOASSERTION", nil
+			}
+			token = upper
+			expectID = true
+		default:
+			if !expectID {
+				return "NOASSERTION", nil
+			}
+			if !spdxIdentifier(token) || token == "custom" {
+				ref := "LicenseRef-" + spdxIDString(token)
+				refs[ref] = token
+				token = ref
+			}
+			expectID = false
+		}
+		tokens = append(tokens, token)
+	}
+	if expectID || depth != 0 {
+		return "NOASSERTION", nil
+	}
+
+	expression := strings.NewReplacer("( ", "(", " )", ")").Replace(strings.Join(tokens, " "))
+	return expression, refs
+}
+
+// spdxIdentifier reports whether id has the form of an SPDX license
+// identifier: letters, digits, dots, dashes and a trailing plus
+func spdxIdentifier(id string) bool {
+	id = strings.TrimSuffix(id, "+")
+	return id != "" && !strings.HasPrefix(id, "LicenseRef-") && spdxIDString(id) == id
+}
+
+// spdxIDString replaces the characters SPDX identifiers may not hold
+func spdxIDString(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// spdxID turns a package name into an SPDX identifier, which may only hold
+// letters, digits, dots and dashes
+func spdxID(name string) string {
+	return "SPDXRef-Package-" + spdxIDString(name)
+}
+
+func spdxDocument(name string, packages []sbomPackage) spdxDoc {
+	doc := spdxDoc{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://github.com/javanhut/isobox/spdx/%s-%s", url.PathEscape(name), newUUID()),
+		CreationInfo: spdxCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: isobox"},
+		},
+		Packages:      []spdxPackage{},
+		Relationships: []spdxRelationship{},
+	}
+
+	extracted := make(map[string]string)
+	for _, pkg := range packages {
+		license, refs := spdxLicense(pkg.License)
+		for ref, text := range refs {
+			extracted[ref] = text
+		}
+
+		sp := spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           spdxID(pkg.Name),
+			VersionInfo:      pkg.Version,
+			Supplier:         "Organization: Alpine Linux",
+			DownloadLocation: "NOASSERTION",
+			Homepage:         pkg.URL,
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  license,
+			CopyrightText:    "NOASSERTION",
+			Summary:          pkg.Description,
+			ExternalRefs: []spdxExternalRef{
+				{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: pkg.purl},
+			},
+		}
+		if pkg.Checksum != "" {
+			sp.ExternalRefs = append(sp.ExternalRefs, spdxExternalRef{ReferenceCategory: "OTHER", ReferenceType: "apk-checksum", ReferenceLocator: pkg.Checksum})
+		}
+		if pkg.Origin != "" {
+			sp.SourceInfo = "built from the " + pkg.Origin + " source package"
+		}
+		if pkg.sha256 != "" {
+			sp.Checksums = []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: pkg.sha256}}
+		}
+		doc.Packages = append(doc.Packages, sp)
+
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      doc.SPDXID,
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: sp.SPDXID,
+		})
+		for _, dep := range pkg.dependsOn {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				SPDXElementID:      sp.SPDXID,
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: spdxID(dep),
+			})
+		}
+	}
+
+	refs := make([]string, 0, len(extracted))
+	for ref := range extracted {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		doc.ExtractedLicenses = append(doc.ExtractedLicenses, spdxExtractedLicense{
+			LicenseID:     ref,
+			Name:          extracted[ref],
+			ExtractedText: fmt.Sprintf("The license Alpine Linux records as %q for the package", extracted[ref]),
+		})
+	}
+
+	return doc
+}
+
+// CycloneDX 1.5
+
+type cdxDoc struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type               string        `json:"type"`
+	BOMRef             string        `json:"bom-ref,omitempty"`
+	Name               string        `json:"name"`
+	Version            string        `json:"version,omitempty"`
+	Description        string        `json:"description,omitempty"`
+	Licenses           []cdxLicense  `json:"licenses,omitempty"`
+	Hashes             []cdxHash     `json:"hashes,omitempty"`
+	PURL               string        `json:"purl,omitempty"`
+	ExternalReferences []cdxExtRef   `json:"externalReferences,omitempty"`
+	Properties         []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxLicense struct {
+	License cdxLicenseName `json:"license"`
+}
+
+type cdxLicenseName struct {
+	Name string `json:"name"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxExtRef struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+func cyclonedxDocument(name string, packages []sbomPackage) cdxDoc {
+	doc := cdxDoc{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     cdxTools{Components: []cdxComponent{{Type: "application", Name: "isobox"}}},
+			Component: cdxComponent{Type: "container", BOMRef: "environment", Name: name},
+		},
+		Components:   []cdxComponent{},
+		Dependencies: []cdxDependency{},
+	}
+
+	purls := make(map[string]string)
+	for _, pkg := range packages {
+		purls[pkg.Name] = pkg.purl
+	}
+
+	environment := cdxDependency{Ref: "environment", DependsOn: []string{}}
+	for _, pkg := range packages {
+		component := cdxComponent{
+			Type:        "library",
+			BOMRef:      pkg.purl,
+			Name:        pkg.Name,
+			Version:     pkg.Version,
+			Description: pkg.Description,
+			PURL:        pkg.purl,
+		}
+		if pkg.License != "" {
+			component.Licenses = []cdxLicense{{License: cdxLicenseName{Name: pkg.License}}}
+		}
+		if pkg.sha256 != "" {
+			component.Hashes = []cdxHash{{Alg: "SHA-256", Content: pkg.sha256}}
+		}
+		if pkg.URL != "" {
+			component.ExternalReferences = []cdxExtRef{{Type: "website", URL: pkg.URL}}
+		}
+		if pkg.Origin != "" {
+			component.Properties = append(component.Properties, cdxProperty{Name: "alpine:origin", Value: pkg.Origin})
+		}
+		if pkg.Checksum != "" {
+			component.Properties = append(component.Properties, cdxProperty{Name: "alpine:checksum", Value: pkg.Checksum})
+		}
+		doc.Components = append(doc.Components, component)
+
+		environment.DependsOn = append(environment.DependsOn, pkg.purl)
+		dependency := cdxDependency{Ref: pkg.purl, DependsOn: []string{}}
+		for _, dep := range pkg.dependsOn {
+			dependency.DependsOn = append(dependency.DependsOn, purls[dep])
+		}
+		doc.Dependencies = append(doc.Dependencies, dependency)
+	}
+	doc.Dependencies = append([]cdxDependency{environment}, doc.Dependencies...)
+
+	return doc
+}
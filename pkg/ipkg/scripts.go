@@ -0,0 +1,266 @@
+package ipkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Install scripts carried in the control stream of an APK
+const (
+	scriptPreInstall    = ".pre-install"
+	scriptPostInstall   = ".post-install"
+	scriptPreUpgrade    = ".pre-upgrade"
+	scriptPostUpgrade   = ".post-upgrade"
+	scriptPreDeinstall  = ".pre-deinstall"
+	scriptPostDeinstall = ".post-deinstall"
+	scriptTrigger       = ".trigger"
+)
+
+var scriptNames = []string{
+	scriptPreInstall,
+	scriptPostInstall,
+	scriptPreUpgrade,
+	scriptPostUpgrade,
+	scriptPreDeinstall,
+	scriptPostDeinstall,
+	scriptTrigger,
+}
+
+// readScripts returns the install scripts of an APK keyed by name
+func readScripts(apkFile string) (map[string][]byte, error) {
+	if isADB(apkFile) {
+		pkg, err := readPackageADB(apkFile)
+		if err != nil {
+			return nil, err
+		}
+		return pkg.scripts(), nil
+	}
+
+	file, err := os.Open(apkFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	scripts := make(map[string][]byte)
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The control entries come first; stop at the package contents
+		if !strings.HasPrefix(header.Name, ".") {
+			break
+		}
+
+		for _, name := range scriptNames {
+			if header.Name == name {
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, err
+				}
+				scripts[name] = data
+			}
+		}
+	}
+
+	return scripts, nil
+}
+
+// scriptsDir holds the scripts of installed packages, which are needed
+// again on removal and when triggers fire
+func (pm *PackageManager) scriptsDir() string {
+	return filepath.Join(filepath.Dir(pm.db), "scripts")
+}
+
+// scriptPath returns where script of an installed package is kept
+func (pm *PackageManager) scriptPath(pkgName, script string) string {
+	return filepath.Join(pm.scriptsDir(), pkgName+script)
+}
+
+// savedScript returns a stored script of an installed package, or nil
+func (pm *PackageManager) savedScript(pkgName, script string) []byte {
+	data, err := os.ReadFile(pm.scriptPath(pkgName, script))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// runScript runs a package script inside the box with args as its
+// arguments. From the host it runs as root through chroot; inside the box
+// it runs as the user running isobox, normally the box user, so scripts
+// that add users or change ownership may fail there. Its output is
+// captured and shown indented under the package. A script that cannot be
+// started at all (for example because chroot is unavailable) only produces
+// a warning. Nothing runs when NoScripts is set.
+func (pm *PackageManager) runScript(pkgName, script string, data []byte, args ...string) error {
+	if len(data) == 0 || pm.NoScripts {
+		return nil
+	}
+
+	if pm.rootfs == "/" && os.Geteuid() != 0 && !pm.warnedUser {
+		pm.warnedUser = true
+		fmt.Fprintf(os.Stderr, "  Warning: package scripts run as uid %d, not root, inside the box; scripts that need root may fail (install from the host with 'isobox pkg install' to run them as root)\n", os.Geteuid())
+	}
+
+	// Scripts are run from the box's /tmp so the same path works inside the chroot
+	tmpDir := filepath.Join(pm.rootfs, "tmp")
+	os.MkdirAll(tmpDir, 01777)
+	name := fmt.Sprintf(".ipkg-%s%s", pkgName, script)
+	if err := os.WriteFile(filepath.Join(tmpDir, name), data, 0755); err != nil {
+		return fmt.Errorf("write %s script of %s: %w", script, pkgName, err)
+	}
+	defer os.Remove(filepath.Join(tmpDir, name))
+
+	scriptArgs := append([]string{"/bin/sh", "/tmp/" + name}, args...)
+	if pm.rootfs != "/" {
+		scriptArgs = append([]string{"chroot", pm.rootfs}, scriptArgs...)
+		if os.Geteuid() != 0 {
+			scriptArgs = append([]string{"sudo"}, scriptArgs...)
+		}
+	}
+
+	fmt.Printf("  Running %s script of %s...\n", strings.TrimPrefix(script, "."), pkgName)
+
+	cmd := exec.CommandContext(pm.context(), scriptArgs[0], scriptArgs[1:]...)
+	cmd.Dir = "/"
+	cmd.Env = []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=/root",
+	}
+	output, err := cmd.CombinedOutput()
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fmt.Printf("    %s\n", scanner.Text())
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		fmt.Fprintf(os.Stderr, "  Warning: cannot run %s script of %s: %v\n", script, pkgName, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s script of %s failed: %w", script, pkgName, err)
+	}
+
+	return nil
+}
+
+// RunSkippedScripts runs the post-install scripts that were skipped while
+// NoScripts was set, in install order, once the rootfs is complete enough
+// to run them. A failing script does not stop the others; the failures
+// are returned together.
+func (pm *PackageManager) RunSkippedScripts(ctx context.Context) error {
+	pm.ctx = ctx
+	tx, err := pm.begin()
+	if err != nil {
+		return err
+	}
+	failed, err := pm.runSkippedScripts()
+	if err := tx.finish(err); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("post-install scripts failed for: %s", strings.Join(failed, " "))
+	}
+	return nil
+}
+
+// runSkippedScripts runs the pending post-install scripts and returns the
+// packages whose script failed. The scripts are marked as run either way,
+// so the transaction records that they were attempted.
+func (pm *PackageManager) runSkippedScripts() ([]string, error) {
+	var pending []Package
+	for _, pkg := range pm.tx.packages {
+		if pkg.ScriptPending {
+			pending = append(pending, pkg)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	fmt.Printf("Running %d deferred post-install scripts...\n", len(pending))
+	var failed []string
+	for _, pkg := range pending {
+		if err := pm.context().Err(); err != nil {
+			return nil, err
+		}
+		pm.tx.setScriptPending(pkg.Name, false)
+		if err := pm.runScript(pkg.Name, scriptPostInstall, pm.savedScript(pkg.Name, scriptPostInstall), pkg.Version); err != nil {
+			fmt.Fprintf(os.Stderr, "  Warning: %v\n", err)
+			failed = append(failed, pkg.Name)
+		}
+	}
+	return failed, nil
+}
+
+// runTriggers runs the trigger script of every installed package whose
+// trigger paths match a directory changed by the transaction. Each script
+// gets the matching directories as arguments.
+func (tx *transaction) runTriggers(changed []string) {
+	if len(changed) == 0 {
+		return
+	}
+
+	dirs := make(map[string]bool)
+	var dirList []string
+	for _, path := range changed {
+		rel, err := filepath.Rel(tx.pm.rootfs, path)
+		if err != nil {
+			continue
+		}
+		dir := "/" + filepath.Dir(rel)
+		if !dirs[dir] {
+			dirs[dir] = true
+			dirList = append(dirList, dir)
+		}
+	}
+
+	for _, pkg := range tx.packages {
+		if len(pkg.Triggers) == 0 {
+			continue
+		}
+
+		var matched []string
+		for _, dir := range dirList {
+			for _, pattern := range pkg.Triggers {
+				if ok, _ := filepath.Match(pattern, dir); ok {
+					matched = append(matched, dir)
+					break
+				}
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		script := tx.pm.savedScript(pkg.Name, scriptTrigger)
+		if err := tx.pm.runScript(pkg.Name, scriptTrigger, script, matched...); err != nil {
+			fmt.Fprintf(os.Stderr, "  Warning: %v\n", err)
+		}
+	}
+}
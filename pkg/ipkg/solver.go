@@ -0,0 +1,425 @@
+package ipkg
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// maxDownloadWorkers bounds the number of packages downloaded at once
+const maxDownloadWorkers = 8
+
+// resolver computes an install plan from the repository index: the
+// requested packages and all their missing dependencies, ordered so that
+// every package comes after its dependencies
+type resolver struct {
+	byName    map[string]*IndexEntry
+	providers map[string]*IndexEntry
+	tagged    map[string]map[string]*IndexEntry
+	pins      map[string]string
+	installed map[string]bool
+	visited   map[string]bool
+	plan      []*IndexEntry
+
+	// versions and held describe the installed packages
+	versions map[string]string
+	held     map[string]bool
+
+	// upgrading maps the installed packages the plan replaces with a newer
+	// version to the version installed now
+	upgrading map[string]string
+
+	// excludes holds the "!name" dependencies of planned packages
+	excludes [][2]string
+	missing  []string
+
+	// blocked holds the dependencies that only a change to a held
+	// package could satisfy
+	blocked []PlanConflict
+}
+
+func (pm *PackageManager) newResolver() (*resolver, error) {
+	entries, err := pm.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	packages, err := pm.getInstalled()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &resolver{
+		byName:    make(map[string]*IndexEntry),
+		providers: make(map[string]*IndexEntry),
+		tagged:    make(map[string]map[string]*IndexEntry),
+		pins:      make(map[string]string),
+		installed: make(map[string]bool),
+		visited:   make(map[string]bool),
+		versions:  make(map[string]string),
+		held:      make(map[string]bool),
+		upgrading: make(map[string]string),
+	}
+
+	// Entries are in repository priority order, so the first repository
+	// wins; within a repository carrying several versions, the newest does.
+	// Tagged repositories are kept apart and only used for pinned packages.
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Tag != "" {
+			tagged, ok := r.tagged[entry.Tag]
+			if !ok {
+				tagged = make(map[string]*IndexEntry)
+				r.tagged[entry.Tag] = tagged
+			}
+			for _, name := range append([]string{entry.Name}, entry.Provides...) {
+				if existing, ok := tagged[dependencyName(name)]; !ok || newerInRepository(entry, existing) {
+					tagged[dependencyName(name)] = entry
+				}
+			}
+			continue
+		}
+		if existing, ok := r.byName[entry.Name]; !ok || newerInRepository(entry, existing) {
+			r.byName[entry.Name] = entry
+		}
+		for _, provide := range entry.Provides {
+			name := dependencyName(provide)
+			if _, ok := r.providers[name]; !ok {
+				r.providers[name] = entry
+			}
+		}
+	}
+
+	for _, pkg := range packages {
+		r.installed[pkg.Name] = true
+		r.versions[pkg.Name] = pkg.Version
+		r.held[pkg.Name] = pkg.Held
+	}
+
+	return r, nil
+}
+
+// newerInRepository reports whether entry is a newer version of the same
+// package as existing, from the same repository
+func newerInRepository(entry, existing *IndexEntry) bool {
+	return entry.Name == existing.Name && entry.Repository == existing.Repository &&
+		compareVersions(entry.Version, existing.Version) > 0
+}
+
+// dependencyName strips the version constraint from a dependency or
+// provides entry like "so:libz.so.1=1.3-r0" or "python3>=3.11"
+func dependencyName(dep string) string {
+	if i := strings.IndexAny(dep, "=<>~"); i >= 0 {
+		dep = dep[:i]
+	}
+	return strings.TrimSpace(dep)
+}
+
+// splitPin splits a requested package like "go@edge" into its name and
+// repository tag
+func splitPin(name string) (string, string) {
+	if i := strings.LastIndex(name, "@"); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// lookup finds the package that satisfies a dependency name, either by
+// package name or by what packages provide (so:, cmd:, pc: names). With a
+// tag, the repositories carrying that tag are searched first.
+func (r *resolver) lookup(name, tag string) *IndexEntry {
+	if entry, ok := r.tagged[tag][name]; ok {
+		return entry
+	}
+	if entry, ok := r.byName[name]; ok {
+		return entry
+	}
+	if entry, ok := r.providers[name]; ok {
+		return entry
+	}
+	if mapped, ok := soLibraryMap[name]; ok {
+		return r.byName[mapped]
+	}
+	return nil
+}
+
+// candidate returns the index entry of the package named name, from the
+// repositories tagged tag if it is pinned, or nil if the index has none
+func (r *resolver) candidate(name, tag string) *IndexEntry {
+	if tag != "" {
+		if entry, ok := r.tagged[tag][name]; ok && entry.Name == name {
+			return entry
+		}
+	}
+	return r.byName[name]
+}
+
+// require adds the package satisfying dep to the plan. A missing package is
+// an error for a requested package and is recorded in missing for a
+// dependency of neededBy. Requested packages may be pinned to a repository
+// tag ("go@edge"); the pin carries over to their dependencies.
+func (r *resolver) require(dep, neededBy string) error {
+	// File dependencies are not resolved
+	if dep == "" || strings.HasPrefix(dep, "/") {
+		return nil
+	}
+
+	if strings.HasPrefix(dep, "!") {
+		if neededBy != "" {
+			r.excludes = append(r.excludes, [2]string{neededBy, dependencyName(dep[1:])})
+		}
+		return nil
+	}
+
+	tag := r.pins[neededBy]
+	if neededBy == "" {
+		dep, tag = splitPin(dep)
+		if _, ok := r.tagged[tag]; tag != "" && !ok {
+			return fmt.Errorf("no repository is tagged @%s", tag)
+		}
+	}
+
+	name := dependencyName(dep)
+	entry := r.lookup(name, tag)
+	if entry == nil {
+		if neededBy == "" {
+			return fmt.Errorf("package %s not found in repositories", name)
+		}
+		r.missing = append(r.missing, fmt.Sprintf("no package provides %s (needed by %s)", name, neededBy))
+		return nil
+	}
+
+	if neededBy == "" && tag != "" && entry.Tag != tag {
+		return fmt.Errorf("package %s not found in repositories tagged @%s", name, tag)
+	}
+	if tag != "" && r.pins[entry.Name] == "" {
+		r.pins[entry.Name] = tag
+	}
+	if r.installed[entry.Name] && neededBy != "" {
+		r.checkInstalled(entry, dep, neededBy)
+	}
+	r.visit(entry)
+	return nil
+}
+
+// checkInstalled handles an installed package whose version does not meet
+// the version constraint of dep. If the package is held, the hold blocks
+// the plan; if entry, its version in the index, meets the constraint, the
+// package is upgraded to it. Otherwise the dependency stays unresolved.
+func (r *resolver) checkInstalled(entry *IndexEntry, dep, neededBy string) {
+	pkgName := entry.Name
+	name, op, want := splitConstraint(dep)
+	if op == "" || name != pkgName || satisfiesVersion(r.versions[pkgName], op, want) {
+		return
+	}
+	if r.held[pkgName] {
+		r.blocked = append(r.blocked, PlanConflict{
+			Package: pkgName,
+			With:    neededBy,
+			Reason:  fmt.Sprintf("is held at %s, but %s is needed by", r.versions[pkgName], dep),
+		})
+		return
+	}
+	if _, ok := r.upgrading[pkgName]; !ok && satisfiesVersion(entry.Version, op, want) && compareVersions(entry.Version, r.versions[pkgName]) > 0 {
+		r.upgrading[pkgName] = r.versions[pkgName]
+		r.versions[pkgName] = entry.Version
+		return
+	}
+	r.missing = append(r.missing, fmt.Sprintf("installed %s %s does not satisfy %s (needed by %s)", pkgName, r.versions[pkgName], dep, neededBy))
+}
+
+// visit adds entry after its dependencies, unless it is already installed
+// and not being upgraded
+func (r *resolver) visit(entry *IndexEntry) {
+	if _, upgrading := r.upgrading[entry.Name]; r.visited[entry.Name] || r.installed[entry.Name] && !upgrading {
+		return
+	}
+	r.visited[entry.Name] = true
+
+	for _, dep := range entry.Depends {
+		r.require(dep, entry.Name)
+	}
+
+	r.plan = append(r.plan, entry)
+}
+
+// conflicts returns the planned packages that declare a conflict with an
+// installed or planned package, and the held packages that block the plan
+func (r *resolver) conflicts() []PlanConflict {
+	planned := make(map[string]bool)
+	for _, entry := range r.plan {
+		planned[entry.Name] = true
+	}
+
+	conflicts := append([]PlanConflict(nil), r.blocked...)
+	for _, exclude := range r.excludes {
+		pkgName, other := exclude[0], exclude[1]
+		switch {
+		case r.held[other]:
+			conflicts = append(conflicts, PlanConflict{Package: pkgName, With: other, Reason: "conflicts with held package"})
+		case r.installed[other]:
+			conflicts = append(conflicts, PlanConflict{Package: pkgName, With: other, Reason: "conflicts with installed package"})
+		case planned[other]:
+			conflicts = append(conflicts, PlanConflict{Package: pkgName, With: other, Reason: "conflicts with planned package"})
+		}
+	}
+	return conflicts
+}
+
+// check prints the unresolved dependencies and fails if the plan has conflicts
+func (r *resolver) check() error {
+	for _, missing := range r.missing {
+		fmt.Fprintf(os.Stderr, "  Warning: %s\n", missing)
+	}
+
+	conflicts := r.conflicts()
+	if len(conflicts) == 0 {
+		return nil
+	}
+	for _, conflict := range conflicts {
+		fmt.Printf("  %s\n", conflict)
+	}
+	return fmt.Errorf("%d package conflict(s), nothing was installed", len(conflicts))
+}
+
+// planInstall resolves names against the index and returns the resolver
+// holding the plan, dependencies first
+func (pm *PackageManager) planInstall(names []string) (*resolver, error) {
+	r, err := pm.newResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if err := r.require(name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// executePlan downloads and verifies every package of plan in parallel,
+// then installs them one by one in plan order. Packages of the plan that
+// are installed are upgraded in place.
+func (pm *PackageManager) executePlan(plan []*IndexEntry) error {
+	if len(plan) == 0 {
+		return nil
+	}
+
+	installed := make(map[string]Package)
+	for _, pkg := range pm.tx.packages {
+		installed[pkg.Name] = pkg
+	}
+	var installs, upgrades []string
+	for _, entry := range plan {
+		if old, ok := installed[entry.Name]; ok {
+			upgrades = append(upgrades, fmt.Sprintf("%s %s -> %s", entry.Name, old.Version, entry.Version))
+		} else {
+			installs = append(installs, entry.Name)
+		}
+	}
+	if len(installs) > 0 {
+		fmt.Printf("Packages to install (%d): %s\n", len(installs), strings.Join(installs, " "))
+	}
+	if len(upgrades) > 0 {
+		fmt.Printf("Packages to upgrade (%d):\n", len(upgrades))
+		for _, upgrade := range upgrades {
+			fmt.Printf("  %s\n", upgrade)
+		}
+	}
+
+	apkFiles, cleanup, err := pm.fetchPlan(plan)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	for i, entry := range plan {
+		if err := pm.context().Err(); err != nil {
+			return err
+		}
+		if old, ok := installed[entry.Name]; ok {
+			err = pm.upgradeFromFile(old, apkFiles[i])
+		} else {
+			err = pm.installFromFile(entry.Name, apkFiles[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchPlan downloads and verifies every package of plan in parallel and
+// returns their local files in plan order. cleanup removes the files that
+// could not be kept in the package cache.
+func (pm *PackageManager) fetchPlan(plan []*IndexEntry) ([]string, func(), error) {
+	type downloadResult struct {
+		apkFile string
+		cleanup func()
+		err     error
+	}
+
+	// Load the trusted keys up front; the workers share them
+	pm.loadKeys()
+
+	jobs := make(chan int, len(plan))
+	results := make([]downloadResult, len(plan))
+
+	workers := maxDownloadWorkers
+	if len(plan) < workers {
+		workers = len(plan)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				entry := plan[i]
+				apkFile, cleanup, err := pm.fetchPackage(entry)
+				if err != nil {
+					results[i] = downloadResult{err: fmt.Errorf("failed to download %s: %w", entry.Name, err)}
+					continue
+				}
+				if err := pm.checkTrust(entry.Name, pm.verifyPackage(apkFile, entry)); err != nil {
+					cleanup()
+					results[i] = downloadResult{err: err}
+					continue
+				}
+				results[i] = downloadResult{apkFile: apkFile, cleanup: cleanup}
+			}
+		}()
+	}
+
+	for i := range plan {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	cleanup := func() {
+		for _, result := range results {
+			if result.cleanup != nil {
+				result.cleanup()
+			}
+		}
+	}
+
+	apkFiles := make([]string, len(plan))
+	for i, result := range results {
+		if result.err != nil {
+			cleanup()
+			return nil, nil, result.err
+		}
+		apkFiles[i] = result.apkFile
+	}
+	if pm.tx != nil {
+		pm.tx.fetched = append(pm.tx.fetched, apkFiles...)
+	}
+	return apkFiles, cleanup, nil
+}
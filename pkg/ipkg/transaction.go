@@ -0,0 +1,551 @@
+package ipkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// transaction groups the changes of one install or remove. It holds an
+// exclusive lock on the package database for its whole lifetime, keeps the
+// database in memory until commit, and journals every file it puts into the
+// rootfs so that a failure anywhere restores the previous state.
+type transaction struct {
+	pm       *PackageManager
+	lock     *os.File
+	apkLock  *os.File
+	workDir  string
+	packages []Package
+	before   []Package
+	owners   map[string]string
+	journal  []journalEntry
+	touched  map[string]bool
+	staged   int
+
+	// fetched lists the package files the transaction downloaded or took
+	// from the package cache, which cache eviction leaves alone
+	fetched []string
+}
+
+// journalEntry records how to undo one change to the rootfs
+type journalEntry struct {
+	path   string // absolute path in the rootfs
+	backup string // previous content, or "" if path did not exist
+	dir    bool   // path is a directory created by the transaction
+}
+
+// begin locks the package database and starts a transaction. Only one
+// transaction can run against a database at a time; others wait.
+func (pm *PackageManager) begin() (*transaction, error) {
+	if err := pm.ensureDB(); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockFile(pm.db + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &transaction{pm: pm, lock: lock, touched: make(map[string]bool)}
+
+	// Keep apk out while the transaction runs, as it uses the same lock
+	apkLock := filepath.Join(pm.rootfs, apkLockPath)
+	if err := os.MkdirAll(filepath.Dir(apkLock), 0755); err != nil {
+		tx.unlock()
+		return nil, fmt.Errorf("create apk db dir: %w", err)
+	}
+	if tx.apkLock, err = lockFile(apkLock); err != nil {
+		tx.unlock()
+		return nil, err
+	}
+
+	packages, err := pm.readDatabase()
+	if err != nil {
+		tx.unlock()
+		return nil, err
+	}
+
+	// Packages installed before /etc/apk/world was kept all go into it, as
+	// it is not known which were asked for and apk removes the others
+	if _, err := os.Stat(filepath.Join(pm.rootfs, apkWorldPath)); os.IsNotExist(err) {
+		for i := range packages {
+			packages[i].Explicit = true
+		}
+	}
+	tx.packages = packages
+	tx.before = append([]Package(nil), packages...)
+
+	tx.owners = make(map[string]string)
+	for _, pkg := range packages {
+		for _, name := range pkg.Files {
+			tx.owners[name] = pkg.Name
+		}
+	}
+
+	tx.workDir = filepath.Join(filepath.Dir(pm.db), fmt.Sprintf(".tx-%d", os.Getpid()))
+	os.RemoveAll(tx.workDir)
+	if err := os.MkdirAll(tx.workDir, 0755); err != nil {
+		tx.unlock()
+		return nil, fmt.Errorf("create transaction dir: %w", err)
+	}
+
+	pm.tx = tx
+	return tx, nil
+}
+
+// lockFile takes an exclusive lock on path, waiting if another process holds it
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open db lock: %w", err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		fmt.Println("Waiting for another package operation to finish...")
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("lock db: %w", err)
+	}
+
+	return file, nil
+}
+
+// finish commits the transaction if err is nil and rolls it back otherwise
+func (tx *transaction) finish(err error) error {
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	return tx.commit()
+}
+
+// commit writes the database, records the transaction in the history,
+// runs the triggers of the changed paths and discards the backups of
+// replaced files
+func (tx *transaction) commit() error {
+	if err := tx.pm.writeDatabase(tx.packages); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	if err := tx.pm.syncToApk(tx.packages); err != nil {
+		fmt.Fprintf(os.Stderr, "  Warning: failed to update the apk database: %v\n", err)
+	}
+
+	if err := tx.pm.recordHistory(historyChanges(tx.before, tx.packages)); err != nil {
+		fmt.Fprintf(os.Stderr, "  Warning: failed to record history: %v\n", err)
+	}
+
+	var changed []string
+	for _, entry := range tx.journal {
+		if !entry.dir {
+			changed = append(changed, entry.path)
+		}
+	}
+	tx.journal = nil
+
+	tx.runTriggers(changed)
+	tx.close()
+	return nil
+}
+
+// rollback undoes every file change in reverse order and leaves the
+// database untouched
+func (tx *transaction) rollback() {
+	if len(tx.journal) > 0 {
+		fmt.Println("Rolling back changes...")
+	}
+	tx.undo(0)
+	tx.close()
+}
+
+// undo reverts the journal back to its first n entries
+func (tx *transaction) undo(n int) {
+	for i := len(tx.journal) - 1; i >= n; i-- {
+		entry := tx.journal[i]
+		switch {
+		case entry.dir:
+			// Only succeeds if nothing else was put there meanwhile
+			os.Remove(entry.path)
+		case entry.backup != "":
+			os.Remove(entry.path)
+			os.MkdirAll(filepath.Dir(entry.path), 0755)
+			if err := os.Rename(entry.backup, entry.path); err != nil {
+				fmt.Fprintf(os.Stderr, "  Warning: failed to restore %s: %v\n", entry.path, err)
+			}
+		default:
+			os.Remove(entry.path)
+		}
+		delete(tx.touched, entry.path)
+	}
+	tx.journal = tx.journal[:n]
+}
+
+func (tx *transaction) close() {
+	os.RemoveAll(tx.workDir)
+	tx.pm.tx = nil
+	tx.unlock()
+
+	// Trim the package cache once the packages are in place, rather than
+	// while they are still being fetched
+	if len(tx.fetched) > 0 {
+		if cache, err := OpenPackageCache(); err == nil {
+			cache.evict(tx.fetched)
+		}
+	}
+}
+
+func (tx *transaction) unlock() {
+	for _, lock := range []*os.File{tx.apkLock, tx.lock} {
+		if lock != nil {
+			syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+			lock.Close()
+		}
+	}
+}
+
+// addPackage records pkg in the transaction's database and makes it the
+// owner of its files, taking them away from any package that had them
+func (tx *transaction) addPackage(pkg Package) {
+	for _, name := range pkg.Files {
+		if owner, ok := tx.owners[name]; ok && owner != pkg.Name {
+			tx.disown(owner, name)
+		}
+		tx.owners[name] = pkg.Name
+	}
+	tx.packages = append(tx.packages, pkg)
+}
+
+// setPin records the repository tag pkgName was installed from
+func (tx *transaction) setPin(pkgName, tag string) {
+	for i := range tx.packages {
+		if tx.packages[i].Name == pkgName {
+			tx.packages[i].Pin = tag
+		}
+	}
+}
+
+// setScriptPending records whether the post-install script of pkgName
+// still has to run
+func (tx *transaction) setScriptPending(pkgName string, pending bool) {
+	for i := range tx.packages {
+		if tx.packages[i].Name == pkgName {
+			tx.packages[i].ScriptPending = pending
+		}
+	}
+}
+
+// setExplicit marks pkgName as asked for by name
+func (tx *transaction) setExplicit(pkgName string) {
+	for i := range tx.packages {
+		if tx.packages[i].Name == pkgName {
+			tx.packages[i].Explicit = true
+		}
+	}
+}
+
+// removePackage drops pkgName from the transaction's database
+func (tx *transaction) removePackage(pkgName string) {
+	filtered := []Package{}
+	for _, pkg := range tx.packages {
+		if pkg.Name != pkgName {
+			filtered = append(filtered, pkg)
+			continue
+		}
+		for _, name := range pkg.Files {
+			if tx.owners[name] == pkgName {
+				delete(tx.owners, name)
+			}
+		}
+	}
+	tx.packages = filtered
+}
+
+// disown removes name from the file list of pkgName
+func (tx *transaction) disown(pkgName, name string) {
+	for i := range tx.packages {
+		if tx.packages[i].Name != pkgName {
+			continue
+		}
+		files := tx.packages[i].Files[:0:0]
+		for _, file := range tx.packages[i].Files {
+			if file != name {
+				files = append(files, file)
+			}
+		}
+		tx.packages[i].Files = files
+		delete(tx.packages[i].Checksums, name)
+		delete(tx.packages[i].Manifest, name)
+	}
+}
+
+// held reports whether pkgName is installed and held
+func (tx *transaction) held(pkgName string) bool {
+	for _, pkg := range tx.packages {
+		if pkg.Name == pkgName {
+			return pkg.Held
+		}
+	}
+	return false
+}
+
+// checksum returns the recorded checksum of a config file of pkgName
+func (tx *transaction) checksum(pkgName, name string) string {
+	for _, pkg := range tx.packages {
+		if pkg.Name == pkgName {
+			return pkg.Checksums[name]
+		}
+	}
+	return ""
+}
+
+// stage extracts apkFile into the transaction's staging area and then moves
+// its files into the rootfs, backing up whatever they replace. Files owned
+// by another package are a conflict unless ForceOverwrite is set, and
+// config files under /etc that were changed since they were installed are
+// kept, with the package's version written next to them as .apk-new.
+// It returns the installed files and their manifest.
+// A package that fails to extract or move leaves the rootfs as it was before.
+func (tx *transaction) stage(pkgName, apkFile string) ([]string, map[string]FileRecord, error) {
+	tx.staged++
+	stagingDir := filepath.Join(tx.workDir, fmt.Sprintf("stage-%d", tx.staged))
+	defer os.RemoveAll(stagingDir)
+
+	files, err := ExtractPackage(apkFile, stagingDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, name := range files {
+		owner, ok := tx.owners[name]
+		if !ok || owner == pkgName {
+			continue
+		}
+		if tx.held(owner) {
+			return nil, nil, fmt.Errorf("file conflict: /%s is owned by %s, which is held", name, owner)
+		}
+		if !tx.pm.ForceOverwrite {
+			return nil, nil, fmt.Errorf("file conflict: /%s is owned by %s (use --force-overwrite to replace it)", name, owner)
+		}
+		fmt.Fprintf(os.Stderr, "  Warning: overwriting /%s owned by %s\n", name, owner)
+	}
+
+	manifest := make(map[string]FileRecord)
+	savepoint := len(tx.journal)
+	for _, name := range files {
+		record, err := readFileRecord(filepath.Join(stagingDir, name))
+		if err != nil {
+			tx.undo(savepoint)
+			return nil, nil, err
+		}
+		manifest[name] = record
+
+		dest := name
+		if isConfigFile(stagingDir, name) {
+			if tx.configModified(name, record.SHA256) {
+				dest = name + ".apk-new"
+				fmt.Printf("  Keeping modified /%s, new version saved as /%s\n", name, dest)
+			}
+		}
+
+		if err := tx.place(stagingDir, name, dest); err != nil {
+			tx.undo(savepoint)
+			return nil, nil, fmt.Errorf("install %s: %w", name, err)
+		}
+	}
+
+	return files, manifest, nil
+}
+
+// configModified reports whether the config file name in the rootfs holds
+// local changes that installing a file with checksum sum would lose: it
+// differs from the new version and from the version its owner installed
+func (tx *transaction) configModified(name, sum string) bool {
+	target := filepath.Join(tx.pm.rootfs, name)
+	if tx.touched[target] {
+		return false
+	}
+
+	info, err := os.Lstat(target)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	current, err := fileChecksum(target)
+	if err != nil || current == sum {
+		return false
+	}
+
+	if owner, ok := tx.owners[name]; ok && tx.checksum(owner, name) == current {
+		return false
+	}
+
+	return true
+}
+
+// place moves the staged file name into the rootfs as dest
+func (tx *transaction) place(stagingDir, name, dest string) error {
+	target := filepath.Join(tx.pm.rootfs, dest)
+
+	if err := tx.mkdirs(stagingDir, filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	if err := tx.backup(target); err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(stagingDir, name), target)
+}
+
+// backup moves the file at target out of the way, journaling it so that
+// rollback puts it back. Only the first change to a path is journaled.
+func (tx *transaction) backup(target string) error {
+	if tx.touched[target] {
+		return nil
+	}
+
+	entry := journalEntry{path: target}
+	if info, err := os.Lstat(target); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", target)
+		}
+		rel, err := filepath.Rel(tx.pm.rootfs, target)
+		if err != nil {
+			return err
+		}
+		entry.backup = filepath.Join(tx.workDir, "backup", rel)
+		if err := os.MkdirAll(filepath.Dir(entry.backup), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(target, entry.backup); err != nil {
+			return err
+		}
+	}
+
+	tx.journal = append(tx.journal, entry)
+	tx.touched[target] = true
+	return nil
+}
+
+// writeFile writes a file into the rootfs as part of the transaction
+func (tx *transaction) writeFile(target string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := tx.backup(target); err != nil {
+		return err
+	}
+	return os.WriteFile(target, data, perm)
+}
+
+// removeFile deletes a file from the rootfs as part of the transaction
+func (tx *transaction) removeFile(target string) error {
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return nil
+	}
+	return tx.backup(target)
+}
+
+// isConfigFile reports whether the staged file name is a protected config file
+func isConfigFile(stagingDir, name string) bool {
+	if !strings.HasPrefix(name, "etc/") {
+		return false
+	}
+	info, err := os.Lstat(filepath.Join(stagingDir, name))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// fileChecksum returns the hex SHA-256 of a file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mkdirs creates the missing directories of dir in the rootfs with the
+// modes they have in the staging area, journaling each one
+func (tx *transaction) mkdirs(stagingDir, dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+
+	target := filepath.Join(tx.pm.rootfs, dir)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+
+	if err := tx.mkdirs(stagingDir, filepath.Dir(dir)); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0755)
+	if info, err := os.Stat(filepath.Join(stagingDir, dir)); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.Mkdir(target, mode); err != nil {
+		return err
+	}
+
+	tx.journal = append(tx.journal, journalEntry{path: target, dir: true})
+	return nil
+}
+
+// writeFileAtomic replaces path with data so that readers see either the
+// old or the new content, never a partial write
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeDatabase atomically replaces the installed package database
+func (pm *PackageManager) writeDatabase(packages []Package) error {
+	data, err := json.MarshalIndent(packages, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal db: %w", err)
+	}
+
+	if err := writeFileAtomic(pm.db, data, 0644); err != nil {
+		return fmt.Errorf("write db: %w", err)
+	}
+
+	return nil
+}
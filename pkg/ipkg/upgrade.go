@@ -0,0 +1,67 @@
+package ipkg
+
+import (
+	"context"
+	"fmt"
+)
+
+// Upgrade replaces the named installed packages, or every installed
+// package, with the version the index offers when it is newer, as one
+// transaction. Packages installed from a tagged repository are upgraded
+// from it; new dependencies of the upgraded versions are installed first.
+// Every package is downloaded before anything changes. Held packages are
+// left at their version.
+func (pm *PackageManager) Upgrade(ctx context.Context, pkgNames []string) error {
+	pm.ctx = ctx
+	tx, err := pm.begin()
+	if err != nil {
+		return err
+	}
+	return tx.finish(pm.upgrade(pkgNames))
+}
+
+func (pm *PackageManager) upgrade(pkgNames []string) error {
+	selected, err := selectPackages(pm.tx.packages, pkgNames, pm.resolvePackageName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Resolving upgrades...")
+	r, err := pm.newResolver()
+	if err != nil {
+		return err
+	}
+
+	var plan []*IndexEntry
+	for _, pkg := range selected {
+		entry := r.candidate(pkg.Name, pkg.Pin)
+		if entry == nil || compareVersions(entry.Version, pkg.Version) <= 0 {
+			continue
+		}
+		if pkg.Held {
+			fmt.Printf("  %s is held at %s, not upgrading to %s\n", pkg.Name, pkg.Version, entry.Version)
+			continue
+		}
+		if pkg.Pin != "" {
+			r.pins[entry.Name] = pkg.Pin
+		}
+		r.upgrading[entry.Name] = pkg.Version
+		r.versions[entry.Name] = entry.Version
+		plan = append(plan, entry)
+	}
+
+	if len(plan) == 0 {
+		fmt.Println("All packages are up to date")
+		return nil
+	}
+
+	// The new versions come after the dependencies they add, and every
+	// package is fetched before anything is changed
+	for _, entry := range plan {
+		r.visit(entry)
+	}
+	if err := r.check(); err != nil {
+		return err
+	}
+	return pm.executePlan(r.plan)
+}
@@ -0,0 +1,333 @@
+package ipkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Alpine's public signing keys, fetched into keys/ by `make keys`
+//
+//go:embed keys
+var bundledKeys embed.FS
+
+// ErrUntrusted is returned when a package or index fails verification
+var ErrUntrusted = errors.New("untrusted")
+
+// userKeysDir returns the directory holding additional trusted keys
+func userKeysDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "isobox", "keys")
+}
+
+// loadKeys collects the trusted RSA public keys, keyed by file name. Keys
+// come from the bundled set, the environment's /etc/apk/keys and the user's
+// ~/.config/isobox/keys directory. It fails if none of them has a key, as
+// every index and package would then be untrusted.
+func (pm *PackageManager) loadKeys() (map[string]*rsa.PublicKey, error) {
+	if pm.keys != nil {
+		return pm.keys, pm.keysErr
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+
+	fs.WalkDir(bundledKeys, "keys", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".rsa.pub") {
+			return nil
+		}
+		if data, err := bundledKeys.ReadFile(path); err == nil {
+			addKey(keys, d.Name(), data)
+		}
+		return nil
+	})
+	dirs := []string{filepath.Join(pm.rootfs, "etc/apk/keys"), userKeysDir()}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pub") {
+				continue
+			}
+			if data, err := os.ReadFile(filepath.Join(dir, entry.Name())); err == nil {
+				addKey(keys, entry.Name(), data)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		pm.keysErr = fmt.Errorf("%w: no trusted signing keys: this isobox was built without Alpine's keys in pkg/ipkg/keys ('make keys' bundles them) and none are in /etc/apk/keys or %s", ErrUntrusted, userKeysDir())
+	}
+
+	pm.keys = keys
+	return keys, pm.keysErr
+}
+
+func addKey(keys map[string]*rsa.PublicKey, name string, data []byte) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		fmt.Fprintf(os.Stderr, "  Warning: ignoring key %s: not PEM encoded\n", name)
+		return
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "  Warning: ignoring key %s: %v\n", name, err)
+		return
+	}
+
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "  Warning: ignoring key %s: not an RSA key\n", name)
+		return
+	}
+
+	keys[name] = rsaKey
+}
+
+// splitGzipStreams returns the raw compressed bytes of each gzip member in
+// data. APK files and indexes are concatenations of separately compressed
+// signature, control and data streams, and signatures cover the compressed
+// bytes, so the boundaries matter.
+func splitGzipStreams(data []byte) ([][]byte, error) {
+	var streams [][]byte
+
+	// bytes.Reader implements io.ByteReader, so gzip reads exactly one
+	// member without buffering past its end
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		start := len(data) - r.Len()
+
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		gzr.Multistream(false)
+		if _, err := io.Copy(io.Discard, gzr); err != nil {
+			return nil, err
+		}
+
+		end := len(data) - r.Len()
+		streams = append(streams, data[start:end])
+	}
+
+	return streams, nil
+}
+
+// readSignature returns the key name, hash and signature stored in the
+// signature stream of an APK or APKINDEX
+func readSignature(stream []byte) (string, crypto.Hash, []byte, bool) {
+	gzr, err := gzip.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return "", 0, nil, false
+	}
+	gzr.Multistream(false)
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return "", 0, nil, false
+		}
+
+		var hash crypto.Hash
+		var keyName string
+		switch {
+		case strings.HasPrefix(header.Name, ".SIGN.RSA256."):
+			hash, keyName = crypto.SHA256, strings.TrimPrefix(header.Name, ".SIGN.RSA256.")
+		case strings.HasPrefix(header.Name, ".SIGN.RSA."):
+			hash, keyName = crypto.SHA1, strings.TrimPrefix(header.Name, ".SIGN.RSA.")
+		default:
+			continue
+		}
+
+		sig, err := io.ReadAll(tr)
+		if err != nil {
+			return "", 0, nil, false
+		}
+		return keyName, hash, sig, true
+	}
+}
+
+// verifySignature checks that the first stream of data is a valid signature
+// over the second stream, made by one of the trusted keys
+func (pm *PackageManager) verifySignature(streams [][]byte) error {
+	if len(streams) < 2 {
+		return fmt.Errorf("%w: archive is not signed", ErrUntrusted)
+	}
+
+	keyName, hash, sig, ok := readSignature(streams[0])
+	if !ok {
+		return fmt.Errorf("%w: archive is not signed", ErrUntrusted)
+	}
+
+	keys, err := pm.loadKeys()
+	if err != nil {
+		return err
+	}
+	key, ok := keys[keyName]
+	if !ok {
+		return fmt.Errorf("%w: signed with unknown key %s", ErrUntrusted, keyName)
+	}
+
+	h := hash.New()
+	h.Write(streams[1])
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig); err != nil {
+		return fmt.Errorf("%w: bad signature from %s", ErrUntrusted, keyName)
+	}
+
+	return nil
+}
+
+// controlChecksum formats the checksum of a control stream the way APKINDEX
+// stores it: "Q1" followed by the base64 SHA-1
+func controlChecksum(control []byte) string {
+	sum := sha1.Sum(control)
+	return "Q1" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// controlStream returns the control stream of an APKv2 package split into
+// streams, skipping its signature, or nil if there is none
+func controlStream(streams [][]byte) []byte {
+	if len(streams) == 0 {
+		return nil
+	}
+	if _, _, _, signed := readSignature(streams[0]); signed {
+		if len(streams) < 2 {
+			return nil
+		}
+		return streams[1]
+	}
+	return streams[0]
+}
+
+// verifyPackage checks a downloaded APK against its index entry. An APKv2
+// package is trusted when its control checksum matches a signed index, or
+// when it carries its own valid signature. The data stream is always checked
+// against the datahash recorded in .PKGINFO.
+func (pm *PackageManager) verifyPackage(apkFile string, entry *IndexEntry) error {
+	// APKv3 packages carry their own signature over the metadata, and the
+	// metadata holds the hash of every file, which extraction checks
+	if isADB(apkFile) {
+		pkg, err := readPackageADB(apkFile)
+		if err != nil {
+			return fmt.Errorf("%w: corrupt archive: %v", ErrUntrusted, err)
+		}
+		if entry != nil && entry.Checksum != "" {
+			if sum := pkg.checksum(entry.Checksum); sum != entry.Checksum {
+				return fmt.Errorf("%w: checksum mismatch for %s (index %s, got %s)", ErrUntrusted, entry.Name, entry.Checksum, sum)
+			}
+			if entry.trusted {
+				return nil
+			}
+		}
+		keys, err := pm.loadKeys()
+		if err != nil {
+			return err
+		}
+		return pkg.verifySignature(keys)
+	}
+
+	data, err := os.ReadFile(apkFile)
+	if err != nil {
+		return err
+	}
+
+	streams, err := splitGzipStreams(data)
+	if err != nil {
+		return fmt.Errorf("%w: corrupt archive: %v", ErrUntrusted, err)
+	}
+
+	// Signed packages are signature + control + data, unsigned ones control + data
+	controlIdx := 0
+	if _, _, _, signed := readSignature(streams[0]); signed {
+		controlIdx = 1
+	}
+	if len(streams) <= controlIdx {
+		return fmt.Errorf("%w: missing control stream", ErrUntrusted)
+	}
+	control := streams[controlIdx]
+
+	trusted := false
+	if entry != nil && entry.Checksum != "" {
+		if sum := controlChecksum(control); sum != entry.Checksum {
+			return fmt.Errorf("%w: checksum mismatch for %s (index %s, got %s)", ErrUntrusted, entry.Name, entry.Checksum, sum)
+		}
+		trusted = entry.trusted
+	}
+
+	if !trusted {
+		if err := pm.verifySignature(streams); err != nil {
+			return err
+		}
+	}
+
+	info := parsePkgInfoStream(control)
+	if info.DataHash != "" {
+		h := sha256.New()
+		for _, stream := range streams[controlIdx+1:] {
+			h.Write(stream)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != info.DataHash {
+			return fmt.Errorf("%w: data hash mismatch", ErrUntrusted)
+		}
+	}
+
+	return nil
+}
+
+// parsePkgInfoStream reads .PKGINFO from a single control stream
+func parsePkgInfoStream(control []byte) *pkgInfo {
+	gzr, err := gzip.NewReader(bytes.NewReader(control))
+	if err != nil {
+		return &pkgInfo{}
+	}
+	gzr.Multistream(false)
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return &pkgInfo{}
+		}
+		if header.Name == ".PKGINFO" {
+			return parsePkgInfo(tr)
+		}
+	}
+}
+
+// checkTrust turns a verification failure into a warning when untrusted
+// packages are explicitly allowed
+func (pm *PackageManager) checkTrust(what string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if pm.AllowUntrusted && errors.Is(err, ErrUntrusted) {
+		fmt.Fprintf(os.Stderr, "  WARNING: %s failed verification (%v), continuing because of --allow-untrusted\n", what, err)
+		return nil
+	}
+	return fmt.Errorf("%s failed verification: %w (use --allow-untrusted to override)", what, err)
+}
@@ -0,0 +1,72 @@
+package ipkg
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeys(t *testing.T) {
+	key := testKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	tests := []struct {
+		name     string
+		envKey   bool
+		userKey  bool
+		wantKeys int
+	}{
+		{"environment key", true, false, 1},
+		{"user key", false, true, 1},
+		{"both", true, true, 2},
+		{"no keys", false, false, 0},
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	bundled, _ := NewRootfsPackageManager(t.TempDir(), DefaultBranch, "x86_64").loadKeys()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantKeys == 0 && len(bundled) > 0 {
+				t.Skip("built with bundled keys")
+			}
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			rootfs := t.TempDir()
+
+			write := func(dir, name string) {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, name), pub, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.envKey {
+				write(filepath.Join(rootfs, "etc/apk/keys"), "env.rsa.pub")
+			}
+			if tt.userKey {
+				write(filepath.Join(home, ".config/isobox/keys"), "user.rsa.pub")
+			}
+
+			pm := NewRootfsPackageManager(rootfs, DefaultBranch, "x86_64")
+			keys, err := pm.loadKeys()
+			if got := len(keys) - len(bundled); got != tt.wantKeys {
+				t.Errorf("loadKeys() found %d keys besides the bundled ones, want %d", got, tt.wantKeys)
+			}
+			if len(keys) == 0 && !errors.Is(err, ErrUntrusted) {
+				t.Errorf("loadKeys() with no keys = %v, want ErrUntrusted", err)
+			}
+			if len(keys) > 0 && err != nil {
+				t.Errorf("loadKeys() = %v, want success", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package ipkg
+
+import (
+	"strconv"
+	"strings"
+)
+
+// suffixRanks orders the apk version suffixes; a version without a suffix
+// ranks between _rc and _cvs
+var suffixRanks = map[string]int{
+	"alpha": 0,
+	"beta":  1,
+	"pre":   2,
+	"rc":    3,
+	"":      4,
+	"cvs":   5,
+	"svn":   6,
+	"git":   7,
+	"hg":    8,
+	"p":     9,
+}
+
+// apkVersion is a parsed version like "1.2.3b_rc1_p2-r4"
+type apkVersion struct {
+	numbers  []int64
+	letter   byte
+	suffixes [][2]int64 // rank and number
+	revision int64
+}
+
+func parseVersion(v string) apkVersion {
+	var version apkVersion
+
+	if i := strings.LastIndex(v, "-r"); i >= 0 {
+		version.revision, _ = strconv.ParseInt(v[i+2:], 10, 64)
+		v = v[:i]
+	}
+	if i := strings.IndexByte(v, '~'); i >= 0 {
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, "_")
+	base := parts[0]
+	if n := len(base); n > 0 && base[n-1] >= 'a' && base[n-1] <= 'z' {
+		version.letter = base[n-1]
+		base = base[:n-1]
+	}
+	for _, number := range strings.Split(base, ".") {
+		n, _ := strconv.ParseInt(number, 10, 64)
+		version.numbers = append(version.numbers, n)
+	}
+
+	for _, suffix := range parts[1:] {
+		name := strings.TrimRight(suffix, "0123456789")
+		rank, ok := suffixRanks[name]
+		if !ok {
+			rank = suffixRanks[""]
+		}
+		n, _ := strconv.ParseInt(suffix[len(name):], 10, 64)
+		version.suffixes = append(version.suffixes, [2]int64{int64(rank), n})
+	}
+
+	return version
+}
+
+// compareVersions compares two apk package versions the way apk orders
+// them, returning -1, 0 or 1
+func compareVersions(a, b string) int {
+	va, vb := parseVersion(a), parseVersion(b)
+
+	for i := 0; i < len(va.numbers) || i < len(vb.numbers); i++ {
+		if i >= len(va.numbers) {
+			return -1
+		}
+		if i >= len(vb.numbers) {
+			return 1
+		}
+		if c := compareInt(va.numbers[i], vb.numbers[i]); c != 0 {
+			return c
+		}
+	}
+
+	if c := compareInt(int64(va.letter), int64(vb.letter)); c != 0 {
+		return c
+	}
+
+	none := [2]int64{int64(suffixRanks[""]), 0}
+	for i := 0; i < len(va.suffixes) || i < len(vb.suffixes); i++ {
+		sa, sb := none, none
+		if i < len(va.suffixes) {
+			sa = va.suffixes[i]
+		}
+		if i < len(vb.suffixes) {
+			sb = vb.suffixes[i]
+		}
+		if c := compareInt(sa[0], sb[0]); c != 0 {
+			return c
+		}
+		if c := compareInt(sa[1], sb[1]); c != 0 {
+			return c
+		}
+	}
+
+	return compareInt(va.revision, vb.revision)
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// splitConstraint splits a dependency like "python3>=3.11" into its name,
+// comparison operator and version; op is empty when there is no constraint
+func splitConstraint(dep string) (name, op, version string) {
+	i := strings.IndexAny(dep, "=<>~")
+	if i < 0 {
+		return strings.TrimSpace(dep), "", ""
+	}
+	j := i
+	for j < len(dep) && strings.IndexByte("=<>~", dep[j]) >= 0 {
+		j++
+	}
+	return strings.TrimSpace(dep[:i]), dep[i:j], strings.TrimSpace(dep[j:])
+}
+
+// satisfiesVersion reports whether version meets the constraint op want
+func satisfiesVersion(version, op, want string) bool {
+	c := compareVersions(version, want)
+	switch op {
+	case "", "*":
+		return true
+	case "=", "==":
+		return c == 0
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	case "~", "~=":
+		return version == want || strings.HasPrefix(version, want+".") ||
+			strings.HasPrefix(version, want+"-") || strings.HasPrefix(version, want+"_")
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package ipkg
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0-r0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.2.3", "1.2", 1},
+		{"1.2", "1.2.0", -1},
+		{"2.0", "10.0", -1},
+		{"1.0-r1", "1.0-r0", 1},
+		{"1.0-r10", "1.0-r9", 1},
+		{"1.0a", "1.0", 1},
+		{"1.0b", "1.0a", 1},
+		{"1.0_alpha1", "1.0_beta1", -1},
+		{"1.0_beta2", "1.0_beta10", -1},
+		{"1.0_pre1", "1.0_rc1", -1},
+		{"1.0_rc1", "1.0", -1},
+		{"1.0", "1.0_p1", -1},
+		{"1.0_cvs", "1.0", 1},
+		{"1.0_git20240101", "1.0_p1", -1},
+		{"1.0_p1", "1.0_p2", -1},
+		{"1.0_rc1_p2", "1.0_rc1_p1", 1},
+		{"1.0_rc1-r5", "1.0-r0", -1},
+		{"1.0~abc123-r0", "1.0-r0", 0},
+		{"8.5.0-r0", "8.11.1-r0", -1},
+		{"3.12.4-r0", "3.12.4-r1", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			if got := compareVersions(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := compareVersions(tt.b, tt.a); got != -tt.want {
+				t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestSatisfiesVersion(t *testing.T) {
+	tests := []struct {
+		dep     string
+		version string
+		want    bool
+	}{
+		{"python3", "3.12.4-r0", true},
+		{"python3>=3.11", "3.12.4-r0", true},
+		{"python3>=3.13", "3.12.4-r0", false},
+		{"curl=8.5.0-r0", "8.5.0-r0", true},
+		{"curl=8.5.0-r0", "8.5.0-r1", false},
+		{"musl<1.3", "1.2.5-r0", true},
+		{"musl>1.2.5-r0", "1.2.5-r0", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dep, func(t *testing.T) {
+			_, op, want := splitConstraint(tt.dep)
+			if got := satisfiesVersion(tt.version, op, want); got != tt.want {
+				t.Errorf("%s satisfied by %s = %v, want %v", tt.dep, tt.version, got, tt.want)
+			}
+		})
+	}
+}
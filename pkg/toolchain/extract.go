@@ -0,0 +1,103 @@
+package toolchain
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extract unpacks a release tarball into dest, dropping the top-level
+// directory every release wraps its files in (go/, node-v20.../, python/)
+func extract(ctx context.Context, tarball, dest string) error {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gzr)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := stripComponent(header.Name)
+		if name == "" {
+			continue
+		}
+		target := filepath.Join(dest, name)
+		if !strings.HasPrefix(target, dest+string(os.PathSeparator)) {
+			return fmt.Errorf("%s escapes the toolchain directory", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0700); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			linked := stripComponent(header.Linkname)
+			if linked == "" {
+				return fmt.Errorf("invalid hard link %s", header.Name)
+			}
+			if err := os.Link(filepath.Join(dest, linked), target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// stripComponent removes the first path element of a tarball entry name
+func stripComponent(name string) string {
+	name = strings.TrimPrefix(name, "./")
+	_, rest, _ := strings.Cut(name, "/")
+	return strings.TrimSuffix(rest, "/")
+}
@@ -0,0 +1,84 @@
+package toolchain
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EnvMirrorsPath returns the toolchain mirrors file of the environment at rootfs
+func EnvMirrorsPath(rootfs string) string {
+	return filepath.Join(rootfs, "etc/isobox/toolchains")
+}
+
+// GlobalMirrorsPath returns the host-wide toolchain mirrors file
+func GlobalMirrorsPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "isobox", "toolchains")
+}
+
+// mirror returns where releases of toolchain name are downloaded from. The
+// environment's /etc/isobox/toolchains wins over the global
+// ~/.config/isobox/toolchains, which wins over the official download sites.
+// Each line of these files names a toolchain and its mirror:
+//
+//	# toolchain  url
+//	go      https://mirror.internal/golang
+//	node    https://mirror.internal/node-musl
+//	python  https://mirror.internal/python-build-standalone
+func (m *Manager) mirror(name string) (string, error) {
+	for _, path := range []string{EnvMirrorsPath(m.rootfs), GlobalMirrorsPath()} {
+		if path == "" {
+			continue
+		}
+
+		mirrors, err := readMirrors(path)
+		if err != nil {
+			return "", err
+		}
+		if url, ok := mirrors[name]; ok {
+			return url, nil
+		}
+	}
+
+	return kinds[name].mirror, nil
+}
+
+// readMirrors parses a toolchain mirrors file; a missing file has no mirrors
+func readMirrors(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mirrors := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("parse %s: line %d: expected a toolchain name and a URL", path, lineNo)
+		}
+		if _, ok := kinds[fields[0]]; !ok {
+			return nil, fmt.Errorf("parse %s: line %d: unknown toolchain %s", path, lineNo, fields[0])
+		}
+		mirrors[fields[0]] = strings.TrimSuffix(fields[1], "/")
+	}
+
+	return mirrors, scanner.Err()
+}
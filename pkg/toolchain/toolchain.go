@@ -0,0 +1,445 @@
+// Package toolchain installs language toolchains (Go, Node.js, Python) from
+// their official release tarballs into an environment, side by side under
+// /opt/toolchains, and switches the default version of each.
+package toolchain
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/javanhut/isobox/pkg/ipkg"
+)
+
+// Dir is where toolchains are installed inside an environment
+const Dir = "opt/toolchains"
+
+// binDir holds the links to the executables of the default versions
+const binDir = "usr/local/bin"
+
+// kind describes where the releases of one toolchain are published
+type kind struct {
+	// mirror is the default download location
+	mirror string
+
+	// archive returns the path of the release tarball for an Alpine
+	// architecture and of the file holding its SHA-256, both relative to
+	// the mirror
+	archive func(version, build, arch string) (string, string, error)
+
+	// build, if set, finds the build tag of a version when the spec leaves
+	// it out; it is only consulted for the default mirror
+	build func(ctx context.Context, version, arch string) (string, error)
+}
+
+var kinds = map[string]kind{
+	// Go release binaries are statically linked and run on musl as is
+	"go": {
+		mirror: "https://go.dev/dl",
+		archive: func(version, build, arch string) (string, string, error) {
+			goArch, ok := map[string]string{
+				"x86_64":      "amd64",
+				"x86":         "386",
+				"aarch64":     "arm64",
+				"armv7":       "armv6l",
+				"armhf":       "armv6l",
+				"ppc64le":     "ppc64le",
+				"s390x":       "s390x",
+				"riscv64":     "riscv64",
+				"loongarch64": "loong64",
+			}[arch]
+			if !ok {
+				return "", "", fmt.Errorf("no Go release for %s", arch)
+			}
+			file := fmt.Sprintf("go%s.linux-%s.tar.gz", version, goArch)
+			return file, file + ".sha256", nil
+		},
+	},
+
+	// The official Node.js builds need glibc; the musl builds are published
+	// as unofficial builds by the Node.js project
+	"node": {
+		mirror: "https://unofficial-builds.nodejs.org/download/release",
+		archive: func(version, build, arch string) (string, string, error) {
+			nodeArch, ok := map[string]string{"x86_64": "x64", "aarch64": "arm64"}[arch]
+			if !ok {
+				return "", "", fmt.Errorf("no Node.js musl release for %s", arch)
+			}
+			file := fmt.Sprintf("v%s/node-v%s-linux-%s-musl.tar.gz", version, version, nodeArch)
+			return file, fmt.Sprintf("v%s/SHASUMS256.txt", version), nil
+		},
+	},
+
+	// python.org only publishes sources; python-build-standalone publishes
+	// relocatable musl builds, tagged with the date of their release
+	"python": {
+		mirror: "https://github.com/astral-sh/python-build-standalone/releases/download",
+		archive: func(version, build, arch string) (string, string, error) {
+			if build == "" {
+				return "", "", fmt.Errorf("python needs the python-build-standalone release date with this mirror, as in python@%s+20240726", version)
+			}
+			file, err := pythonArchive(version, build, arch)
+			if err != nil {
+				return "", "", err
+			}
+			return build + "/" + file, build + "/SHA256SUMS", nil
+		},
+		build: pythonBuild,
+	},
+}
+
+// pythonReleases lists the python-build-standalone releases, newest first
+const pythonReleases = "https://api.github.com/repos/astral-sh/python-build-standalone/releases?per_page=100"
+
+// pythonArchive returns the name of the python-build-standalone tarball of
+// a Python version from the release tagged build
+func pythonArchive(version, build, arch string) (string, error) {
+	triple, ok := map[string]string{"x86_64": "x86_64-unknown-linux-musl", "aarch64": "aarch64-unknown-linux-musl"}[arch]
+	if !ok {
+		return "", fmt.Errorf("no Python musl release for %s", arch)
+	}
+	return fmt.Sprintf("cpython-%s+%s-%s-install_only.tar.gz", version, build, triple), nil
+}
+
+// pythonBuild finds the newest python-build-standalone release that has a
+// build of version for arch and returns its tag, the release date
+func pythonBuild(ctx context.Context, version, arch string) (string, error) {
+	data, err := ipkg.FetchURL(ctx, pythonReleases)
+	if err != nil {
+		return "", fmt.Errorf("list python-build-standalone releases: %w", err)
+	}
+
+	var releases []struct {
+		Tag    string `json:"tag_name"`
+		Assets []struct {
+			Name string `json:"name"`
+		} `json:"assets"`
+	}
+	if err := json.Unmarshal(data, &releases); err != nil {
+		return "", fmt.Errorf("parse python-build-standalone releases: %w", err)
+	}
+
+	for _, release := range releases {
+		file, err := pythonArchive(version, release.Tag, arch)
+		if err != nil {
+			return "", err
+		}
+		for _, asset := range release.Assets {
+			if asset.Name == file {
+				return release.Tag, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no recent python-build-standalone release has Python %s; name the release date, as in python@%s+20240726", version, version)
+}
+
+// Manager installs and selects toolchains in the environment at rootfs
+type Manager struct {
+	rootfs string
+	arch   string
+}
+
+// NewManager returns a toolchain manager for the environment whose root
+// filesystem is rootfs ("/" inside the environment). Releases are chosen
+// for the architecture of the environment.
+func NewManager(rootfs string) *Manager {
+	return &Manager{rootfs: rootfs, arch: ipkg.EnvironmentArch(rootfs)}
+}
+
+// ParseSpec splits a toolchain spec like "go@1.22.5" or
+// "python@3.12.4+20240726" into name, version and build
+func ParseSpec(spec string) (string, string, string, error) {
+	name, version, ok := strings.Cut(spec, "@")
+	if !ok || version == "" {
+		return "", "", "", fmt.Errorf("invalid toolchain %q, expected name@version as in go@1.22.5", spec)
+	}
+	if _, ok := kinds[name]; !ok {
+		return "", "", "", fmt.Errorf("unknown toolchain %s (known: %s)", name, strings.Join(Names(), ", "))
+	}
+
+	version = strings.TrimPrefix(version, "v")
+	version, build, _ := strings.Cut(version, "+")
+	return name, version, build, nil
+}
+
+// Names returns the supported toolchains
+func Names() []string {
+	var names []string
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// path returns where version of toolchain name is installed in the rootfs
+func (m *Manager) path(name, version string) string {
+	return filepath.Join(m.rootfs, Dir, name, version)
+}
+
+// Install downloads, verifies and unpacks a toolchain release. The first
+// version installed of a toolchain becomes its default.
+func (m *Manager) Install(ctx context.Context, spec string) error {
+	name, version, build, err := ParseSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	dest := m.path(name, version)
+	if _, err := os.Stat(dest); err == nil {
+		fmt.Printf("%s %s is already installed\n", name, version)
+		return nil
+	}
+
+	mirror, err := m.mirror(name)
+	if err != nil {
+		return err
+	}
+	if build == "" && kinds[name].build != nil && mirror == kinds[name].mirror {
+		if build, err = kinds[name].build(ctx, version, m.arch); err != nil {
+			return err
+		}
+		fmt.Printf("Using the %s build of %s %s\n", build, name, version)
+	}
+	archive, sums, err := kinds[name].archive(version, build, m.arch)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Installing %s %s...\n", name, version)
+
+	tarball, err := m.fetch(ctx, mirror+"/"+archive, mirror+"/"+sums)
+	if err != nil {
+		return err
+	}
+
+	// Unpack next to the final location and move it into place at the end,
+	// so an interrupted install leaves nothing behind
+	staging := dest + ".partial"
+	os.RemoveAll(staging)
+	defer os.RemoveAll(staging)
+
+	fmt.Printf("  Unpacking to /%s/%s/%s...\n", Dir, name, version)
+	if err := extract(ctx, tarball, staging); err != nil {
+		return fmt.Errorf("unpack %s: %w", filepath.Base(archive), err)
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		return fmt.Errorf("install %s %s: %w", name, version, err)
+	}
+
+	if _, err := os.Lstat(m.currentLink(name)); os.IsNotExist(err) {
+		return m.Use(name + "@" + version)
+	}
+
+	fmt.Printf("Installed %s %s; run 'isobox toolchain use %s@%s' to make it the default\n", name, version, name, version)
+	return nil
+}
+
+// fetch downloads the release tarball at url into the user's toolchain
+// cache, reusing a cached copy, and checks it against the SHA-256 published
+// at sumsURL. The checksum comes from the same mirror as the tarball, so it
+// catches corrupt and truncated downloads but not a compromised mirror.
+func (m *Manager) fetch(ctx context.Context, url, sumsURL string) (string, error) {
+	sums, err := ipkg.FetchURL(ctx, sumsURL)
+	if err != nil {
+		return "", fmt.Errorf("fetch checksum %s: %w", sumsURL, err)
+	}
+	want, err := findChecksum(sums, filepath.Base(url))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", sumsURL, err)
+	}
+
+	cacheDir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(cacheDir, filepath.Base(url))
+
+	if got, err := fileSHA256(path); err == nil && got == want {
+		fmt.Printf("  Using cached %s\n", filepath.Base(url))
+		return path, nil
+	}
+
+	fmt.Printf("  Downloading %s...\n", url)
+	tmp := path + ".partial"
+	if err := ipkg.DownloadURL(ctx, url, tmp); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("download %s: %w", url, err)
+	}
+
+	got, err := fileSHA256(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if got != want {
+		os.Remove(tmp)
+		return "", fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filepath.Base(url), want, got)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+// findChecksum returns the SHA-256 of file from a checksum file, which is
+// either a bare hash or "<hash>  <file>" lines as written by sha256sum
+func findChecksum(data []byte, file string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 1:
+			return strings.ToLower(fields[0]), nil
+		case len(fields) >= 2 && filepath.Base(strings.TrimPrefix(fields[1], "*")) == file:
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s", file)
+}
+
+// fileSHA256 returns the hex SHA-256 of a file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheDir returns ~/.cache/isobox/toolchains, where release tarballs are
+// kept for reuse by every environment
+func cacheDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".cache", "isobox", "toolchains")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// currentLink is the link naming the default version of toolchain name
+func (m *Manager) currentLink(name string) string {
+	return filepath.Join(m.rootfs, Dir, name, "current")
+}
+
+// Use makes an installed version the default: /opt/toolchains/<name>/current
+// points to it, and its executables are linked from /usr/local/bin, ahead
+// of any Alpine package of the same toolchain on PATH
+func (m *Manager) Use(spec string) error {
+	name, version, _, err := ParseSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(m.path(name, version)); err != nil {
+		return fmt.Errorf("%s %s is not installed; run 'isobox toolchain install %s@%s' first", name, version, name, version)
+	}
+
+	// Replace the current link atomically
+	link := m.currentLink(name)
+	tmp := link + ".new"
+	os.Remove(tmp)
+	if err := os.Symlink(version, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := m.linkExecutables(name); err != nil {
+		return err
+	}
+
+	fmt.Printf("Now using %s %s\n", name, version)
+	return nil
+}
+
+// linkExecutables points /usr/local/bin at the executables of the current
+// version of name, removing links left by the previous version
+func (m *Manager) linkExecutables(name string) error {
+	binPath := filepath.Join(m.rootfs, binDir)
+	if err := os.MkdirAll(binPath, 0755); err != nil {
+		return err
+	}
+
+	// Links are absolute paths inside the environment
+	prefix := "/" + filepath.Join(Dir, name, "current", "bin") + "/"
+
+	entries, err := os.ReadDir(binPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(binPath, entry.Name()))
+		if err == nil && strings.HasPrefix(target, prefix) {
+			os.Remove(filepath.Join(binPath, entry.Name()))
+		}
+	}
+
+	executables, err := os.ReadDir(filepath.Join(m.currentLink(name), "bin"))
+	if err != nil {
+		return fmt.Errorf("read executables of %s: %w", name, err)
+	}
+	for _, executable := range executables {
+		link := filepath.Join(binPath, executable.Name())
+		if _, err := os.Lstat(link); err == nil {
+			fmt.Printf("  Warning: /%s/%s already exists, not linking it\n", binDir, executable.Name())
+			continue
+		}
+		if err := os.Symlink(prefix+executable.Name(), link); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List shows the installed versions of every toolchain, marking the defaults
+func (m *Manager) List() error {
+	found := false
+	for _, name := range Names() {
+		entries, err := os.ReadDir(filepath.Join(m.rootfs, Dir, name))
+		if err != nil {
+			continue
+		}
+		current, _ := os.Readlink(m.currentLink(name))
+
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasSuffix(entry.Name(), ".partial") {
+				continue
+			}
+			marker := " "
+			if entry.Name() == current {
+				marker = "*"
+			}
+			fmt.Printf("%s %s@%s\n", marker, name, entry.Name())
+			found = true
+		}
+	}
+
+	if !found {
+		fmt.Println("No toolchains installed")
+	}
+	return nil
+}